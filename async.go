@@ -0,0 +1,259 @@
+// +build amd64
+
+package zlib
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// AsyncWriterOptions configures an AsyncWriter. The zero value selects the
+// defaults.
+type AsyncWriterOptions struct {
+	// Writer configures the compression, as in NewWriterOpts. Its
+	// BufferSize is also the size of the output buffers, and its
+	// CloseUnderlying makes Close close w once the goroutines are done.
+	// SplitSize isn't supported. Progress runs on the compressing goroutine,
+	// and its OutputBytes includes output that w hasn't received yet.
+	Writer WriterOptions
+	// ChunkSize is the amount of input handed to the compressing goroutine
+	// at a time. It defaults to DefaultParallelChunkSize.
+	ChunkSize int
+	// Buffers is the number of input chunks, and of output buffers, in the
+	// pipeline. It defaults to 2, which lets deflate work on a chunk while
+	// the previous output is written. The buffers take up to about
+	// Buffers*(ChunkSize+BufferSize) bytes.
+	Buffers int
+}
+
+// asyncOp is the kind of an asyncMsg.
+type asyncOp int
+
+const (
+	asyncData asyncOp = iota
+	asyncFlush
+	asyncClose
+)
+
+// asyncMsg is a step of the pipeline of an AsyncWriter.
+type asyncMsg struct {
+	op   asyncOp
+	data []byte // input or output of asyncData.
+	// done receives the first error of the pipeline once an asyncFlush or
+	// asyncClose has gone through it.
+	done chan error
+}
+
+// AsyncWriter is a gzip writer that compresses and writes on background
+// goroutines. Write copies the input into chunks that one goroutine
+// compresses, while another writes the output to the underlying writer, so
+// that the caller, deflate and a slow destination such as a network
+// connection all make progress at the same time. The output is that of a
+// Writer with the same options.
+//
+// Errors of the underlying writer happen in the background. The next Write,
+// Flush or Close returns the first of them, as do all the calls after that.
+// Close must be called to stop the goroutines. Like Writer, an AsyncWriter
+// isn't safe for concurrent use.
+type AsyncWriter struct {
+	in  chan asyncMsg // chunks for compress.
+	out chan asyncMsg // output for push.
+	// Free input chunks and output buffers; nil ones are allocated on first
+	// use.
+	inFree, outFree chan []byte
+	wg              sync.WaitGroup
+	w               io.Writer
+	closeOut        bool
+	chunkSize       int
+	bufSize         int
+	cur             []byte // chunk being filled by Write; nil if none.
+	closed          bool
+	closeErr        error
+	mu              sync.Mutex
+	err             error // first error of the pipeline, guarded by mu.
+}
+
+// NewAsyncWriter returns a writer of a gzip stream to w that compresses it in
+// the background as configured by opts.
+func NewAsyncWriter(w io.Writer, opts AsyncWriterOptions) (*AsyncWriter, error) {
+	if opts.Writer.SplitSize != 0 {
+		return nil, errors.New("zlib: SplitSize with AsyncWriter")
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = DefaultParallelChunkSize
+	}
+	if opts.Buffers <= 0 {
+		opts.Buffers = 2
+	}
+	a := &AsyncWriter{
+		in:        make(chan asyncMsg, opts.Buffers),
+		out:       make(chan asyncMsg, opts.Buffers),
+		inFree:    make(chan []byte, opts.Buffers),
+		outFree:   make(chan []byte, opts.Buffers),
+		w:         w,
+		closeOut:  opts.Writer.CloseUnderlying,
+		chunkSize: opts.ChunkSize,
+	}
+	zw, err := NewWriterOpts(asyncSink{a}, opts.Writer)
+	if err != nil {
+		return nil, err
+	}
+	a.bufSize = len(zw.(*writer).outBuf)
+	for i := 0; i < opts.Buffers; i++ {
+		a.inFree <- nil
+		a.outFree <- nil
+	}
+	a.wg.Add(2)
+	go a.compress(zw)
+	go a.push()
+	return a, nil
+}
+
+func (a *AsyncWriter) setErr(err error) {
+	a.mu.Lock()
+	if a.err == nil {
+		a.err = err
+	}
+	a.mu.Unlock()
+}
+
+func (a *AsyncWriter) loadErr() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+// compress runs zw on the messages of in, and hands the output to push
+// through asyncSink.
+func (a *AsyncWriter) compress(zw Writer) {
+	defer a.wg.Done()
+	defer close(a.out)
+	for msg := range a.in {
+		var err error
+		switch msg.op {
+		case asyncData:
+			_, err = zw.Write(msg.data)
+			a.inFree <- msg.data[:0]
+		case asyncFlush:
+			err = zw.Flush()
+		case asyncClose:
+			err = zw.Close()
+		}
+		if err != nil {
+			a.setErr(err)
+		}
+		if msg.op != asyncData {
+			a.out <- asyncMsg{op: msg.op, done: msg.done}
+		}
+	}
+}
+
+// asyncSink is the underlying writer of the Writer of an AsyncWriter. It
+// copies the output into the buffers of push.
+type asyncSink struct{ a *AsyncWriter }
+
+func (s asyncSink) Write(p []byte) (int, error) {
+	if err := s.a.loadErr(); err != nil {
+		return 0, err
+	}
+	n := 0
+	for len(p) > 0 {
+		b := <-s.a.outFree
+		if b == nil {
+			b = make([]byte, 0, s.a.bufSize)
+		}
+		m := copy(b[:cap(b)], p)
+		s.a.out <- asyncMsg{op: asyncData, data: b[:m]}
+		n += m
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// push writes the output to the underlying writer. After an error, it keeps
+// recycling the buffers so that the other goroutines don't block.
+func (a *AsyncWriter) push() {
+	defer a.wg.Done()
+	for msg := range a.out {
+		if msg.op != asyncData {
+			msg.done <- a.loadErr()
+			continue
+		}
+		if a.loadErr() == nil {
+			if _, err := writeFull(a.w, msg.data); err != nil {
+				a.setErr(err)
+			}
+		}
+		a.outFree <- msg.data[:0]
+	}
+}
+
+// Write implements io.Writer. It returns once the input has been copied into
+// the pipeline, which blocks while all the chunks are in use.
+func (a *AsyncWriter) Write(b []byte) (int, error) {
+	if a.closed {
+		return 0, ErrWriterClosed
+	}
+	if err := a.loadErr(); err != nil {
+		return 0, err
+	}
+	n := 0
+	for len(b) > 0 {
+		if a.cur == nil {
+			if a.cur = <-a.inFree; a.cur == nil {
+				a.cur = make([]byte, 0, a.chunkSize)
+			}
+		}
+		m := copy(a.cur[len(a.cur):a.chunkSize], b)
+		a.cur = a.cur[:len(a.cur)+m]
+		n += m
+		b = b[m:]
+		if len(a.cur) == a.chunkSize {
+			a.in <- asyncMsg{op: asyncData, data: a.cur}
+			a.cur = nil
+		}
+	}
+	return n, nil
+}
+
+// sync sends the current chunk and op through the pipeline, and waits for
+// them to be written.
+func (a *AsyncWriter) sync(op asyncOp) error {
+	if len(a.cur) > 0 {
+		a.in <- asyncMsg{op: asyncData, data: a.cur}
+		a.cur = nil
+	}
+	done := make(chan error, 1)
+	a.in <- asyncMsg{op: op, done: done}
+	return <-done
+}
+
+// Flush compresses all the data written so far with a sync flush, and waits
+// until the underlying writer has received the output, as Writer.Flush.
+func (a *AsyncWriter) Flush() error {
+	if a.closed {
+		return ErrWriterClosed
+	}
+	return a.sync(asyncFlush)
+}
+
+// Close writes the rest of the stream, waits until the underlying writer has
+// received it, and stops the goroutines. It only closes the underlying writer
+// with WriterOptions.CloseUnderlying. Closing again returns the same result
+// without doing anything.
+func (a *AsyncWriter) Close() error {
+	if a.closed {
+		return a.closeErr
+	}
+	a.closed = true
+	a.closeErr = a.sync(asyncClose)
+	close(a.in)
+	a.wg.Wait()
+	if c, ok := a.w.(io.Closer); ok && a.closeOut {
+		if err := c.Close(); a.closeErr == nil {
+			a.closeErr = err
+		}
+	}
+	return a.closeErr
+}
@@ -0,0 +1,570 @@
+// +build amd64
+
+package zlib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// bgzfEOF is the empty block that ends a BGZF file.
+var bgzfEOF = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43,
+	0x02, 0x00, 0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+// bgzfMaxBlockSize is the maximum compressed and decompressed size of a BGZF
+// block.
+const bgzfMaxBlockSize = 64 * 1024
+
+// bgzfHeader is the header of a BGZF block, up to the BSIZE field of the BC
+// extra subfield, as written by bgzip.
+var bgzfHeader = bgzfEOF[:16]
+
+// bgzfHeaderSize and bgzfTrailerSize are the sizes of the header and trailer
+// of a BGZF block.
+const (
+	bgzfHeaderSize  = 18
+	bgzfTrailerSize = 8
+)
+
+// BGZFDefaultBlockSize is the largest, and default, amount of data that
+// BGZFWriter compresses into a block, like bgzip. It leaves room for the
+// framing of incompressible data within the 64KB blocks.
+const BGZFDefaultBlockSize = 0xff00
+
+// ErrNotBGZF is returned by BGZFReader when a gzip member doesn't have the BC
+// extra subfield that tells the size of a BGZF block.
+var ErrNotBGZF = errors.New("zlib: not a BGZF block")
+
+// VirtualOffset is a BGZF virtual file offset: the compressed offset of a
+// block in the upper 48 bits, and the offset in the decompressed block in the
+// lower 16 bits.
+type VirtualOffset uint64
+
+// NewVirtualOffset returns the virtual offset of the uncompressed-th byte of
+// the block that starts at compressed.
+func NewVirtualOffset(compressed int64, uncompressed int) VirtualOffset {
+	return VirtualOffset(compressed<<16 | int64(uncompressed))
+}
+
+// Compressed returns the offset of the block in the compressed file.
+func (v VirtualOffset) Compressed() int64 {
+	return int64(v >> 16)
+}
+
+// Uncompressed returns the offset in the decompressed block.
+func (v VirtualOffset) Uncompressed() int {
+	return int(v & 0xffff)
+}
+
+// BGZFReader decompresses a BGZF file, as written by bgzip, and seeks to its
+// virtual offsets. Each block is decoded with a Reader.
+type BGZFReader struct {
+	src   io.ReadSeeker
+	base  int64 // offset of the file in src.
+	br    *bufio.Reader
+	lr    io.LimitedReader // feeds the current block from br to zr.
+	zr    Reader
+	block []byte // decoded current block.
+	pos   int    // offset of the next byte to return in block.
+	start int64  // compressed offset of the current block.
+	next  int64  // compressed offset of the next block.
+	// eofMarker is true if the current block is the EOF marker.
+	eofMarker bool
+	err       error
+}
+
+// NewBGZFReader returns a reader of the BGZF file that starts at the current
+// offset of r. Virtual offsets are relative to that offset. It fails with
+// ErrNotBGZF if the first block isn't a BGZF block.
+func NewBGZFReader(r io.ReadSeeker) (*BGZFReader, error) {
+	base, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	b := &BGZFReader{
+		src:   r,
+		base:  base,
+		br:    bufio.NewReaderSize(r, bgzfMaxBlockSize),
+		block: make([]byte, 0, bgzfMaxBlockSize+1),
+	}
+	b.lr.R = b.br
+	b.zr, err = NewReaderOpts(&b.lr, ReaderOptions{Buffer: make([]byte, bgzfMaxBlockSize)})
+	if err != nil {
+		return nil, err
+	}
+	if err = b.loadBlock(); err != nil {
+		b.zr.Close()
+		if err == io.EOF {
+			err = ErrNotBGZF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// bgzfBlockSize parses the header of the block at the start of br, and returns
+// the size of the block. It returns io.EOF if br has no more input.
+func bgzfBlockSize(br *bufio.Reader) (int64, error) {
+	h, err := br.Peek(12)
+	if len(h) < 12 {
+		if len(h) == 0 && err == io.EOF {
+			return 0, io.EOF
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	if h[0] != 0x1f || h[1] != 0x8b || h[2] != 8 || h[3]&4 == 0 {
+		return 0, ErrNotBGZF
+	}
+	xlen := int(binary.LittleEndian.Uint16(h[10:]))
+	h, err = br.Peek(12 + xlen)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	for extra := h[12:]; len(extra) >= 4; {
+		n := 4 + int(binary.LittleEndian.Uint16(extra[2:]))
+		if n > len(extra) {
+			break
+		}
+		if extra[0] == 'B' && extra[1] == 'C' && n == 6 {
+			size := int64(binary.LittleEndian.Uint16(extra[4:])) + 1
+			if size < int64(12+xlen+8) {
+				break
+			}
+			return size, nil
+		}
+		extra = extra[n:]
+	}
+	return 0, ErrNotBGZF
+}
+
+// loadBlock decodes the block at next. It returns io.EOF at the end of the
+// file.
+func (b *BGZFReader) loadBlock() error {
+	size, err := bgzfBlockSize(b.br)
+	if err != nil {
+		return err
+	}
+	marker := false
+	if size == int64(len(bgzfEOF)) {
+		h, _ := b.br.Peek(len(bgzfEOF))
+		marker = bytes.Equal(h, bgzfEOF)
+	}
+	b.lr.N = size
+	buf := b.block[:cap(b.block)]
+	n, err := inflateBGZFBlock(b.zr, &b.lr, buf)
+	if err == nil && b.lr.N != 0 {
+		err = errBGZFShort
+	}
+	if err == errBGZFLong || err == errBGZFShort {
+		err = fmt.Errorf("zlib: BGZF block at %d %v", b.next, err)
+	}
+	if err != nil {
+		return err
+	}
+	b.block = buf[:n]
+	b.pos = 0
+	b.start = b.next
+	b.next += size
+	b.eofMarker = marker
+	return nil
+}
+
+var (
+	errBGZFLong  = fmt.Errorf("block is larger than %d bytes", bgzfMaxBlockSize)
+	errBGZFShort = errors.New("block is shorter than its BSIZE")
+)
+
+// inflateBGZFBlock decodes the single block read from src with zr into buf,
+// which must have room for one byte more than a block, and returns its size.
+func inflateBGZFBlock(zr Reader, src io.Reader, buf []byte) (int, error) {
+	if err := zr.Reset(src); err != nil {
+		return 0, err
+	}
+	zr.Multistream(false)
+	var err error
+	n := 0
+	for err == nil && n < len(buf) {
+		var m int
+		m, err = zr.Read(buf[n:])
+		n += m
+	}
+	if err == nil {
+		return 0, errBGZFLong
+	}
+	if err != io.EOF {
+		return 0, err
+	}
+	if len(zr.Remaining()) != 0 {
+		return 0, errBGZFShort
+	}
+	return n, nil
+}
+
+// Read implements io.Reader. It returns io.ErrUnexpectedEOF if the file
+// doesn't end with the EOF marker block, which tells that it is truncated.
+func (b *BGZFReader) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	for b.pos == len(b.block) {
+		if err := b.loadBlock(); err != nil {
+			if err == io.EOF && !b.eofMarker {
+				err = io.ErrUnexpectedEOF
+			}
+			b.err = err
+			return 0, err
+		}
+	}
+	n := copy(p, b.block[b.pos:])
+	b.pos += n
+	return n, nil
+}
+
+// Tell returns the virtual offset of the next byte that Read returns. At the
+// end of a block, it is the offset of the start of the next block.
+func (b *BGZFReader) Tell() VirtualOffset {
+	if b.pos == len(b.block) {
+		return NewVirtualOffset(b.next, 0)
+	}
+	return NewVirtualOffset(b.start, b.pos)
+}
+
+// Seek moves to the virtual offset v, which must point into a block, or to
+// its end, or to the end of the file.
+func (b *BGZFReader) Seek(v VirtualOffset) error {
+	if _, err := b.src.Seek(b.base+v.Compressed(), io.SeekStart); err != nil {
+		return err
+	}
+	b.br.Reset(b.src)
+	b.block = b.block[:0]
+	b.pos = 0
+	b.start, b.next = v.Compressed(), v.Compressed()
+	b.err = nil
+	err := b.loadBlock()
+	if err == io.EOF && v.Uncompressed() == 0 {
+		b.eofMarker = true
+		return nil
+	}
+	if err == nil && v.Uncompressed() > len(b.block) {
+		err = fmt.Errorf("zlib: virtual offset %d is past the end of its block", v)
+	}
+	if err != nil {
+		b.err = err
+		return err
+	}
+	b.pos = v.Uncompressed()
+	return nil
+}
+
+// Close frees the decoder. It doesn't close the file.
+func (b *BGZFReader) Close() error {
+	return b.zr.Close()
+}
+
+// bgzfResult is a block decoded by a worker of ParallelBGZFReader.
+type bgzfResult struct {
+	data []byte
+	err  error
+}
+
+// bgzfJob is a compressed block for a worker of ParallelBGZFReader to decode.
+type bgzfJob struct {
+	block  []byte
+	result chan<- bgzfResult
+}
+
+// ParallelBGZFReader decompresses a BGZF file with several goroutines. Since
+// BGZF blocks are independent, workers decode them concurrently, each with its
+// own zstream, while Read returns their output in file order. At most a few
+// blocks per worker, of 64KB compressed and 64KB decoded each, are in flight
+// at any time.
+type ParallelBGZFReader struct {
+	order  chan chan bgzfResult // results of the blocks in file order.
+	done   chan struct{}        // closed to stop the goroutines.
+	cancel sync.Once
+	wg     sync.WaitGroup
+	cur    []byte // the decoded block being returned by Read.
+	pos    int
+	err    error
+}
+
+// NewParallelBGZFReader returns a reader of the BGZF file read from r that
+// decodes with the given number of workers, or GOMAXPROCS workers if workers
+// isn't positive.
+func NewParallelBGZFReader(r io.Reader, workers int) (*ParallelBGZFReader, error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	p := &ParallelBGZFReader{
+		order: make(chan chan bgzfResult, 2*workers),
+		done:  make(chan struct{}),
+	}
+	jobs := make(chan bgzfJob)
+	zrs := make([]Reader, workers)
+	for i := range zrs {
+		zr, err := NewReaderOpts(nil, ReaderOptions{Buffer: make([]byte, bgzfMaxBlockSize)})
+		if err != nil {
+			for _, zr := range zrs[:i] {
+				zr.Close()
+			}
+			return nil, err
+		}
+		zrs[i] = zr
+	}
+	p.wg.Add(1 + workers)
+	go p.split(bufio.NewReaderSize(r, bgzfMaxBlockSize), jobs)
+	for _, zr := range zrs {
+		go p.decode(zr, jobs)
+	}
+	return p, nil
+}
+
+// split reads the blocks of the file from br and hands them to the workers.
+func (p *ParallelBGZFReader) split(br *bufio.Reader, jobs chan<- bgzfJob) {
+	defer p.wg.Done()
+	defer close(jobs)
+	marker := false
+	for {
+		result := make(chan bgzfResult, 1)
+		select {
+		case p.order <- result:
+		case <-p.done:
+			return
+		}
+		size, err := bgzfBlockSize(br)
+		if err == io.EOF && !marker {
+			// The file doesn't end with the EOF marker; it may be truncated.
+			err = io.ErrUnexpectedEOF
+		}
+		var block []byte
+		if err == nil {
+			block = make([]byte, size)
+			_, err = io.ReadFull(br, block)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		if err != nil {
+			result <- bgzfResult{err: err}
+			return
+		}
+		marker = bytes.Equal(block, bgzfEOF)
+		select {
+		case jobs <- bgzfJob{block: block, result: result}:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// decode decodes blocks until split runs out of them, then frees zr.
+func (p *ParallelBGZFReader) decode(zr Reader, jobs <-chan bgzfJob) {
+	defer p.wg.Done()
+	defer zr.Close()
+	for job := range jobs {
+		buf := make([]byte, bgzfMaxBlockSize+1)
+		n, err := inflateBGZFBlock(zr, bytes.NewReader(job.block), buf)
+		job.result <- bgzfResult{data: buf[:n], err: err}
+	}
+}
+
+// stop makes the goroutines exit.
+func (p *ParallelBGZFReader) stop() {
+	p.cancel.Do(func() { close(p.done) })
+}
+
+// Read implements io.Reader. Once a block fails to decode, the goroutines are
+// stopped, and Read returns the error from then on.
+func (p *ParallelBGZFReader) Read(b []byte) (int, error) {
+	for p.pos == len(p.cur) {
+		if p.err != nil {
+			return 0, p.err
+		}
+		res := <-<-p.order
+		if res.err != nil {
+			p.err = res.err
+			p.stop()
+			continue
+		}
+		p.cur, p.pos = res.data, 0
+	}
+	n := copy(b, p.cur[p.pos:])
+	p.pos += n
+	return n, nil
+}
+
+// Close stops the goroutines and waits for them to exit, which includes
+// waiting for a Read of the source in progress to return. It doesn't close the
+// source.
+func (p *ParallelBGZFReader) Close() error {
+	p.stop()
+	p.wg.Wait()
+	if p.err == nil || p.err == io.EOF {
+		p.err = ErrReaderClosed
+		return nil
+	}
+	return p.err
+}
+
+// BGZFWriter compresses data into a BGZF file, which tabix and samtools can
+// index: a sequence of gzip members, called blocks, of at most 64KB, whose
+// header tells their compressed size, followed by an empty block that marks
+// the end of the file. Each block is compressed independently by a Writer and
+// written to the underlying writer once complete.
+type BGZFWriter struct {
+	w         io.Writer
+	zw        Writer       // raw deflate writer of the blocks.
+	out       bytes.Buffer // the block being compressed.
+	block     []byte       // data of the current block.
+	blockSize int
+	offset    int64 // compressed offset of the current block.
+	closed    bool
+	err       error
+}
+
+// NewBGZFWriter returns a writer of a BGZF file to w, with the compression
+// level as in NewWriterLevel and blocks of blockSize bytes of data. Zero
+// selects BGZFDefaultBlockSize, which is also the largest size.
+func NewBGZFWriter(w io.Writer, level int, blockSize int) (*BGZFWriter, error) {
+	if blockSize == 0 {
+		blockSize = BGZFDefaultBlockSize
+	}
+	if blockSize < 0 || blockSize > BGZFDefaultBlockSize {
+		return nil, fmt.Errorf("zlib: invalid BGZF block size %d", blockSize)
+	}
+	opts := levelOptions(level, bgzfMaxBlockSize)
+	opts.Format = FormatRaw
+	b := &BGZFWriter{
+		w:         w,
+		block:     make([]byte, 0, blockSize),
+		blockSize: blockSize,
+	}
+	var err error
+	if b.zw, err = NewWriterOpts(&b.out, opts); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Write implements io.Writer. It writes blocks to the underlying writer as
+// they fill up. Once it fails, every later call returns the same error.
+func (b *BGZFWriter) Write(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrWriterClosed
+	}
+	n := 0
+	for b.err == nil && len(p) > 0 {
+		m := copy(b.block[len(b.block):b.blockSize], p)
+		b.block = b.block[:len(b.block)+m]
+		n += m
+		p = p[m:]
+		if len(b.block) == b.blockSize {
+			b.err = b.flush()
+		}
+	}
+	return n, b.err
+}
+
+// Flush ends the current block, if it has any data, and writes it, so that
+// the next Write starts a new block at Tell. Indexers call it at record
+// boundaries, at the cost of smaller blocks.
+func (b *BGZFWriter) Flush() error {
+	if b.closed {
+		return ErrWriterClosed
+	}
+	if b.err == nil && len(b.block) > 0 {
+		b.err = b.flush()
+	}
+	return b.err
+}
+
+// Tell returns the virtual offset of the next byte that Write takes, relative
+// to the start of the file. Right after Flush, it is the offset of the start
+// of the next block.
+func (b *BGZFWriter) Tell() VirtualOffset {
+	return NewVirtualOffset(b.offset, len(b.block))
+}
+
+// flush compresses the data of the current block into one or more blocks, and
+// writes them.
+func (b *BGZFWriter) flush() error {
+	if err := b.writeBlock(b.block); err != nil {
+		return err
+	}
+	b.block = b.block[:0]
+	return nil
+}
+
+// writeBlock compresses data into a block and writes it, or into two blocks if
+// it doesn't fit.
+func (b *BGZFWriter) writeBlock(data []byte) error {
+	b.out.Reset()
+	b.out.Write(bgzfHeader)
+	b.out.Write([]byte{0, 0}) // BSIZE, patched below.
+	if _, err := b.zw.Write(data); err != nil {
+		return err
+	}
+	// NewMember ends the raw stream and resets zlib for the next block,
+	// without freeing it.
+	if err := b.zw.NewMember(); err != nil {
+		return err
+	}
+	var trailer [bgzfTrailerSize]byte
+	binary.LittleEndian.PutUint32(trailer[:], crc32.ChecksumIEEE(data))
+	binary.LittleEndian.PutUint32(trailer[4:], uint32(len(data)))
+	b.out.Write(trailer[:])
+	block := b.out.Bytes()
+	if len(block) > bgzfMaxBlockSize {
+		// Only possible for data that compresses very badly with a small
+		// window.
+		half := len(data) / 2
+		if err := b.writeBlock(data[:half]); err != nil {
+			return err
+		}
+		return b.writeBlock(data[half:])
+	}
+	binary.LittleEndian.PutUint16(block[bgzfHeaderSize-2:], uint16(len(block)-1))
+	if _, err := writeFull(b.w, block); err != nil {
+		return err
+	}
+	b.offset += int64(len(block))
+	return nil
+}
+
+// Close writes the rest of the data and the EOF marker block, and frees the
+// compressor. It doesn't close the underlying writer.
+func (b *BGZFWriter) Close() error {
+	if b.closed {
+		return b.err
+	}
+	b.closed = true
+	if b.err == nil && len(b.block) > 0 {
+		b.err = b.flush()
+	}
+	if b.err == nil {
+		if _, err := writeFull(b.w, bgzfEOF); err != nil {
+			b.err = err
+		} else {
+			b.offset += int64(len(bgzfEOF))
+		}
+	}
+	if err := b.zw.Close(); b.err == nil {
+		b.err = err
+	}
+	return b.err
+}
@@ -0,0 +1,209 @@
+// +build amd64
+
+package zlib
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"unsafe"
+)
+
+// #include <zlib.h>
+// #include "./zstream.h"
+import "C"
+
+// DictzipReader reads ranges of the decompressed content of a dictzip file, as
+// written by dictzip(1) for dictd. The RA subfield of the gzip header lists
+// the compressed size of each chunk of the content, so ReadAt only decodes the
+// chunks that cover the range. For gzip files without the subfield, ReadAt
+// decodes sequentially from the start.
+type DictzipReader struct {
+	r    io.ReaderAt
+	size int64 // compressed size.
+	// chunkLen is the decompressed size of every chunk but the last; 0 if the
+	// file has no RA subfield.
+	chunkLen int
+	// offsets[i] is the compressed offset of chunk i; offsets[len(offsets)-1]
+	// is the end of the last chunk.
+	offsets []int64
+}
+
+// NewDictzipReader returns a reader of the gzip file of the given size read
+// from r.
+func NewDictzipReader(r io.ReaderAt, size int64) (*DictzipReader, error) {
+	d := &DictzipReader{r: r, size: size}
+	br := bufio.NewReader(io.NewSectionReader(r, 0, size))
+	var h [10]byte
+	if _, err := io.ReadFull(br, h[:]); err != nil {
+		return nil, ErrHeader
+	}
+	if h[0] != 0x1f || h[1] != 0x8b || h[2] != 8 {
+		return nil, ErrHeader
+	}
+	flags := h[3]
+	offset := int64(len(h))
+	if flags&4 != 0 {
+		var xlen [2]byte
+		if _, err := io.ReadFull(br, xlen[:]); err != nil {
+			return nil, ErrHeader
+		}
+		extra := make([]byte, binary.LittleEndian.Uint16(xlen[:]))
+		if _, err := io.ReadFull(br, extra); err != nil {
+			return nil, ErrHeader
+		}
+		offset += int64(len(xlen) + len(extra))
+		if err := d.parseRA(extra); err != nil {
+			return nil, err
+		}
+	}
+	// Skip FNAME and FCOMMENT.
+	for _, flag := range []byte{8, 16} {
+		if flags&flag == 0 {
+			continue
+		}
+		s, err := br.ReadSlice(0)
+		for err == bufio.ErrBufferFull {
+			offset += int64(len(s))
+			s, err = br.ReadSlice(0)
+		}
+		if err != nil {
+			return nil, ErrHeader
+		}
+		offset += int64(len(s))
+	}
+	if flags&2 != 0 {
+		offset += 2
+	}
+	for i := range d.offsets {
+		d.offsets[i] += offset
+	}
+	if n := len(d.offsets); n > 0 && d.offsets[n-1] > size {
+		return nil, errors.New("zlib: dictzip chunks extend past the end of the file")
+	}
+	return d, nil
+}
+
+// parseRA fills chunkLen and offsets, relative to the start of the compressed
+// data, from the RA subfield in the gzip extra field, if it has one.
+func (d *DictzipReader) parseRA(extra []byte) error {
+	for len(extra) >= 4 {
+		n := 4 + int(binary.LittleEndian.Uint16(extra[2:]))
+		if n > len(extra) {
+			return ErrHeader
+		}
+		if extra[0] != 'R' || extra[1] != 'A' {
+			extra = extra[n:]
+			continue
+		}
+		// VER, CHLEN and CHCNT, followed by CHCNT compressed sizes.
+		ra := extra[4:n]
+		if len(ra) < 6 || binary.LittleEndian.Uint16(ra) != 1 {
+			return errors.New("zlib: unsupported dictzip RA subfield")
+		}
+		chunkLen := int(binary.LittleEndian.Uint16(ra[2:]))
+		count := int(binary.LittleEndian.Uint16(ra[4:]))
+		if chunkLen == 0 || len(ra) != 6+2*count {
+			return errors.New("zlib: invalid dictzip RA subfield")
+		}
+		d.chunkLen = chunkLen
+		d.offsets = make([]int64, count+1)
+		for i := 0; i < count; i++ {
+			d.offsets[i+1] = d.offsets[i] + int64(binary.LittleEndian.Uint16(ra[6+2*i:]))
+		}
+		return nil
+	}
+	return nil
+}
+
+// RandomAccess reports whether the file has an RA subfield, so that ReadAt
+// decodes only the chunks it needs.
+func (d *DictzipReader) RandomAccess() bool {
+	return d.chunkLen > 0
+}
+
+// ReadAt implements io.ReaderAt. It may be called concurrently.
+func (d *DictzipReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("zlib: negative offset")
+	}
+	if !d.RandomAccess() {
+		return d.readAtSequential(p, off)
+	}
+	var comp, chunk []byte
+	n := 0
+	for n < len(p) {
+		i := (off + int64(n)) / int64(d.chunkLen)
+		if i >= int64(len(d.offsets)-1) {
+			return n, io.EOF
+		}
+		start, end := d.offsets[i], d.offsets[i+1]
+		if int64(cap(comp)) < end-start {
+			comp = make([]byte, end-start)
+		}
+		comp = comp[:end-start]
+		if m, err := d.r.ReadAt(comp, start); m < len(comp) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		if chunk == nil {
+			chunk = make([]byte, d.chunkLen)
+		}
+		m, err := inflateChunk(comp, chunk)
+		if err != nil {
+			return n, err
+		}
+		pos := int(off + int64(n) - i*int64(d.chunkLen))
+		if pos >= m {
+			// Only the last chunk may be short.
+			return n, io.EOF
+		}
+		n += copy(p[n:], chunk[pos:m])
+	}
+	return n, nil
+}
+
+// readAtSequential implements ReadAt for files without an RA subfield.
+func (d *DictzipReader) readAtSequential(p []byte, off int64) (int, error) {
+	zr, err := NewReader(io.NewSectionReader(d.r, 0, d.size))
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+	if _, err = zr.Discard(off); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	n, err := io.ReadFull(zr, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// inflateChunk decodes comp, a dictzip chunk compressed independently of the
+// others, into out and returns the size of the chunk.
+func inflateChunk(comp, out []byte) (int, error) {
+	if len(comp) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	zs := new(zstream)
+	if ret := C.zs_inflate_init(&zs[0], C.int(FormatRaw.windowBits(maxWindowBits))); ret != C.Z_OK {
+		return 0, zlibReturnCodeToError(ret)
+	}
+	defer C.zs_inflate_end(&zs[0])
+	inLen, outLen := C.int(len(comp)), C.int(len(out))
+	ret := C.zs_inflate(&zs[0], unsafe.Pointer(&comp[0]), &inLen, unsafe.Pointer(&out[0]), &outLen)
+	if ret != C.Z_OK && ret != C.Z_STREAM_END {
+		return 0, inflateError(zs, ret)
+	}
+	if inLen != 0 {
+		return 0, errors.New("zlib: dictzip chunk is longer than the chunk length")
+	}
+	return len(out) - int(outLen), nil
+}
@@ -0,0 +1,497 @@
+// +build amd64
+
+package zlib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"unsafe"
+)
+
+// #include <zlib.h>
+// #include "./zstream.h"
+import "C"
+
+// windowSize is the size of the deflate window, i.e. how far back in the
+// output a match can reach.
+const windowSize = 32 * 1024
+
+// indexChunkSize is the size of the compressed chunks read by BuildIndex and
+// IndexedReader.ReadAt.
+const indexChunkSize = 64 * 1024
+
+// sampleSize is the size of the samples at the start and at the end of the
+// compressed stream whose checksums identify the stream an index was built
+// from.
+const sampleSize = 4096
+
+// accessPoint is a position in a stream from which decoding can start without
+// decoding the data before it.
+type accessPoint struct {
+	out int64 // uncompressed offset.
+	in  int64 // compressed offset of the first byte that isn't fully consumed.
+	// bits is the number of bits of the byte at in-1 that haven't been
+	// consumed yet, 0 to 7.
+	bits int
+	// window is the output of the member before out, up to windowSize bytes.
+	window []byte
+	// member is true if the point is at the header of a member. Decoding
+	// starts with the header then, and bits and window are unused.
+	member bool
+}
+
+// Index lists access points into a gzip or zlib stream, from which
+// IndexedReader can start decoding in the middle of the stream. It is built
+// by BuildIndex.
+type Index struct {
+	points []accessPoint // sorted by out.
+	size   int64
+	span   int64
+	inSize int64 // compressed size of the stream.
+	// headCRC and tailCRC are the CRC-32 of the first and the last sampleSize
+	// bytes of the compressed stream.
+	headCRC, tailCRC uint32
+	// unverified is true if the index was loaded by UnmarshalBinary and
+	// Verify hasn't checked it against the stream yet.
+	unverified bool
+}
+
+// Size returns the decompressed size of the indexed stream.
+func (x *Index) Size() int64 {
+	return x.size
+}
+
+// Len returns the number of access points in the index.
+func (x *Index) Len() int {
+	return len(x.points)
+}
+
+// Span returns the spacing of the access points passed to BuildIndex.
+func (x *Index) Span() int64 {
+	return x.span
+}
+
+// BuildIndex decodes the gzip or zlib stream read from r and returns an index
+// with an access point about every span decompressed bytes, and one at the
+// start of every gzip member. Each access point holds a copy of the 32KB
+// window that precedes it, so a smaller span makes IndexedReader faster to
+// reach an offset at the cost of a larger index. Checksums are verified while
+// the index is built.
+func BuildIndex(r io.Reader, span int64) (*Index, error) {
+	if span <= 0 {
+		return nil, fmt.Errorf("zlib: invalid span %d", span)
+	}
+	zs := new(zstream)
+	if ret := C.zs_inflate_init(&zs[0], C.int(FormatAuto.windowBits(maxWindowBits))); ret != C.Z_OK {
+		return nil, zlibReturnCodeToError(ret)
+	}
+	defer C.zs_inflate_end(&zs[0])
+
+	x := &Index{points: []accessPoint{{member: true}}, span: span}
+	in := make([]byte, indexChunkSize)
+	head := make([]byte, 0, sampleSize)
+	tail := make([]byte, 0, sampleSize)
+	// window is a ring buffer that inflate decodes into directly.
+	window := make([]byte, windowSize)
+	var (
+		inPos, inEnd, winPos int
+		inLen, outLen        C.int
+		totIn, totOut        int64
+		last, memberStart    int64 // offsets of the last point and member.
+		gzip                 bool
+	)
+	for {
+		if inPos == inEnd {
+			n, err := io.ReadAtLeast(r, in, 1)
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return nil, err
+			}
+			if totIn == 0 {
+				gzip = in[0] == 0x1f
+			}
+			inPos, inEnd = 0, n
+		}
+		inLen = C.int(inEnd - inPos)
+		outLen = C.int(windowSize - winPos)
+		ret := C.zs_inflate_block(&zs[0], unsafe.Pointer(&in[inPos]), &inLen, unsafe.Pointer(&window[winPos]), &outLen)
+		nIn := inEnd - inPos - int(inLen)
+		nOut := windowSize - winPos - int(outLen)
+		sampleInput(&head, &tail, in[inPos:inPos+nIn])
+		inPos += nIn
+		totIn += int64(nIn)
+		totOut += int64(nOut)
+		winPos = (winPos + nOut) % windowSize
+		switch ret {
+		case C.Z_OK:
+		case C.Z_NEED_DICT:
+			return nil, ErrDictionaryRequired
+		case C.Z_STREAM_END:
+			if inPos == inEnd && gzip {
+				n, err := io.ReadAtLeast(r, in, 1)
+				if err != nil && err != io.EOF {
+					return nil, err
+				}
+				inPos, inEnd = 0, n
+			}
+			if inPos == inEnd || !gzip {
+				// Only gzip has a notion of concatenated members.
+				x.size = totOut
+				x.inSize = totIn
+				x.headCRC = crc32.ChecksumIEEE(head)
+				x.tailCRC = crc32.ChecksumIEEE(tail)
+				return x, nil
+			}
+			if ret = C.zs_inflate_reset(&zs[0]); ret != C.Z_OK {
+				return nil, zlibReturnCodeToError(ret)
+			}
+			x.points = append(x.points, accessPoint{out: totOut, in: totIn, member: true})
+			last, memberStart = totOut, totOut
+			continue
+		default:
+			return nil, inflateError(zs, ret)
+		}
+
+		// Bit 128 of data_type tells that inflate stopped at the end of a
+		// block, bit 64 that it was the last block of the member.
+		dt := C.zs_get_data_type(&zs[0])
+		if dt&128 == 0 || dt&64 != 0 || totOut-last < span {
+			continue
+		}
+		w := totOut - memberStart
+		if w > windowSize {
+			w = windowSize
+		}
+		p := accessPoint{out: totOut, in: totIn, bits: int(dt & 7), window: make([]byte, w)}
+		if int(w) <= winPos {
+			copy(p.window, window[winPos-int(w):winPos])
+		} else {
+			n := copy(p.window, window[windowSize-(int(w)-winPos):])
+			copy(p.window[n:], window[:winPos])
+		}
+		x.points = append(x.points, p)
+		last = totOut
+	}
+}
+
+// sampleInput adds the compressed input b, which follows the input seen
+// before, to the samples at the start and at the end of the stream.
+func sampleInput(head, tail *[]byte, b []byte) {
+	if n := sampleSize - len(*head); n > 0 {
+		if n > len(b) {
+			n = len(b)
+		}
+		*head = append(*head, b[:n]...)
+	}
+	if len(b) >= sampleSize {
+		*tail = append((*tail)[:0], b[len(b)-sampleSize:]...)
+		return
+	}
+	if keep := sampleSize - len(b); len(*tail) > keep {
+		n := copy(*tail, (*tail)[len(*tail)-keep:])
+		*tail = (*tail)[:n]
+	}
+	*tail = append(*tail, b...)
+}
+
+var (
+	// ErrIndexCorrupt is returned by Index.UnmarshalBinary when the data is
+	// not a valid index.
+	ErrIndexCorrupt = errors.New("zlib: corrupt index")
+	// ErrIndexVersion is returned by Index.UnmarshalBinary when the index was
+	// encoded in a version of the format that isn't supported.
+	ErrIndexVersion = errors.New("zlib: unsupported index version")
+	// ErrIndexMismatch is returned by Index.Verify when the index was built
+	// from another stream.
+	ErrIndexMismatch = errors.New("zlib: index doesn't match the stream")
+	// ErrIndexUnverified is returned by IndexedReader.ReadAt when the index
+	// was loaded by UnmarshalBinary and hasn't been verified.
+	ErrIndexUnverified = errors.New("zlib: index not verified")
+)
+
+// indexMagic starts an encoded index, followed by indexVersion.
+const (
+	indexMagic   = "ZIDX"
+	indexVersion = 1
+)
+
+// MarshalBinary implements encoding.BinaryMarshaler. The encoding holds the
+// access points with their windows, and the compressed size and samples of the
+// stream that Verify checks. It ends with a CRC-32 of the rest.
+func (x *Index) MarshalBinary() ([]byte, error) {
+	b := append([]byte(indexMagic), indexVersion)
+	var tmp [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) {
+		b = append(b, tmp[:binary.PutUvarint(tmp[:], v)]...)
+	}
+	putUvarint(uint64(x.span))
+	putUvarint(uint64(x.size))
+	putUvarint(uint64(x.inSize))
+	putUvarint(uint64(x.headCRC))
+	putUvarint(uint64(x.tailCRC))
+	putUvarint(uint64(len(x.points)))
+	for _, p := range x.points {
+		flags := byte(p.bits)
+		if p.member {
+			flags |= 0x80
+		}
+		putUvarint(uint64(p.out))
+		putUvarint(uint64(p.in))
+		b = append(b, flags)
+		putUvarint(uint64(len(p.window)))
+		b = append(b, p.window...)
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(b))
+	return append(b, sum[:]...), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. It returns
+// ErrIndexCorrupt if data isn't a valid index. The loaded index must be checked
+// against the stream with Verify before IndexedReader can use it.
+func (x *Index) UnmarshalBinary(data []byte) error {
+	if len(data) < len(indexMagic)+1+4 || string(data[:len(indexMagic)]) != indexMagic {
+		return ErrIndexCorrupt
+	}
+	if data[len(indexMagic)] != indexVersion {
+		return ErrIndexVersion
+	}
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+		return ErrIndexCorrupt
+	}
+	b := body[len(indexMagic)+1:]
+	bad := false
+	uvarint := func() int64 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 || v > 1<<62 {
+			bad = true
+			return 0
+		}
+		b = b[n:]
+		return int64(v)
+	}
+	var y Index
+	y.span = uvarint()
+	y.size = uvarint()
+	y.inSize = uvarint()
+	y.headCRC = uint32(uvarint())
+	y.tailCRC = uint32(uvarint())
+	n := uvarint()
+	for i := int64(0); i < n && !bad; i++ {
+		var p accessPoint
+		p.out = uvarint()
+		p.in = uvarint()
+		if len(b) == 0 {
+			return ErrIndexCorrupt
+		}
+		flags := b[0]
+		b = b[1:]
+		p.bits = int(flags & 7)
+		p.member = flags&0x80 != 0
+		w := uvarint()
+		if bad || w > windowSize || w > int64(len(b)) || (p.member && (w > 0 || p.bits > 0)) {
+			return ErrIndexCorrupt
+		}
+		if w > 0 {
+			p.window = append([]byte(nil), b[:w]...)
+			b = b[w:]
+		}
+		// The points are sorted in both streams, and the first one is at the
+		// start of the first member.
+		if i == 0 && (!p.member || p.out != 0 || p.in != 0) {
+			return ErrIndexCorrupt
+		}
+		if i > 0 {
+			prev := y.points[i-1]
+			if p.out < prev.out || p.in < prev.in || p.out > y.size || p.in > y.inSize || (p.in == 0 && p.bits > 0) {
+				return ErrIndexCorrupt
+			}
+		}
+		y.points = append(y.points, p)
+	}
+	if bad || len(b) != 0 || len(y.points) == 0 || y.span <= 0 {
+		return ErrIndexCorrupt
+	}
+	y.unverified = true
+	*x = y
+	return nil
+}
+
+// Verify checks that the index was built from the compressed stream of the
+// given size read from r, by comparing the size and the checksums of samples
+// from the start and the end of the stream. It returns ErrIndexMismatch if they
+// differ. Once Verify succeeds, IndexedReader accepts an index loaded by
+// UnmarshalBinary.
+func (x *Index) Verify(r io.ReaderAt, size int64) error {
+	if size != x.inSize {
+		return ErrIndexMismatch
+	}
+	n := int64(sampleSize)
+	if n > size {
+		n = size
+	}
+	buf := make([]byte, n)
+	for _, s := range []struct {
+		off int64
+		crc uint32
+	}{{0, x.headCRC}, {size - n, x.tailCRC}} {
+		if m, err := r.ReadAt(buf, s.off); m < len(buf) {
+			if err == nil || err == io.EOF {
+				err = ErrIndexMismatch
+			}
+			return err
+		}
+		if crc32.ChecksumIEEE(buf) != s.crc {
+			return ErrIndexMismatch
+		}
+	}
+	x.unverified = false
+	return nil
+}
+
+// IndexedReader reads ranges of the decompressed data of an indexed stream
+// without decoding the stream from the start.
+type IndexedReader struct {
+	r io.ReaderAt
+	x *Index
+}
+
+// NewIndexedReader returns an IndexedReader that reads the compressed stream
+// from r, using the index x that BuildIndex built from the same stream.
+func NewIndexedReader(r io.ReaderAt, x *Index) *IndexedReader {
+	return &IndexedReader{r: r, x: x}
+}
+
+// Size returns the decompressed size of the stream.
+func (ir *IndexedReader) Size() int64 {
+	return ir.x.size
+}
+
+// ReadAt implements io.ReaderAt. It decodes from the last access point at or
+// before off, throwing away the output up to off. Checksums aren't verified,
+// since decoding doesn't start at the beginning of a member. ReadAt may be
+// called concurrently.
+func (ir *IndexedReader) ReadAt(p []byte, off int64) (int, error) {
+	if ir.x.unverified {
+		return 0, ErrIndexUnverified
+	}
+	if off < 0 {
+		return 0, errors.New("zlib: negative offset")
+	}
+	if off >= ir.x.size {
+		return 0, io.EOF
+	}
+	points := ir.x.points
+	i := sort.Search(len(points), func(i int) bool { return points[i].out > off }) - 1
+	zs := new(zstream)
+	inOff, err := ir.start(zs, &points[i])
+	defer C.zs_inflate_end(&zs[0])
+	if err != nil {
+		return 0, err
+	}
+
+	skip := off - points[i].out
+	in := make([]byte, indexChunkSize)
+	var (
+		scratch       []byte
+		inPos, inEnd  int
+		inLen, outLen C.int
+		n             int
+	)
+	for n < len(p) {
+		if inPos == inEnd {
+			m, err := ir.r.ReadAt(in, inOff)
+			if m == 0 {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return n, err
+			}
+			// An error along with m > 0 is returned by the next ReadAt.
+			inPos, inEnd = 0, m
+			inOff += int64(m)
+		}
+		out := p[n:]
+		if skip > 0 {
+			if scratch == nil {
+				scratch = make([]byte, windowSize)
+			}
+			out = scratch
+			if int64(len(out)) > skip {
+				out = out[:skip]
+			}
+		}
+		inLen = C.int(inEnd - inPos)
+		outLen = C.int(len(out))
+		ret := C.zs_inflate(&zs[0], unsafe.Pointer(&in[inPos]), &inLen, unsafe.Pointer(&out[0]), &outLen)
+		inPos = inEnd - int(inLen)
+		if nOut := len(out) - int(outLen); skip > 0 {
+			skip -= int64(nOut)
+		} else {
+			n += nOut
+		}
+		switch ret {
+		case C.Z_OK:
+		case C.Z_STREAM_END:
+			// Raw decoding doesn't read the trailer; continue from the
+			// header of the next member.
+			i++
+			for i < len(points) && !points[i].member {
+				i++
+			}
+			if i == len(points) {
+				return n, io.EOF
+			}
+			C.zs_inflate_end(&zs[0])
+			if inOff, err = ir.start(zs, &points[i]); err != nil {
+				return n, err
+			}
+			inPos, inEnd = 0, 0
+		case C.Z_NEED_DICT:
+			return n, ErrDictionaryRequired
+		default:
+			return n, inflateError(zs, ret)
+		}
+	}
+	return n, nil
+}
+
+// start initializes zs for decoding from pt, and returns the offset of the
+// compressed input that follows.
+func (ir *IndexedReader) start(zs *zstream, pt *accessPoint) (int64, error) {
+	if pt.member {
+		ret := C.zs_inflate_init(&zs[0], C.int(FormatAuto.windowBits(maxWindowBits)))
+		return pt.in, zlibReturnCodeToError(ret)
+	}
+	ret := C.zs_inflate_init(&zs[0], C.int(FormatRaw.windowBits(maxWindowBits)))
+	if ret != C.Z_OK {
+		return 0, zlibReturnCodeToError(ret)
+	}
+	if pt.bits > 0 {
+		var b [1]byte
+		if n, err := ir.r.ReadAt(b[:], pt.in-1); n == 0 {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		ret = C.zs_inflate_prime(&zs[0], C.int(pt.bits), C.int(b[0]>>uint(8-pt.bits)))
+		if ret != C.Z_OK {
+			return 0, zlibReturnCodeToError(ret)
+		}
+	}
+	if len(pt.window) > 0 {
+		ret = C.zs_inflate_set_dictionary(&zs[0], unsafe.Pointer(&pt.window[0]), C.int(len(pt.window)))
+		if ret != C.Z_OK {
+			return 0, zlibReturnCodeToError(ret)
+		}
+	}
+	return pt.in, nil
+}
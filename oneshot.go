@@ -0,0 +1,360 @@
+// +build amd64
+
+package zlib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// #include <zlib.h>
+// #include "./zstream.h"
+import "C"
+
+// deflater is a zlib state cached for the one-shot functions such as Compress.
+type deflater struct {
+	zs zstream
+	// outLen is the in/out argument of zs_deflate_all. A local would escape
+	// to the heap on every call.
+	outLen C.size_t
+}
+
+// deflaters caches a deflater per writer format and level, from HuffmanOnly
+// to BestCompression. The pools drop the idle ones at garbage collection, and
+// their finalizers free the zlib states.
+var deflaters [FormatRaw + 1][BestCompression - HuffmanOnly + 1]sync.Pool
+
+func gcDeflater(d *deflater) {
+	C.zs_deflate_end(&d.zs[0])
+}
+
+// getDeflater returns a deflater of format f and level from the cache, or a
+// new one. f and level must be valid.
+func getDeflater(f Format, level int) (*deflater, error) {
+	if d, ok := deflaters[f][level-HuffmanOnly].Get().(*deflater); ok {
+		return d, nil
+	}
+	strategy := StrategyDefault
+	if level == HuffmanOnly {
+		level, strategy = DefaultCompression, StrategyHuffmanOnly
+	}
+	d := new(deflater)
+	ec := C.zs_deflate_init(&d.zs[0], C.int(level), C.int(f.windowBits(maxWindowBits)), C.int(defaultMemLevel), C.int(strategy))
+	if ec != 0 {
+		return nil, zlibReturnCodeToError(ec)
+	}
+	runtime.SetFinalizer(d, gcDeflater)
+	return d, nil
+}
+
+// oneShotBound returns deflateBound for a stream of format f of n bytes with
+// the default window, memory level and header.
+func oneShotBound(f Format, n int) int {
+	wrap := 6 // zlib header and trailer.
+	switch f {
+	case FormatGzip:
+		wrap = 18
+	case FormatRaw:
+		wrap = 0
+	}
+	return n + n>>12 + n>>14 + n>>25 + 7 + wrap
+}
+
+// Compress appends the gzip stream of src, compressed at level, to dst and
+// returns the extended slice. It is CompressFormat with FormatGzip.
+func Compress(dst, src []byte, level int) ([]byte, error) {
+	return CompressFormat(dst, src, FormatGzip, level)
+}
+
+// CompressFormat appends the stream of format f of src, compressed at level,
+// to dst and returns the extended slice. The stream has the default window,
+// memory level and header of writers, and the levels have the meanings of
+// NewWriterLevel. It is meant for small payloads, which it compresses in a
+// single cgo call, with a zlib state cached per format and level instead of a
+// writer and its buffer: if dst has room for the bound of the output at its
+// end, it doesn't allocate. Otherwise dst is copied into a new slice with room.
+// dst and src must not overlap.
+func CompressFormat(dst, src []byte, f Format, level int) ([]byte, error) {
+	if err := ValidateLevel(f, level); err != nil {
+		return dst, err
+	}
+	d, err := getDeflater(f, level)
+	if err != nil {
+		return dst, err
+	}
+	var in unsafe.Pointer
+	if len(src) > 0 {
+		in = unsafe.Pointer(&src[0])
+	}
+	size := oneShotBound(f, len(src))
+	for {
+		if cap(dst)-len(dst) < size {
+			grown := make([]byte, len(dst), len(dst)+size)
+			copy(grown, dst)
+			dst = grown
+		}
+		out := dst[len(dst):cap(dst)]
+		d.outLen = C.size_t(len(out))
+		ret := C.zs_deflate_all(&d.zs[0], in, C.size_t(len(src)), unsafe.Pointer(&out[0]), &d.outLen)
+		runtime.KeepAlive(src)
+		switch ret {
+		case C.Z_STREAM_END:
+			n := int(d.outLen)
+			deflaters[f][level-HuffmanOnly].Put(d)
+			return dst[:len(dst)+n], nil
+		case C.Z_OK, C.Z_BUF_ERROR:
+			// Out of room, which the bound should prevent.
+			size = 2 * (cap(dst) - len(dst))
+		default:
+			// d is dropped, and its finalizer frees it.
+			return dst, zstreamError(&d.zs, ret)
+		}
+	}
+}
+
+// inflater is a zlib state cached for the one-shot functions such as
+// Decompress.
+type inflater struct {
+	zs zstream
+	// inLen and outLen are the in/out arguments of zs_inflate_all.
+	inLen, outLen C.size_t
+	// probe receives the output past the size of DecompressWithSize.
+	probe [1]byte
+}
+
+// inflaters caches an inflater per reader format, like deflaters.
+var inflaters [FormatAuto + 1]sync.Pool
+
+func gcInflater(d *inflater) {
+	C.zs_inflate_end(&d.zs[0])
+}
+
+// getInflater returns an inflater of format f from the cache, or a new one. f
+// must be valid.
+func getInflater(f Format) (*inflater, error) {
+	if d, ok := inflaters[f].Get().(*inflater); ok {
+		return d, nil
+	}
+	d := new(inflater)
+	if ec := C.zs_inflate_init(&d.zs[0], C.int(f.windowBits(maxWindowBits))); ec != 0 {
+		return nil, zlibReturnCodeToError(ec)
+	}
+	runtime.SetFinalizer(d, gcInflater)
+	return d, nil
+}
+
+// maxDeflateRatio is the largest ratio of the decoded and encoded sizes of a
+// deflate stream, which bounds the guess of the decoded size of a gzip file.
+const maxDeflateRatio = 1032
+
+// decodedSizeHint guesses the decoded size of src, a stream of format f: the
+// ISIZE field of the last member of a gzip file, which is exact for a single
+// member smaller than 4GB, or four times its size otherwise.
+func decodedSizeHint(f Format, src []byte) int {
+	if f == FormatGzip && len(src) >= 18 {
+		n := int(binary.LittleEndian.Uint32(src[len(src)-4:]))
+		if n <= maxDeflateRatio*len(src) {
+			return n
+		}
+	}
+	return 4 * len(src)
+}
+
+// growBytes returns b with room for at least n more bytes, at least doubling
+// its capacity if it has to grow it.
+func growBytes(b []byte, n int) []byte {
+	if cap(b)-len(b) >= n {
+		return b
+	}
+	c := 2 * cap(b)
+	if c < len(b)+n {
+		c = len(b) + n
+	}
+	grown := make([]byte, len(b), c)
+	copy(grown, b)
+	return grown
+}
+
+// Decompress appends the decoded gzip file src to dst and returns the extended
+// slice. It is DecompressFormat with FormatGzip.
+func Decompress(dst, src []byte) ([]byte, error) {
+	return DecompressFormat(dst, src, FormatGzip)
+}
+
+// DecompressFormat appends the decoded stream of format f in src to dst and
+// returns the extended slice. It decodes all the members of a gzip file, like
+// a reader created by NewReaderOpts with f, and fails with the same errors:
+// ErrHeader, ErrChecksum, ErrDictionaryRequired, io.ErrUnexpectedEOF for a
+// truncated stream, and so on. Data after the end of a zlib or raw stream is
+// ignored. It is meant for buffers in memory, which it decodes with a zlib
+// state cached per format, without a reader and its input buffer. If dst has
+// no room for the output, it allocates a new slice sized from the ISIZE field
+// of a gzip file, or from the size of src, and grows it geometrically if that
+// isn't enough. With room in dst, there is a single cgo call and no
+// allocation. dst and src must not overlap. On error, dst is returned with its
+// original length.
+func DecompressFormat(dst, src []byte, f Format) ([]byte, error) {
+	return decompress(dst, src, f, -1)
+}
+
+// DecompressWithSize is Decompress for a gzip file known to decode to size
+// bytes, e.g. from an index. It makes room for exactly size bytes in dst, if
+// it lacks it, and decodes src there in a single cgo call, without growing or
+// copying. It fails with ErrShortBuffer if the file decodes to more than size
+// bytes, and ErrSizeMismatch if it decodes to less.
+func DecompressWithSize(dst, src []byte, size int) ([]byte, error) {
+	if size < 0 {
+		return dst, fmt.Errorf("zlib: invalid size %d", size)
+	}
+	return decompress(dst, src, FormatGzip, size)
+}
+
+// decompress appends the decoded stream of format f in src to dst. If size is
+// negative, dst grows as needed; otherwise the output must be size bytes.
+func decompress(dst, src []byte, f Format, size int) ([]byte, error) {
+	switch f {
+	case FormatGzip, FormatZlib, FormatRaw, FormatAuto:
+	default:
+		return dst, fmt.Errorf("zlib: invalid format %d", f)
+	}
+	start := len(dst)
+	if len(src) == 0 {
+		// Like a reader, which finds no member.
+		if size > 0 {
+			return dst, ErrSizeMismatch
+		}
+		return dst, nil
+	}
+	d, err := getInflater(f)
+	if err != nil {
+		return dst, err
+	}
+	switch {
+	case size >= 0 && cap(dst)-len(dst) < size:
+		grown := make([]byte, len(dst), len(dst)+size)
+		copy(grown, dst)
+		dst = grown
+	case size < 0 && cap(dst) == len(dst):
+		dst = growBytes(dst, decodedSizeHint(f, src))
+	}
+	multistream := C.int(0)
+	if f.gzip() {
+		multistream = 1
+	}
+	for reset := C.int(1); ; reset = 0 {
+		var out []byte
+		if size < 0 {
+			if cap(dst) == len(dst) {
+				dst = growBytes(dst, 1)
+			}
+			out = dst[len(dst):cap(dst)]
+		} else if out = dst[len(dst) : start+size]; len(out) == 0 {
+			// Check that the stream ends without more output.
+			out = d.probe[:]
+		}
+		probing := size >= 0 && len(dst) == start+size
+		var in unsafe.Pointer
+		if len(src) > 0 {
+			in = unsafe.Pointer(&src[0])
+		}
+		d.inLen = C.size_t(len(src))
+		d.outLen = C.size_t(len(out))
+		ret := C.zs_inflate_all(&d.zs[0], reset, multistream, in, &d.inLen, unsafe.Pointer(&out[0]), &d.outLen)
+		runtime.KeepAlive(src)
+		src = src[len(src)-int(d.inLen):]
+		produced := int(d.outLen)
+		switch {
+		case probing && produced > 0:
+			inflaters[f].Put(d)
+			return dst[:start], ErrShortBuffer
+		case !probing:
+			dst = dst[:len(dst)+produced]
+		}
+		switch ret {
+		case C.Z_STREAM_END:
+			inflaters[f].Put(d)
+			if size >= 0 && len(dst) < start+size {
+				return dst[:start], ErrSizeMismatch
+			}
+			return dst, nil
+		case C.Z_OK, C.Z_BUF_ERROR:
+			if produced < len(out) {
+				// The input ended inside the stream. The next use resets d.
+				inflaters[f].Put(d)
+				return dst[:start], io.ErrUnexpectedEOF
+			}
+		case C.Z_NEED_DICT:
+			inflaters[f].Put(d)
+			return dst[:start], ErrDictionaryRequired
+		default:
+			// d is dropped, and its finalizer frees it.
+			return dst[:start], inflateError(&d.zs, ret)
+		}
+	}
+}
+
+// AppendCompress appends the gzip stream of src, compressed at level, to dst
+// and returns the extended slice, so that the caller manages the buffer. It is
+// Compress, and fails only for an invalid level, or if zlib runs out of
+// memory.
+//
+// AppendCompress and AppendDecompress share one contract: on success, the
+// returned slice is dst followed by the output, in dst itself if it has room;
+// on error, it holds just the bytes of dst, so the output is never partial.
+// Both share the cached zlib states of the one-shot functions, and keep no
+// reference to dst or src once they return.
+func AppendCompress(dst, src []byte, level int) ([]byte, error) {
+	return Compress(dst, src, level)
+}
+
+// AppendDecompress appends the decoded gzip file src to dst and returns the
+// extended slice, with the contract of AppendCompress. It is Decompress, and
+// fails if src is corrupt or truncated.
+func AppendDecompress(dst, src []byte) ([]byte, error) {
+	return Decompress(dst, src)
+}
+
+// gzipScratch recycles the output buffers of GzipBytes.
+var gzipScratch = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+// maxGzipScratch is the capacity above which GzipBytes doesn't keep its
+// buffer, so that a rare large input doesn't pin memory.
+const maxGzipScratch = 1 << 20
+
+// GzipBytes returns the gzip file of src, compressed at level, with the levels
+// of NewWriterLevel. The output is a complete file with the default header of
+// writers, which gunzip(1) and HTTP clients of Content-Encoding gzip decode,
+// like that of a compress/gzip writer into a bytes.Buffer. It compresses into
+// a reused buffer with Compress, then copies the result into a slice of its
+// exact size. Callers with their own buffers can use Compress or
+// AppendCompress instead.
+func GzipBytes(src []byte, level int) ([]byte, error) {
+	scratch := gzipScratch.Get().(*[]byte)
+	out, err := Compress((*scratch)[:0], src, level)
+	if err != nil {
+		gzipScratch.Put(scratch)
+		return nil, err
+	}
+	result := make([]byte, len(out))
+	copy(result, out)
+	if cap(out) <= maxGzipScratch {
+		*scratch = out
+		gzipScratch.Put(scratch)
+	}
+	return result, nil
+}
+
+// GunzipBytes returns the data of the gzip file src, the counterpart of
+// GzipBytes. It decodes all the concatenated members of src, like gunzip(1),
+// and fails like a reader, e.g. with ErrChecksum or io.ErrUnexpectedEOF. Empty
+// input has no members, and decodes to nothing. It is Decompress with a nil
+// dst.
+func GunzipBytes(src []byte) ([]byte, error) {
+	return Decompress(nil, src)
+}
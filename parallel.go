@@ -0,0 +1,269 @@
+// +build amd64
+
+package zlib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// DefaultParallelChunkSize is the default amount of input that a worker of
+// ParallelWriter compresses at a time, as in pigz.
+const DefaultParallelChunkSize = 128 << 10
+
+// parallelWindowSize is the size of the dictionary of a chunk: the end of the
+// previous chunk, within the reach of deflate.
+const parallelWindowSize = 1 << maxWindowBits
+
+// parallelBufferSize is the output buffer size of the writers of the workers.
+const parallelBufferSize = 64 << 10
+
+// ParallelWriterOptions configures a ParallelWriter. The zero value selects
+// the defaults.
+type ParallelWriterOptions struct {
+	// Level is the compression level, as in WriterOptions: zero selects the
+	// default level.
+	Level int
+	// Workers is the number of goroutines that compress. It defaults to
+	// GOMAXPROCS.
+	Workers int
+	// ChunkSize is the amount of input compressed at a time. It defaults to
+	// DefaultParallelChunkSize. Larger chunks cost a little less ratio and
+	// more memory.
+	ChunkSize int
+	// InFlight is the largest number of chunks being compressed or waiting
+	// to be written, which bounds the memory to about 2*InFlight*ChunkSize.
+	// It defaults to 2*Workers.
+	InFlight int
+}
+
+// parallelJob is a chunk for a worker of ParallelWriter to compress.
+type parallelJob struct {
+	data   []byte
+	dict   []byte // end of the previous chunk; empty for the first chunk.
+	out    *bytes.Buffer
+	result chan<- parallelResult
+}
+
+// parallelResult is a chunk compressed by a worker of ParallelWriter.
+type parallelResult struct {
+	job parallelJob
+	crc uint32
+	err error
+}
+
+// ParallelWriter compresses data into a single gzip member with several
+// goroutines, like pigz. The input is cut into chunks, which workers compress
+// concurrently, each with the end of the previous chunk as a preset
+// dictionary so that the ratio is almost that of a Writer, while Write and
+// Close write the output in order. The output only depends on the input,
+// Level and ChunkSize, not on the number of workers, and the header has no
+// name or modification time, like with WriterOptions.Deterministic.
+type ParallelWriter struct {
+	w         io.Writer
+	jobs      chan parallelJob
+	wg        sync.WaitGroup
+	chunkSize int
+	inFlight  int
+	pending   []chan parallelResult // results of the chunks in input order.
+	cur       []byte                // the chunk being filled by Write.
+	dict      []byte                // end of the last chunk handed to a worker.
+	// Buffers of the chunks that have been written, for reuse.
+	freeData, freeDicts [][]byte
+	freeOuts            []*bytes.Buffer
+	crc                 uint32 // CRC-32 of the chunks that have been written.
+	size                int64  // size of the chunks that have been written.
+	started             bool   // true once the header has been written.
+	closed              bool
+	err                 error
+}
+
+// NewParallelWriter returns a writer of a gzip stream to w that compresses it
+// as configured by opts.
+func NewParallelWriter(w io.Writer, opts ParallelWriterOptions) (*ParallelWriter, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.GOMAXPROCS(0)
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = DefaultParallelChunkSize
+	}
+	if opts.InFlight <= 0 {
+		opts.InFlight = 2 * opts.Workers
+	}
+	zws := make([]*writer, opts.Workers)
+	for i := range zws {
+		// compress always frees the writers.
+		zw, err := NewWriterOpts(nil, WriterOptions{Format: FormatRaw, Level: opts.Level, BufferSize: parallelBufferSize, NoFinalizer: true})
+		if err != nil {
+			for _, zw := range zws[:i] {
+				zw.end()
+			}
+			return nil, err
+		}
+		zws[i] = zw.(*writer)
+	}
+	p := &ParallelWriter{
+		w:         w,
+		jobs:      make(chan parallelJob, opts.InFlight),
+		chunkSize: opts.ChunkSize,
+		inFlight:  opts.InFlight,
+		cur:       make([]byte, 0, opts.ChunkSize),
+	}
+	p.wg.Add(len(zws))
+	for _, zw := range zws {
+		go p.compress(zw)
+	}
+	return p, nil
+}
+
+// compress compresses chunks until Close, then frees zw. zw never ends a
+// stream, so it is freed without Close.
+func (p *ParallelWriter) compress(zw *writer) {
+	defer p.wg.Done()
+	defer zw.end()
+	for job := range p.jobs {
+		job.result <- parallelResult{
+			job: job,
+			crc: crc32.ChecksumIEEE(job.data),
+			err: zw.compressChunk(job.out, job.data, job.dict),
+		}
+	}
+}
+
+// compressChunk compresses data into a raw deflate stream that ends with a
+// sync flush instead of a final block, with dict as the preset dictionary.
+func (z *writer) compressChunk(out io.Writer, data, dict []byte) error {
+	z.dict = nil
+	if len(dict) > 0 {
+		z.dict = dict
+	}
+	if err := z.Reset(out); err != nil {
+		return err
+	}
+	if _, err := z.Write(data); err != nil {
+		return err
+	}
+	return z.Flush()
+}
+
+// Write implements io.Writer. It hands the input to the workers a chunk at a
+// time, and writes the output of the chunks that are done. Once it fails,
+// every later call returns the same error.
+func (p *ParallelWriter) Write(b []byte) (int, error) {
+	if p.closed {
+		return 0, ErrWriterClosed
+	}
+	n := 0
+	for p.err == nil && len(b) > 0 {
+		m := copy(p.cur[len(p.cur):p.chunkSize], b)
+		p.cur = p.cur[:len(p.cur)+m]
+		n += m
+		b = b[m:]
+		if len(p.cur) == p.chunkSize {
+			p.err = p.submit()
+		}
+	}
+	return n, p.err
+}
+
+// submit hands the current chunk to a worker, after writing the output of the
+// oldest chunk if InFlight chunks are pending.
+func (p *ParallelWriter) submit() error {
+	if len(p.pending) == p.inFlight {
+		if err := p.collect(); err != nil {
+			return err
+		}
+	}
+	job := parallelJob{data: p.cur, dict: p.dict}
+	if n := len(p.freeOuts); n > 0 {
+		job.out = p.freeOuts[n-1]
+		p.freeOuts = p.freeOuts[:n-1]
+		job.out.Reset()
+	} else {
+		job.out = new(bytes.Buffer)
+	}
+	result := make(chan parallelResult, 1)
+	job.result = result
+	p.pending = append(p.pending, result)
+	p.jobs <- job
+
+	// The next chunk starts where this one ends.
+	tail := p.cur
+	if len(tail) > parallelWindowSize {
+		tail = tail[len(tail)-parallelWindowSize:]
+	}
+	p.dict = append(p.takeBuf(&p.freeDicts, parallelWindowSize), tail...)
+	p.cur = p.takeBuf(&p.freeData, p.chunkSize)
+	return nil
+}
+
+// takeBuf returns an empty buffer of capacity size, from free if possible.
+func (p *ParallelWriter) takeBuf(free *[][]byte, size int) []byte {
+	if n := len(*free); n > 0 {
+		b := (*free)[n-1]
+		*free = (*free)[:n-1]
+		return b[:0]
+	}
+	return make([]byte, 0, size)
+}
+
+// collect waits for the oldest pending chunk, and writes its output.
+func (p *ParallelWriter) collect() error {
+	res := <-p.pending[0]
+	p.pending = p.pending[1:]
+	if res.err != nil {
+		return res.err
+	}
+	if !p.started {
+		p.started = true
+		// The gzip header of a Writer with WriterOptions.Deterministic.
+		header := [10]byte{0: 0x1f, 1: 0x8b, 2: 8, 9: unknownOS}
+		if _, err := writeFull(p.w, header[:]); err != nil {
+			return err
+		}
+	}
+	if _, err := writeFull(p.w, res.job.out.Bytes()); err != nil {
+		return err
+	}
+	p.crc = CRC32Combine(p.crc, res.crc, int64(len(res.job.data)))
+	p.size += int64(len(res.job.data))
+	p.freeData = append(p.freeData, res.job.data)
+	if res.job.dict != nil {
+		p.freeDicts = append(p.freeDicts, res.job.dict)
+	}
+	p.freeOuts = append(p.freeOuts, res.job.out)
+	return nil
+}
+
+// Close compresses the rest of the input, writes the end of the stream, and
+// waits for the workers to exit. It doesn't close the underlying writer.
+func (p *ParallelWriter) Close() error {
+	if p.closed {
+		return p.err
+	}
+	p.closed = true
+	if p.err == nil && (len(p.cur) > 0 || !p.started && len(p.pending) == 0) {
+		p.err = p.submit()
+	}
+	for len(p.pending) > 0 {
+		if err := p.collect(); err != nil && p.err == nil {
+			p.err = err
+		}
+	}
+	close(p.jobs)
+	p.wg.Wait()
+	if p.err != nil {
+		return p.err
+	}
+	// An empty final block with fixed codes ends the deflate stream.
+	var trailer [10]byte
+	trailer[0] = 3
+	binary.LittleEndian.PutUint32(trailer[2:], p.crc)
+	binary.LittleEndian.PutUint32(trailer[6:], uint32(p.size))
+	_, p.err = writeFull(p.w, trailer[:])
+	return p.err
+}
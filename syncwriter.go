@@ -0,0 +1,176 @@
+// +build amd64
+
+package zlib
+
+import (
+	"io"
+	"sync"
+)
+
+// SyncWriter is a Writer that can be shared by goroutines. Every method runs
+// the corresponding method of the wrapped writer with a mutex held, so calls
+// never interleave: a Flush covers all the Writes that got the lock before it,
+// and Close waits for the Writes in progress to return. The data of concurrent
+// Writes appears in the stream in the order in which they acquired the lock.
+//
+// Writers returned by the NewWriter functions aren't safe for concurrent use
+// and don't pay for any locking; wrap them only if they are shared.
+type SyncWriter struct {
+	mu sync.Mutex
+	w  Writer
+}
+
+// NewSyncWriter returns a SyncWriter that serializes the calls to w. w must not
+// be used directly afterwards.
+func NewSyncWriter(w Writer) *SyncWriter {
+	return &SyncWriter{w: w}
+}
+
+// Write implements io.Writer. The whole of p is written before any other call
+// to the writer starts.
+func (s *SyncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// WriteString is like Write for a string.
+func (s *SyncWriter) WriteString(str string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.WriteString(str)
+}
+
+// ReadFrom implements io.ReaderFrom. It holds the lock until r returns io.EOF
+// or an error, so the data read from r isn't mixed with other Writes.
+func (s *SyncWriter) ReadFrom(r io.Reader) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.ReadFrom(r)
+}
+
+// Flush is Writer.Flush.
+func (s *SyncWriter) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Flush()
+}
+
+// FullFlush is Writer.FullFlush.
+func (s *SyncWriter) FullFlush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.FullFlush()
+}
+
+// FlushMode is Writer.FlushMode.
+func (s *SyncWriter) FlushMode(mode FlushMode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.FlushMode(mode)
+}
+
+// Close implements io.Closer. It waits for the calls in progress to return.
+func (s *SyncWriter) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Close()
+}
+
+// Reset is Writer.Reset.
+func (s *SyncWriter) Reset(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Reset(w)
+}
+
+// SetHeader is Writer.SetHeader.
+func (s *SyncWriter) SetHeader(h Header) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.SetHeader(h)
+}
+
+// SetParams is Writer.SetParams.
+func (s *SyncWriter) SetParams(level int, strategy Strategy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.SetParams(level, strategy)
+}
+
+// NewMember is Writer.NewMember.
+func (s *SyncWriter) NewMember() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.NewMember()
+}
+
+// Pending is Writer.Pending.
+func (s *SyncWriter) Pending() (bytes int, bits int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Pending()
+}
+
+// Bound is Writer.Bound.
+func (s *SyncWriter) Bound(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Bound(n)
+}
+
+// InputBytes is Writer.InputBytes.
+func (s *SyncWriter) InputBytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.InputBytes()
+}
+
+// OutputBytes is Writer.OutputBytes.
+func (s *SyncWriter) OutputBytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.OutputBytes()
+}
+
+// Ratio is Writer.Ratio.
+func (s *SyncWriter) Ratio() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Ratio()
+}
+
+// Checksum is Writer.Checksum.
+func (s *SyncWriter) Checksum() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Checksum()
+}
+
+// Tune is Writer.Tune.
+func (s *SyncWriter) Tune(goodLength, maxLazy, niceLength, maxChain int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Tune(goodLength, maxLazy, niceLength, maxChain)
+}
+
+// Checkpoint is Writer.Checkpoint.
+func (s *SyncWriter) Checkpoint() (*WriterCheckpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Checkpoint()
+}
+
+// Restore is Writer.Restore.
+func (s *SyncWriter) Restore(cp *WriterCheckpoint, w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Restore(cp, w)
+}
+
+// Abort is Writer.Abort. It waits for the calls in progress to return.
+func (s *SyncWriter) Abort() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Abort()
+}
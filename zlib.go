@@ -3,254 +3,3184 @@
 package zlib
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"golang.org/x/sys/unix"
 	"io"
 	"runtime"
+	"strings"
+	"sync"
+	"time"
 	"unsafe"
 )
 
 // #cgo LDFLAGS: -lz
 // #include <errno.h>
+// #include <stdlib.h>
+// #include <string.h>
 // #include <zlib.h>
 // #include "./zstream.h"
 import "C"
 
 type zstream [unsafe.Sizeof(C.z_stream{})]C.char
 
+// Reader decompresses a stream in one of the Formats. Reset makes it reusable
+// for a new stream, so that readers can be kept in a sync.Pool.
+type Reader interface {
+	Close() error
+	Read([]byte) (int, error)
+	Reset(io.Reader) error
+	Multistream(ok bool)
+	NextMember() (bool, error)
+	Drain() (size int64, crc uint32, err error)
+	Header() Header
+	UncompressedSize() int64
+	Format() Format
+	SetDictionary(dict []byte) error
+	DictID() uint32
+	WriteTo(w io.Writer) (int64, error)
+	ReadByte() (byte, error)
+	Discard(n int64) (int64, error)
+	Members() []MemberBoundary
+	MemberCount() int
+	Remaining() []byte
+	InputBytes() int64
+	OutputBytes() int64
+	Offsets() (compressed, uncompressed int64)
+	Recover() (int64, error)
+	Checkpoint() (*Checkpoint, error)
+	Restore(cp *Checkpoint, r io.Reader) error
+	Passthrough() bool
+}
+
+// MemberBoundary locates a member of a stream, as offsets from the start of
+// the compressed input and of the decompressed output.
+type MemberBoundary struct {
+	CompressedStart, CompressedEnd     int64
+	UncompressedStart, UncompressedEnd int64
+}
+
+// Header is the gzip header of a member, see gzip.Header.
+type Header struct {
+	Comment string    // comment
+	Extra   []byte    // "extra data"; nil if the FEXTRA field is absent
+	ModTime time.Time // modification time
+	Name    string    // file name
+	OS      byte      // operating system type
+	Text    bool      // true if the FTEXT flag is set
+	// HeaderCRC is true if the FHCRC flag is set. zlib verifies the CRC16 of
+	// the header then, and Read fails with ErrHeaderChecksum on a mismatch.
+	// Writer.SetHeader writes the CRC16 if it is true.
+	HeaderCRC bool
+}
+
+// Format is the framing around a deflate stream.
+type Format int
+
+const (
+	// FormatGzip is the gzip format of RFC 1952.
+	FormatGzip Format = iota
+	// FormatZlib is the zlib format of RFC 1950, with an Adler-32 trailer.
+	FormatZlib
+	// FormatRaw is a bare deflate stream of RFC 1951 without any header or
+	// trailer, as stored in zip archives.
+	FormatRaw
+	// FormatAuto makes a reader detect FormatGzip or FormatZlib from the
+	// header of each member.
+	FormatAuto
+)
+
+// gzip reports whether streams of format f may have gzip headers, and thus
+// consist of concatenated members.
+func (f Format) gzip() bool {
+	return f == FormatGzip || f == FormatAuto
+}
+
+// maxWindowBits is the base two logarithm of the largest window, 32KB.
+const maxWindowBits = 15
+
+// windowBits returns the windowBits argument of inflateInit2 and deflateInit2
+// that selects f with a window of 1<<bits bytes.
+func (f Format) windowBits(bits int) int {
+	switch f {
+	case FormatZlib:
+		return bits
+	case FormatRaw:
+		return -bits
+	case FormatAuto:
+		// 32 enables gzip and zlib header detection
+		return 32 + bits
+	default:
+		// 16 makes it understand only gzip files
+		return 16 + bits
+	}
+}
+
+// Compression levels of NewWriterLevel and SetParams, with the values of
+// compress/gzip.
+const (
+	NoCompression      = 0
+	BestSpeed          = 1
+	BestCompression    = 9
+	DefaultCompression = -1
+	// HuffmanOnly selects the default level with StrategyHuffmanOnly.
+	HuffmanOnly = -2
+)
+
+// ValidateLevel returns an error if level isn't a compression level, with the
+// meanings of NewWriterLevel, of a writer of format f. All the levels work with
+// all the formats that writers support, FormatGzip, FormatZlib and FormatRaw.
+func ValidateLevel(f Format, level int) error {
+	switch f {
+	case FormatGzip, FormatZlib, FormatRaw:
+	default:
+		return fmt.Errorf("zlib: invalid format %d", f)
+	}
+	if level < HuffmanOnly || level > BestCompression {
+		return fmt.Errorf("zlib: invalid level %d", level)
+	}
+	return nil
+}
+
+// huffmanOnly returns the zlib level and strategy for HuffmanOnly with
+// strategy, which must be the default.
+func huffmanOnly(strategy Strategy) (int, Strategy, error) {
+	if strategy != StrategyDefault && strategy != StrategyHuffmanOnly {
+		return 0, 0, fmt.Errorf("level %d with strategy %d", HuffmanOnly, strategy)
+	}
+	return DefaultCompression, StrategyHuffmanOnly, nil
+}
+
+// Strategy tunes the compression algorithm of a writer for the kind of data,
+// see deflateInit2 in zlib.h. It only affects the compression ratio and
+// speed; the output is a valid stream either way.
+type Strategy int
+
+const (
+	// StrategyDefault is for ordinary data.
+	StrategyDefault Strategy = iota
+	// StrategyFiltered is for data produced by a filter or predictor, such
+	// as PNG rows: small values with a somewhat random distribution. It
+	// favors Huffman coding over string matching.
+	StrategyFiltered
+	// StrategyHuffmanOnly only uses Huffman coding, without string matching.
+	StrategyHuffmanOnly
+	// StrategyRLE limits matches to a distance of one, i.e. run-length
+	// encoding. It is almost as fast as StrategyHuffmanOnly, and compresses
+	// PNG image data better.
+	StrategyRLE
+	// StrategyFixed disables dynamic Huffman codes, for simpler decoders.
+	StrategyFixed
+)
+
+// FlushMode selects how Writer.FlushMode ends the data compressed so far, see
+// deflate in zlib.h. Every mode writes all the output for the input so far,
+// so that a reader can decode it, but ending blocks early costs ratio.
+type FlushMode int
+
+const (
+	// FlushSync ends the current block and appends an empty stored block,
+	// which aligns the output to a byte boundary. It is what Flush does. The
+	// empty block takes 4 or 5 bytes, and the new block starts new Huffman
+	// codes; flushing source code every 4KB grows the output by about 3%, and
+	// every 1KB by about 10%.
+	FlushSync FlushMode = iota
+	// FlushFull is like FlushSync, and also clears the history, so that
+	// decoding can restart at the output that follows, see Reader.Recover and
+	// inflateSync in zlib.h. The data after it can't refer to the data before
+	// it, which costs much more than FlushSync: flushing source code every
+	// 32KB grows the output by about 10%, and every 1KB by over 70%.
+	FlushFull
+	// FlushPartial ends the current block and appends an empty static block of
+	// 10 bits, and up to one more, so it is cheaper than FlushSync but doesn't
+	// byte-align the output.
+	FlushPartial
+	// FlushBlock ends the current block without appending anything, so the
+	// output may end in the middle of a byte, which is held back until the
+	// next write. It is the cheapest mode, and is meant for framing formats
+	// that control block boundaries.
+	FlushBlock
+)
+
+// zlibFlush returns the flush argument of deflate for m.
+func (m FlushMode) zlibFlush() C.int {
+	switch m {
+	case FlushFull:
+		return C.Z_FULL_FLUSH
+	case FlushPartial:
+		return C.Z_PARTIAL_FLUSH
+	case FlushBlock:
+		return C.Z_BLOCK
+	default:
+		return C.Z_SYNC_FLUSH
+	}
+}
+
 type reader struct {
-	in         io.Reader
-	inConsumed bool    // true if zstream has finished consuming the current input buffer.
-	inEOF      bool    // true if in reaches io.EOF
+	in            io.Reader
+	format        Format
+	ignoreGarbage bool            // see ReaderOptions.IgnoreTrailingGarbage
+	limit         int64           // see ReaderOptions.Limit
+	windowBits    int             // see ReaderOptions.WindowBits
+	closeIn       bool            // see ReaderOptions.CloseUnderlying
+	closeErr      error           // result of closing in.
+	ctx           context.Context // see ReaderOptions.Context
+	passthrough   bool            // see ReaderOptions.Passthrough
+	sniffed       bool            // true once the passthrough check has been made.
+	plain         bool            // true if the input is passed through verbatim.
+	detected      Format          // format of the last header when format is FormatAuto.
+	inEOF         bool            // true if in reaches io.EOF
+	inErr         error           // error returned by in along with data, kept until the data is consumed.
+	exactInput    bool            // ReaderOptions.ExactInput.
+	exact         bool            // true if no input is read past the end of the stream.
+	seeker        io.Seeker       // in, if exact and in can give input back.
+	peeker        bufPeeker       // in, if exact and in is buffered like a bufio.Reader.
+	buffer        *bytes.Buffer   // in, if exact and in is a bytes.Buffer.
+	// peeked is the number of bytes at the end of inBuf[:inEnd] that peeker or
+	// buffer still hold; they are discarded once decoded.
+	peeked     int
+	byteReader io.ByteReader // in, if exact and in implements io.ByteReader.
+	unread     bool          // true if Remaining has been given back to seeker.
+	zs         zstream       // underlying zlib implementation.
+	// inLen and outLen are the in/out arguments of zs_inflate. Locals would
+	// escape to the heap on every call.
+	inLen, outLen C.int
+	bufSize       int                      // size of inBuf once it is allocated.
+	inBuf         []byte                   // allocated by the first Read.
+	pooled        *[defaultBufferSize]byte // backs inBuf if it came from inBufPool.
+	// inBuf[inPos:inEnd] is the input that zstream hasn't consumed yet.
+	inPos, inEnd int
+	multistream  bool // true if Read continues into the next gzip member.
+	memberEOF    bool // true if err is io.EOF because multistream is false.
+	hdr          *C.zs_header
+	header       Header
+	headerDone   bool   // true if header has been filled from hdr.
+	memberOut    int64  // bytes decoded from the current member so far.
+	lastSize     int64  // size of the last member that reached its trailer.
+	lastCheck    uint32 // checksum verified against the trailer of that member.
+	inMember     bool   // true if input has been fed to zstream since the last member ended.
+	consumed     int64  // compressed bytes consumed by zstream.
+	produced     int64  // bytes decoded by zstream.
+	members      []MemberBoundary
+	inRead       int64  // bytes read from in.
+	returned     int64  // decoded bytes returned to the caller.
+	outBuf       []byte // output buffer of WriteTo, allocated on first use.
+	// stage[stagePos:stageEnd] is output decoded by ReadByte but not returned
+	// yet. stage is allocated on first use.
+	stage              []byte
+	stagePos, stageEnd int
+	dict               []byte // preset dictionary; nil if none.
+	dictID             uint32 // Adler-32 of the dictionary the stream asked for.
+	closed             bool
+	corrupt            bool // true if err is a data error that Recover can skip.
+	err                error
+}
+
+// defaultBufferSize is the default buffer size used by NewBuffer.
+const defaultBufferSize = 512 * 1024
+
+// minFlushBufferSize is the smallest output buffer that a flush can complete
+// in; zlib.h asks for more than six bytes.
+const minFlushBufferSize = 64
+
+// outBufferSize is the size of the buffer WriteTo decodes into.
+const outBufferSize = 256 * 1024
+
+// stageBufferSize is the size of the buffer ReadByte decodes into.
+const stageBufferSize = 4096
+
+// maxConsecutiveEmptyReads is the number of (0, nil) results from the source
+// tolerated in a row before Read fails with io.ErrNoProgress, as in bufio.
+const maxConsecutiveEmptyReads = 100
+
+// maxConsecutiveEmptyWrites is the number of (0, nil) results from the
+// underlying writer tolerated in a row before a writer fails with
+// io.ErrShortWrite.
+const maxConsecutiveEmptyWrites = 100
+
+// inBufPool recycles the input buffers of default size.
+var inBufPool = sync.Pool{
+	New: func() interface{} { return new([defaultBufferSize]byte) },
+}
+
+// outBufPool recycles the output buffers of writers with
+// WriterOptions.PoolBuffer.
+var outBufPool = sync.Pool{
+	New: func() interface{} { return new([defaultBufferSize]byte) },
+}
+
+// maxExtraSize is the largest possible gzip FEXTRA field.
+const maxExtraSize = 65535
+
+// ReaderOptions configures a reader created by NewReaderOpts. The zero value
+// yields the same reader as NewReader.
+type ReaderOptions struct {
+	// Format is the format of the input. It defaults to FormatGzip.
+	Format Format
+	// BufferSize is the size of the input buffer. It defaults to 512KB. Any
+	// positive size is valid, down to 1 byte, but buffers smaller than a few KB
+	// cost a cgo call per few bytes of input. Negative sizes are rejected.
+	BufferSize int
+	// Buffer, if non-nil, is used as the input buffer instead of allocating
+	// one, and BufferSize is ignored. The reader owns it until Close returns;
+	// the caller must not touch it before then. The reader never grows or
+	// frees it.
+	Buffer []byte
+	// Dictionary is the preset dictionary the input was compressed with. For
+	// FormatZlib and FormatAuto, it is installed when a stream asks for one.
+	// For FormatRaw, it is installed at the start of the stream. The reader
+	// doesn't modify it, and the caller must not modify it either.
+	Dictionary []byte
+	// IgnoreTrailingGarbage makes Read return io.EOF instead of an error when
+	// the input that follows a complete gzip member isn't the header of
+	// another member. By default such input is an error, like in gzip.Reader.
+	IgnoreTrailingGarbage bool
+	// Limit is the maximum number of bytes decoded from a stream, across all of
+	// its members. Read fails with ErrLimitExceeded once the stream turns out
+	// to be longer. Zero means no limit.
+	Limit int64
+	// MaxExtraSize is the maximum number of bytes of the gzip FEXTRA field kept
+	// in Header.Extra. Longer fields are truncated. It defaults to 65535, which
+	// keeps any field in full. A negative value disables capturing the field.
+	MaxExtraSize int
+	// Passthrough makes the reader return the input verbatim if it doesn't
+	// start with a header of the format, like gzip -dc does for files that
+	// aren't compressed. For FormatGzip that is the 0x1f 0x8b magic, for
+	// FormatZlib a zlib header, and FormatAuto accepts either. The check is
+	// made once per stream, on its first two bytes. It is ignored for
+	// FormatRaw, which has no header.
+	Passthrough bool
+	// WindowBits is the base two logarithm of the window size, 8 to 15. It
+	// defaults to 15, the 32KB window that any stream can be decoded with.
+	// Streams compressed with a window no larger than 1<<WindowBits bytes can
+	// be decoded with less memory: the zlib state of a reader takes about
+	// 1<<WindowBits + 7KB, plus the input buffer. Read fails with
+	// ErrWindowTooSmall on a stream that needs a larger window.
+	WindowBits int
+	// CloseUnderlying makes Close also close the source if it implements
+	// io.Closer, after the zlib state has been freed. Reset doesn't close the
+	// source it replaces.
+	CloseUnderlying bool
+	// SkipChecksum disables the verification of the CRC-32 and the size in
+	// gzip trailers, the Adler-32 in zlib trailers, and the FHCRC of gzip
+	// headers, which saves computing them. It is only safe for input whose
+	// integrity is verified otherwise. It is rejected for FormatRaw, which has
+	// no checksum to skip.
+	SkipChecksum bool
+	// Context, if non-nil, is checked between the inflate calls of Read, which
+	// fails with ctx.Err() once the context is done. The reader can still be
+	// closed then.
+	Context context.Context
+	// ExactInput makes the reader read no input past the end of the stream,
+	// so that the source is left positioned right after it, like
+	// compress/flate does. It is enabled automatically for the sources that
+	// implement io.ByteReader and can be read in chunks all the same: an
+	// io.Seeker such as a bytes.Reader, whose input read past the end is given
+	// back with Seek once the stream ends, and a bufio.Reader or a
+	// bytes.Buffer, whose buffered input is only consumed once decoded.
+	// Remaining returns the input past the end until the next Read. Other
+	// sources are read one byte at a time, which costs a cgo call per byte,
+	// so they need the option. The end is that of a zlib or raw stream, or
+	// of a gzip member when multistream mode is disabled; in multistream mode
+	// the reader reads on to look for another member.
+	ExactInput bool
+}
+
+// NewReader creates a gzip reader with 512KB buffer.
+func NewReader(r io.Reader) (Reader, error) {
+	return NewReaderOpts(r, ReaderOptions{})
+}
+
+// NewReaderBuffer creates a new gzip reader with a given prefetch buffer size.
+// Zero selects the default size; see ReaderOptions.BufferSize.
+func NewReaderBuffer(in io.Reader, bufSize int) (Reader, error) {
+	return NewReaderOpts(in, ReaderOptions{BufferSize: bufSize})
+}
+
+// NewReaderRaw creates a reader of a raw deflate stream, such as the contents
+// of a zip archive entry. Raw streams have no header or trailer, and Read
+// returns io.EOF at the end of the stream regardless of Multistream.
+func NewReaderRaw(in io.Reader, bufSize int) (Reader, error) {
+	return NewReaderOpts(in, ReaderOptions{Format: FormatRaw, BufferSize: bufSize})
+}
+
+// NewReaderZlib creates a reader of a zlib stream. The Adler-32 trailer is
+// verified, and Read returns io.EOF at the end of the stream regardless of
+// Multistream.
+func NewReaderZlib(in io.Reader, bufSize int) (Reader, error) {
+	return NewReaderOpts(in, ReaderOptions{Format: FormatZlib, BufferSize: bufSize})
+}
+
+// NewReaderAuto creates a reader that accepts both gzip and zlib streams,
+// detecting the format from the header of each member. See Reader.Format.
+func NewReaderAuto(in io.Reader, bufSize int) (Reader, error) {
+	return NewReaderOpts(in, ReaderOptions{Format: FormatAuto, BufferSize: bufSize})
+}
+
+// NewReaderDict creates a reader of a zlib stream compressed with the preset
+// dictionary dict.
+func NewReaderDict(in io.Reader, dict []byte, bufSize int) (Reader, error) {
+	return NewReaderOpts(in, ReaderOptions{Format: FormatZlib, Dictionary: dict, BufferSize: bufSize})
+}
+
+// NewReaderLimit creates a gzip reader that decodes at most maxBytes bytes,
+// as a defense against decompression bombs. See ReaderOptions.Limit.
+func NewReaderLimit(in io.Reader, maxBytes int64) (Reader, error) {
+	return NewReaderOpts(in, ReaderOptions{Limit: maxBytes})
+}
+
+// NewReaderWithBuffer creates a gzip reader that uses buf as its input buffer
+// instead of allocating one. See ReaderOptions.Buffer.
+func NewReaderWithBuffer(in io.Reader, buf []byte) (Reader, error) {
+	if len(buf) == 0 {
+		return nil, errors.New("zlib: empty buffer")
+	}
+	return NewReaderOpts(in, ReaderOptions{Buffer: buf})
+}
+
+// NewReaderOpts creates a reader configured by opts.
+func NewReaderOpts(in io.Reader, opts ReaderOptions) (Reader, error) {
+	if opts.Buffer != nil {
+		opts.BufferSize = len(opts.Buffer)
+		if opts.BufferSize == 0 {
+			return nil, errors.New("zlib: empty buffer")
+		}
+	}
+	if opts.BufferSize < 0 {
+		return nil, fmt.Errorf("zlib: invalid buffer size %d", opts.BufferSize)
+	}
+	if opts.BufferSize == 0 {
+		opts.BufferSize = defaultBufferSize
+	}
+	if opts.WindowBits == 0 {
+		opts.WindowBits = maxWindowBits
+	}
+	if opts.WindowBits < 8 || opts.WindowBits > maxWindowBits {
+		return nil, fmt.Errorf("zlib: invalid window bits %d", opts.WindowBits)
+	}
+	if opts.SkipChecksum && opts.Format == FormatRaw {
+		return nil, errors.New("zlib: FormatRaw has no checksum to skip")
+	}
+	switch {
+	case opts.MaxExtraSize == 0 || opts.MaxExtraSize > maxExtraSize:
+		opts.MaxExtraSize = maxExtraSize
+	case opts.MaxExtraSize < 0:
+		opts.MaxExtraSize = 0
+	}
+	z := &reader{
+		exactInput:    opts.ExactInput,
+		format:        opts.Format,
+		ignoreGarbage: opts.IgnoreTrailingGarbage,
+		limit:         opts.Limit,
+		windowBits:    opts.WindowBits,
+		closeIn:       opts.CloseUnderlying,
+		ctx:           opts.Context,
+		passthrough:   opts.Passthrough && opts.Format != FormatRaw,
+		detected:      FormatAuto,
+		multistream:   true,
+	}
+	z.setSource(in)
+	z.bufSize = opts.BufferSize
+	z.inBuf = opts.Buffer
+	if len(opts.Dictionary) > 0 {
+		z.dict = opts.Dictionary
+	}
+	ec := C.zs_inflate_init(&z.zs[0], C.int(opts.Format.windowBits(opts.WindowBits)))
+	if ec != 0 {
+		return nil, zlibReturnCodeToError(ec)
+	}
+	if opts.SkipChecksum {
+		// inflateReset keeps this setting.
+		if ec = C.zs_inflate_validate(&z.zs[0], 0); ec != 0 {
+			C.zs_inflate_end(&z.zs[0])
+			return nil, zlibReturnCodeToError(ec)
+		}
+	}
+	if z.format == FormatRaw && z.dict != nil {
+		if ec = z.setDictionary(); ec != 0 {
+			C.zs_inflate_end(&z.zs[0])
+			return nil, zlibReturnCodeToError(ec)
+		}
+	}
+	if opts.Format.gzip() {
+		z.hdr = C.zs_header_new(C.int(opts.MaxExtraSize))
+		if z.hdr == nil {
+			C.zs_inflate_end(&z.zs[0])
+			return nil, zlibErrors[C.Z_MEM_ERROR]
+		}
+		if ec = C.zs_inflate_get_header(&z.zs[0], z.hdr); ec != 0 {
+			z.end()
+			return nil, zlibReturnCodeToError(ec)
+		}
+	}
+	runtime.SetFinalizer(z, gcReader)
+	return z, nil
+}
+
+// setSource makes z read the compressed stream from in.
+func (z *reader) setSource(in io.Reader) {
+	z.in = in
+	z.byteReader, _ = in.(io.ByteReader)
+	z.seeker, z.peeker, z.buffer = nil, nil, nil
+	switch in := in.(type) {
+	case io.Seeker:
+		z.seeker = in
+	case bufPeeker:
+		z.peeker = in
+	case *bytes.Buffer:
+		z.buffer = in
+	}
+	// Sources that can give input back are read in chunks, so exact mode is
+	// free for them. Others are read a byte at a time, only on request.
+	cheap := z.byteReader != nil && (z.seeker != nil || z.peeker != nil || z.buffer != nil)
+	z.exact = z.exactInput || cheap
+	if z.exact && z.seeker != nil && !canSeek(z.seeker) {
+		// A pipe has Seek too, but fails it; read it a byte at a time.
+		z.seeker = nil
+	}
+	if !z.exact {
+		z.seeker, z.peeker, z.buffer = nil, nil, nil
+	}
+	z.peeked = 0
+	z.unread = false
+}
+
+// canSeek reports whether s can actually seek, unlike an os.File on a pipe.
+func canSeek(s io.Seeker) bool {
+	_, err := s.Seek(0, io.SeekCurrent)
+	return err == nil
+}
+
+// bufPeeker is a buffered source such as a bufio.Reader, whose input can be
+// looked at before it is consumed.
+type bufPeeker interface {
+	Buffered() int
+	Peek(n int) ([]byte, error)
+	Discard(n int) (int, error)
+}
+
+func gcReader(z *reader) {
+	z.end()
+}
+
+// end releases the C state of z.
+func (z *reader) end() {
+	C.zs_inflate_end(&z.zs[0])
+	if z.hdr != nil {
+		C.zs_header_free(z.hdr)
+		z.hdr = nil
+	}
+}
+
+// allocInBuf allocates inBuf. It is deferred to the first Read so that readers
+// that are never read don't hold a buffer. If the source tells how much input
+// is left, like bytes.Reader does, the buffer isn't made larger than that.
+func (z *reader) allocInBuf() {
+	size := z.bufSize
+	if l, ok := z.in.(interface{ Len() int }); ok {
+		if n := l.Len(); n < size {
+			size = n + 1 // + 1 lets the first read see io.EOF.
+		}
+	}
+	if size == defaultBufferSize {
+		z.pooled = inBufPool.Get().(*[defaultBufferSize]byte)
+		z.inBuf = z.pooled[:]
+		return
+	}
+	z.inBuf = make([]byte, size)
+}
+
+// inBufFits reports whether inBuf, allocated for a previous source, is as
+// large as allocInBuf would make it for the current one, so that Reset keeps
+// it.
+func (z *reader) inBufFits() bool {
+	if len(z.inBuf) >= z.bufSize {
+		return true
+	}
+	l, ok := z.in.(interface{ Len() int })
+	return ok && l.Len() < len(z.inBuf)
+}
+
+// Close implements io.Closer. Calling Close more than once returns the same
+// result without touching the freed zstream. With
+// ReaderOptions.CloseUnderlying, it returns the error of closing the source
+// unless decoding had failed.
+func (z *reader) Close() error {
+	if !z.closed {
+		z.closed = true
+		z.end()
+		runtime.SetFinalizer(z, nil)
+		// The closed reader never touches inBuf again, so it can be handed to
+		// another reader.
+		if z.pooled != nil {
+			inBufPool.Put(z.pooled)
+			z.pooled = nil
+		}
+		z.inBuf = nil
+		z.inPos, z.inEnd = 0, 0
+		if c, ok := z.in.(io.Closer); ok && z.closeIn {
+			z.closeErr = c.Close()
+		}
+	}
+	if z.err == nil || z.err == io.EOF {
+		return z.closeErr
+	}
+	return z.err
+}
+
+// Read implements io.Reader. Once Read fails, every later call returns the same
+// error without doing any work, except for the io.EOF at the end of a member
+// when multistream mode is disabled, and ErrDictionaryRequired. A Read into an
+// empty slice returns 0 and no error, unless the reader is closed; it neither
+// reads input nor reports an error that a non-empty Read would return.
+func (z *reader) Read(out []byte) (int, error) {
+	if z.closed {
+		return 0, ErrReaderClosed
+	}
+	if len(out) == 0 {
+		return 0, nil
+	}
+	if z.stagePos < z.stageEnd {
+		n := copy(out, z.stage[z.stagePos:z.stageEnd])
+		z.stagePos += n
+		z.returned += int64(n)
+		return n, nil
+	}
+	n, err := z.read(out)
+	z.returned += int64(n)
+	return n, err
+}
+
+// ReadByte implements io.ByteReader. It decodes into a small buffer, so that
+// reading one byte at a time doesn't cost a cgo call per byte. Read returns
+// the rest of that buffer before decoding more.
+func (z *reader) ReadByte() (byte, error) {
+	if z.closed {
+		return 0, ErrReaderClosed
+	}
+	for z.stagePos == z.stageEnd {
+		if z.stage == nil {
+			z.stage = make([]byte, stageBufferSize)
+		}
+		n, err := z.read(z.stage)
+		z.stagePos, z.stageEnd = 0, n
+		if n == 0 && err != nil {
+			return 0, err
+		}
+	}
+	c := z.stage[z.stagePos]
+	z.stagePos++
+	z.returned++
+	return c, nil
+}
+
+// Discard skips the next n decoded bytes. It decodes into a buffer owned by
+// the reader, like WriteTo, so skipping costs no copy to the caller. It returns
+// the number of bytes skipped, and io.ErrUnexpectedEOF if the stream ends
+// before n bytes.
+func (z *reader) Discard(n int64) (int64, error) {
+	if z.closed {
+		return 0, ErrReaderClosed
+	}
+	var skipped int64
+	if staged := int64(z.stageEnd - z.stagePos); staged > 0 {
+		if staged > n {
+			staged = n
+		}
+		z.stagePos += int(staged)
+		skipped = staged
+	}
+	if skipped < n && z.outBuf == nil {
+		z.outBuf = make([]byte, outBufferSize)
+	}
+	for skipped < n {
+		buf := z.outBuf
+		if left := n - skipped; int64(len(buf)) > left {
+			buf = buf[:left]
+		}
+		m, err := z.read(buf)
+		skipped += int64(m)
+		if err == io.EOF && skipped == n {
+			break
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			z.returned += skipped
+			return skipped, err
+		}
+	}
+	z.returned += skipped
+	return skipped, nil
+}
+
+// read decodes into out, bypassing stage.
+func (z *reader) read(out []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	if z.unread {
+		// The source yields that input again.
+		z.inRead -= int64(z.inEnd - z.inPos)
+		z.inPos = z.inEnd
+		z.inEOF, z.inErr = false, nil
+		z.unread = false
+	}
+	if z.limit > 0 {
+		// Decode at most one byte past the limit; it tells that the limit is
+		// exceeded rather than reached.
+		if left := z.limit - z.produced + 1; int64(len(out)) > left {
+			out = out[:left]
+		}
+	}
+	var orgOut = out
+	for z.err == nil && len(out) > 0 {
+		if z.ctx != nil {
+			if err := z.ctx.Err(); err != nil {
+				z.err = err
+				break
+			}
+		}
+		if z.plain {
+			out = out[z.readPlain(out):]
+			break
+		}
+		if z.inPos == z.inEnd {
+			if err := z.fill(); err != nil {
+				if err == io.EOF {
+					err = z.eofError()
+				}
+				z.err = err
+				break
+			}
+		}
+		if z.passthrough && !z.sniffed {
+			if err := z.sniff(); err != nil {
+				z.err = err
+				break
+			}
+			continue
+		}
+		z.inLen = C.int(z.inEnd - z.inPos)
+		z.outLen = C.int(len(out))
+		ret := C.zs_inflate(&z.zs[0], unsafe.Pointer(&z.inBuf[z.inPos]), &z.inLen, unsafe.Pointer(&out[0]), &z.outLen)
+		z.consumed += int64(z.inEnd - z.inPos - int(z.inLen))
+		z.inPos = z.inEnd - int(z.inLen)
+		z.inMember = true
+		if !z.headerDone && z.hdr != nil {
+			z.readHeader(ret)
+		}
+		if ret == C.Z_NEED_DICT {
+			// At this point zlib has stored the dictionary ID in adler.
+			z.dictID = uint32(C.zs_get_adler(&z.zs[0]))
+			if z.dict == nil {
+				// SetDictionary can resume from here.
+				z.err = ErrDictionaryRequired
+				break
+			}
+			ret = z.setDictionary()
+		}
+		if ret != C.Z_STREAM_END && ret != C.Z_OK {
+			z.err = inflateError(&z.zs, ret)
+			if z.windowBits < maxWindowBits && ret == C.Z_DATA_ERROR {
+				// A zlib header tells the window size, gzip and raw streams
+				// only fail once a match reaches too far.
+				switch C.GoString(C.zs_get_msg(&z.zs[0])) {
+				case "invalid window size", "invalid distance too far back":
+					z.err = ErrWindowTooSmall
+				}
+			}
+			if z.isGarbage() {
+				z.err = io.EOF
+			} else {
+				z.corrupt = ret == C.Z_DATA_ERROR
+			}
+			break
+		}
+		nOut := len(out) - int(z.outLen)
+		out = out[nOut:]
+		z.memberOut += int64(nOut)
+		z.produced += int64(nOut)
+		if ret == C.Z_STREAM_END {
+			z.endMember()
+			z.lastSize = z.memberOut
+			if z.Format() != FormatRaw {
+				// inflateReset below clears adler.
+				z.lastCheck = uint32(C.zs_get_adler(&z.zs[0]))
+			}
+			z.memberOut = 0
+			z.inMember = false
+			if !z.format.gzip() {
+				// Only gzip has a notion of concatenated members.
+				z.err = io.EOF
+				z.unreadRemaining()
+				break
+			}
+			ret = z.resetMember()
+			if ret != C.Z_OK {
+				z.err = zlibReturnCodeToError(ret)
+			} else if !z.multistream {
+				z.err = io.EOF
+				z.memberEOF = true
+				z.unreadRemaining()
+			}
+			if len(out) < len(orgOut) {
+				break
+			}
+			// An empty member; returning 0 bytes and no error would look
+			// like no progress to the caller.
+		}
+	}
+	// Keep the finalizer from freeing zstream while a cgo call is using it.
+	runtime.KeepAlive(z)
+	n := len(orgOut) - len(out)
+	if z.limit > 0 && z.produced > z.limit {
+		n -= int(z.produced - z.limit)
+		z.err = ErrLimitExceeded
+	}
+	if n > 0 && z.err != io.EOF {
+		// Like the io.Readers of the standard library, return the data first;
+		// many callers ignore n along with an error. The next call returns
+		// the error.
+		return n, nil
+	}
+	return n, z.err
+}
+
+// fill reads the next chunk of input into inBuf once zstream has consumed the
+// previous one. It returns io.EOF if the source has no more input.
+func (z *reader) fill() error {
+	if z.inEOF {
+		return io.EOF
+	}
+	if z.inErr != nil {
+		return z.inErr
+	}
+	if z.inBuf == nil {
+		z.allocInBuf()
+	}
+	n, err := z.readInput(z.inBuf)
+	for i := 1; n == 0 && err == nil; i++ {
+		if i == maxConsecutiveEmptyReads {
+			return io.ErrNoProgress
+		}
+		n, err = z.readInput(z.inBuf)
+	}
+	switch {
+	case err == io.EOF:
+		z.inEOF = true
+	case err != nil && n == 0:
+		return err
+	case err != nil:
+		// Decode the data first, an io.Reader may return both.
+		z.inErr = err
+	}
+	if n == 0 {
+		return io.EOF
+	}
+	z.inPos, z.inEnd = 0, n
+	z.inRead += int64(n)
+	return nil
+}
+
+// readInput reads from in into buf. In exact mode, buffered sources are only
+// consumed once their input is decoded, and sources that can't give input back
+// are read one byte at a time.
+func (z *reader) readInput(buf []byte) (int, error) {
+	if !z.exact || z.seeker != nil {
+		return z.in.Read(buf)
+	}
+	if z.peeker != nil || z.buffer != nil {
+		return z.peekInput(buf)
+	}
+	if z.byteReader == nil {
+		return z.in.Read(buf[:1])
+	}
+	c, err := z.byteReader.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	buf[0] = c
+	return 1, nil
+}
+
+// peekInput copies the input buffered by peeker or buffer past the peeked
+// bytes into buf, after consuming the peeked bytes that have been decoded.
+func (z *reader) peekInput(buf []byte) (int, error) {
+	z.discardDecoded()
+	var p []byte
+	if z.buffer != nil {
+		if p = z.buffer.Bytes()[z.peeked:]; len(p) == 0 {
+			return 0, io.EOF
+		}
+	} else {
+		if z.peeker.Buffered() <= z.peeked {
+			if _, err := z.peeker.Peek(z.peeked + 1); err != nil {
+				return 0, err
+			}
+		}
+		p, _ = z.peeker.Peek(z.peeker.Buffered())
+		p = p[z.peeked:]
+	}
+	n := copy(buf, p)
+	z.peeked += n
+	return n, nil
+}
+
+// discardDecoded consumes the peeked bytes that are no longer in
+// inBuf[inPos:inEnd], so that the source holds just the undecoded ones.
+func (z *reader) discardDecoded() {
+	n := z.peeked - (z.inEnd - z.inPos)
+	if n <= 0 {
+		return
+	}
+	if z.buffer != nil {
+		z.buffer.Next(n)
+	} else {
+		z.peeker.Discard(n)
+	}
+	z.peeked -= n
+}
+
+// unreadRemaining gives the input buffered past the end of the stream back to
+// a seekable or buffered source in exact mode. It stays in inBuf for
+// Remaining.
+func (z *reader) unreadRemaining() {
+	if z.peeker != nil || z.buffer != nil {
+		// Only consume the decoded input; the source keeps the rest.
+		z.discardDecoded()
+		z.peeked = 0
+		z.unread = z.inPos < z.inEnd
+		return
+	}
+	if z.seeker == nil || z.inPos == z.inEnd {
+		return
+	}
+	if _, err := z.seeker.Seek(int64(z.inPos-z.inEnd), io.SeekCurrent); err != nil {
+		z.err = err
+		z.memberEOF = false
+		return
+	}
+	z.unread = true
+}
+
+// sniff decides whether the input is passed through verbatim, from its first
+// two bytes. At least one byte is buffered.
+func (z *reader) sniff() error {
+	for i := 0; z.inEnd-z.inPos < 2 && !z.inEOF && z.inErr == nil && len(z.inBuf) >= 2; i++ {
+		if i == maxConsecutiveEmptyReads {
+			return io.ErrNoProgress
+		}
+		n := copy(z.inBuf, z.inBuf[z.inPos:z.inEnd])
+		z.inPos, z.inEnd = 0, n
+		n, err := z.readInput(z.inBuf[z.inEnd:])
+		z.inEnd += n
+		z.inRead += int64(n)
+		if err == io.EOF {
+			z.inEOF = true
+		} else if err != nil {
+			// fill returns it once the buffered input is consumed.
+			z.inErr = err
+		}
+	}
+	gzip, zlib := sniffHeader(z.inBuf[z.inPos:z.inEnd])
+	switch z.format {
+	case FormatGzip:
+		z.plain = !gzip
+	case FormatZlib:
+		z.plain = !zlib
+	default:
+		z.plain = !gzip && !zlib
+	}
+	z.sniffed = true
+	return nil
+}
+
+// sniffHeader reports whether b, the first bytes of a stream, may start a gzip
+// or a zlib header. A single 0x1f byte may start a gzip header.
+func sniffHeader(b []byte) (gzip, zlib bool) {
+	if len(b) == 0 {
+		return false, false
+	}
+	gzip = b[0] == 0x1f && (len(b) < 2 || b[1] == 0x8b)
+	zlib = len(b) >= 2 && b[0]&0x0f == 8 && b[0]>>4 <= 7 && (uint(b[0])<<8|uint(b[1]))%31 == 0
+	return gzip, zlib
+}
+
+// Sniff reads the first two bytes of r to tell whether it is a gzip or a zlib
+// stream. It returns FormatGzip or FormatZlib, or ok false if the input starts
+// with neither header, and a reader that yields the whole input of r,
+// including the bytes read by Sniff. Short input isn't an error; err is only
+// set if reading r fails.
+func Sniff(r io.Reader) (f Format, ok bool, rest io.Reader, err error) {
+	var b [2]byte
+	n, err := io.ReadFull(r, b[:])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	rest = io.MultiReader(bytes.NewReader(b[:n]), r)
+	switch gzip, zlib := sniffHeader(b[:n]); {
+	case gzip:
+		return FormatGzip, true, rest, err
+	case zlib:
+		return FormatZlib, true, rest, err
+	}
+	return FormatAuto, false, rest, err
+}
+
+// readPlain copies input to out when the input is passed through verbatim,
+// and returns the number of bytes copied.
+func (z *reader) readPlain(out []byte) int {
+	if z.inPos < z.inEnd {
+		n := copy(out, z.inBuf[z.inPos:z.inEnd])
+		z.inPos += n
+		z.consumed += int64(n)
+		z.produced += int64(n)
+		return n
+	}
+	if z.inEOF || z.inErr != nil {
+		z.err = z.inErr
+		if z.inEOF {
+			z.err = io.EOF
+		}
+		return 0
+	}
+	if z.peeked > 0 {
+		// inBuf is all copied out, so the source must not yield it again.
+		z.discardDecoded()
+	}
+	n, err := z.in.Read(out)
+	z.inRead += int64(n)
+	z.consumed += int64(n)
+	z.produced += int64(n)
+	if err == io.EOF {
+		z.inEOF = true
+	}
+	z.err = err
+	return n
+}
+
+// Passthrough reports whether the reader returns the input verbatim because
+// it doesn't start with a header, see ReaderOptions.Passthrough. It is valid
+// once Read has returned data or an error.
+func (z *reader) Passthrough() bool {
+	return z.plain
+}
+
+// Recover resumes decoding after Read has failed because the input is
+// corrupted. It skips the input up to the next full flush point of the deflate
+// stream and returns the number of compressed bytes skipped; Read then
+// continues from there. The data between the corruption and the flush point is
+// lost, and the checksum and size of the damaged member are not verified. If
+// the rest of the input has no flush point, Recover returns ErrNoSyncPoint,
+// which Read returns from then on. If Read hasn't failed with a data error,
+// Recover does nothing and returns the error of the last Read.
+func (z *reader) Recover() (int64, error) {
+	if z.closed {
+		return 0, ErrReaderClosed
+	}
+	if !z.corrupt {
+		return 0, z.err
+	}
+	z.corrupt = false
+	var skipped int64
+	for {
+		if z.inPos == z.inEnd {
+			if err := z.fill(); err != nil {
+				if err == io.EOF {
+					err = ErrNoSyncPoint
+				}
+				z.err = err
+				return skipped, err
+			}
+		}
+		z.inLen = C.int(z.inEnd - z.inPos)
+		ret := C.zs_inflate_sync(&z.zs[0], unsafe.Pointer(&z.inBuf[z.inPos]), &z.inLen)
+		runtime.KeepAlive(z)
+		n := z.inEnd - z.inPos - int(z.inLen)
+		z.inPos += n
+		z.consumed += int64(n)
+		skipped += int64(n)
+		switch ret {
+		case C.Z_OK:
+			z.err = nil
+			return skipped, nil
+		case C.Z_DATA_ERROR:
+			// No flush point in this chunk; zlib remembers a partial match.
+		default:
+			z.err = zlibReturnCodeToError(ret)
+			return skipped, z.err
+		}
+	}
+}
+
+// WriteTo implements io.WriterTo. It decodes into a buffer owned by the reader
+// and writes it to w, so that io.Copy needs no intermediate buffer. It stops
+// where Read would return io.EOF, and returns the number of decoded bytes
+// written to w.
+func (z *reader) WriteTo(w io.Writer) (int64, error) {
+	if z.outBuf == nil {
+		z.outBuf = make([]byte, outBufferSize)
+	}
+	var total int64
+	for {
+		n, err := z.Read(z.outBuf)
+		if n > 0 {
+			nw, werr := w.Write(z.outBuf[:n])
+			total += int64(nw)
+			if werr != nil {
+				return total, werr
+			}
+			if nw < n {
+				return total, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Reset discards the reader's state and makes it equivalent to the result of
+// NewReader on r, reusing the existing buffers. Any input buffered from the
+// previous stream is dropped, even if that stream ended mid-member.
+func (z *reader) Reset(r io.Reader) error {
+	if z.closed {
+		return ErrReaderClosed
+	}
+	ret := z.resetMember()
+	if ret != C.Z_OK {
+		return zlibReturnCodeToError(ret)
+	}
+
+	z.setSource(r)
+	z.inEOF = false
+	z.inErr = nil
+	z.inPos, z.inEnd = 0, 0
+	if !z.inBufFits() {
+		// Sized for a smaller previous source; allocate again for r.
+		z.inBuf = nil
+	}
+	z.stagePos, z.stageEnd = 0, 0
+	z.multistream = true
+	z.memberEOF = false
+	z.header = Header{}
+	z.detected = FormatAuto
+	z.memberOut, z.lastSize, z.lastCheck = 0, 0, 0
+	z.inMember = false
+	z.consumed, z.produced = 0, 0
+	z.inRead, z.returned = 0, 0
+	z.members = z.members[:0]
+	z.dictID = 0
+	z.corrupt = false
+	z.sniffed, z.plain = false, false
+	z.err = nil
+
+	return nil
+}
+
+// endMember records the boundary of the member that zstream just finished.
+// Compressed bytes of the next member may still be buffered in inBuf, but they
+// aren't counted in consumed yet.
+func (z *reader) endMember() {
+	var m MemberBoundary
+	if n := len(z.members); n > 0 {
+		m.CompressedStart = z.members[n-1].CompressedEnd
+		m.UncompressedStart = z.members[n-1].UncompressedEnd
+	}
+	m.CompressedEnd = z.consumed
+	m.UncompressedEnd = z.produced
+	z.members = append(z.members, m)
+}
+
+// Members returns the boundaries of the members that have been decoded up to
+// their trailer since the reader was created or Reset, in stream order. The
+// slice grows by one entry per member and must not be modified.
+func (z *reader) Members() []MemberBoundary {
+	return z.members
+}
+
+// MemberCount returns the number of members that have been decoded up to
+// their trailer, i.e. len(Members()).
+func (z *reader) MemberCount() int {
+	return len(z.members)
+}
+
+// Remaining returns the input that has been read from the source but not
+// consumed by the decoder. After Read returns io.EOF at the end of a zlib or
+// raw stream, or at the end of a gzip member with multistream mode disabled,
+// these are the bytes that follow the stream; the rest of the source can be
+// read from the source itself. With ReaderOptions.ExactInput, the source has
+// been rewound to the end of the stream and yields these bytes too. The slice
+// aliases the reader's buffer and is only valid until the next call to Read or
+// Reset.
+func (z *reader) Remaining() []byte {
+	return z.inBuf[z.inPos:z.inEnd]
+}
+
+// InputBytes returns the number of compressed bytes read from the source since
+// the reader was created or Reset. It includes input that is buffered but not
+// decoded yet, see Remaining.
+func (z *reader) InputBytes() int64 {
+	return z.inRead
+}
+
+// OutputBytes returns the number of decoded bytes returned by Read, ReadByte
+// and WriteTo, or skipped by Discard and NextMember, since the reader was
+// created or Reset.
+func (z *reader) OutputBytes() int64 {
+	return z.returned
+}
+
+// Offsets returns the current position of the reader in the compressed and
+// the decompressed stream. Unlike InputBytes, compressed counts only the input
+// consumed by the decoder, not input buffered in the reader. uncompressed is
+// the number of decoded bytes returned to the caller, like OutputBytes. At a
+// member boundary, the offsets match the corresponding MemberBoundary.
+func (z *reader) Offsets() (compressed, uncompressed int64) {
+	return z.consumed, z.returned
+}
+
+// Checkpoint is a snapshot of the state of a reader, taken by
+// Reader.Checkpoint. It holds a copy of the zlib state, including the window,
+// in C memory, and must be closed once it's no longer needed.
+type Checkpoint struct {
+	z      *reader // the reader that took the checkpoint.
+	zs     zstream
+	hdr    *C.zs_header // copy of z.hdr; nil if z has none.
+	closed bool
+
+	input       []byte // copy of inBuf[inPos:inEnd].
+	inEOF       bool
+	stage       []byte // copy of stage[stagePos:stageEnd].
+	detected    Format
+	multistream bool
+	memberEOF   bool
+	header      Header
+	headerDone  bool
+	memberOut   int64
+	lastSize    int64
+	lastCheck   uint32
+	inMember    bool
+	consumed    int64
+	produced    int64
+	members     []MemberBoundary
+	inRead      int64
+	returned    int64
+	dictID      uint32
+	corrupt     bool
+	sniffed     bool
+	plain       bool
+	err         error
+}
+
+// InputOffset returns the offset in the source at which the reader was
+// reading when the checkpoint was taken. The source passed to Restore must
+// continue from that offset.
+func (cp *Checkpoint) InputOffset() int64 {
+	return cp.inRead
+}
+
+// OutputOffset returns the number of decoded bytes that the reader had
+// returned when the checkpoint was taken. After Restore, Read continues right
+// after them.
+func (cp *Checkpoint) OutputOffset() int64 {
+	return cp.returned
+}
+
+// Close frees the C memory held by the checkpoint. It can be called more than
+// once.
+func (cp *Checkpoint) Close() error {
+	if !cp.closed {
+		cp.closed = true
+		cp.end()
+		runtime.SetFinalizer(cp, nil)
+	}
+	return nil
+}
+
+func gcCheckpoint(cp *Checkpoint) {
+	cp.end()
+}
+
+// end releases the C state of cp.
+func (cp *Checkpoint) end() {
+	C.zs_inflate_end(&cp.zs[0])
+	if cp.hdr != nil {
+		C.zs_header_free(cp.hdr)
+		cp.hdr = nil
+	}
+}
+
+// Checkpoint takes a snapshot of the reader from which Restore can resume
+// decoding later, e.g. after a failure of the source, without decoding the
+// stream again from the start. The checkpoint only lives in memory; it can be
+// restored any number of times into the reader that took it, and must be
+// closed to free its C memory.
+func (z *reader) Checkpoint() (*Checkpoint, error) {
+	if z.closed {
+		return nil, ErrReaderClosed
+	}
+	cp := &Checkpoint{z: z}
+	ret := C.zs_inflate_copy(&cp.zs[0], &z.zs[0])
+	runtime.KeepAlive(z)
+	if ret != C.Z_OK {
+		return nil, zlibReturnCodeToError(ret)
+	}
+	if z.hdr != nil {
+		cp.hdr = C.zs_header_new(C.int(z.hdr.extra_max))
+		if cp.hdr == nil {
+			C.zs_inflate_end(&cp.zs[0])
+			return nil, zlibErrors[C.Z_MEM_ERROR]
+		}
+		C.zs_header_copy(cp.hdr, z.hdr)
+	}
+	runtime.SetFinalizer(cp, gcCheckpoint)
+
+	cp.input = append([]byte(nil), z.inBuf[z.inPos:z.inEnd]...)
+	cp.inEOF = z.inEOF
+	cp.stage = append([]byte(nil), z.stage[z.stagePos:z.stageEnd]...)
+	cp.detected = z.detected
+	cp.multistream = z.multistream
+	cp.memberEOF = z.memberEOF
+	cp.header = z.header
+	cp.headerDone = z.headerDone
+	cp.memberOut = z.memberOut
+	cp.lastSize = z.lastSize
+	cp.lastCheck = z.lastCheck
+	cp.inMember = z.inMember
+	cp.consumed = z.consumed
+	cp.produced = z.produced
+	cp.members = append([]MemberBoundary(nil), z.members...)
+	cp.inRead = z.inRead
+	cp.returned = z.returned
+	cp.dictID = z.dictID
+	cp.corrupt = z.corrupt
+	cp.sniffed, cp.plain = z.sniffed, z.plain
+	cp.err = z.err
+	return cp, nil
+}
+
+// Restore returns the reader to the state captured by cp, which must have
+// been taken by this reader, and continues reading the compressed stream from
+// r. r must yield the source from cp.InputOffset() onwards; input that had
+// been buffered when the checkpoint was taken is restored from cp. Read then
+// returns the same output as it would have after the checkpoint was taken.
+func (z *reader) Restore(cp *Checkpoint, r io.Reader) error {
+	if z.closed {
+		return ErrReaderClosed
+	}
+	if cp.closed {
+		return errors.New("zlib: checkpoint is closed")
+	}
+	if cp.z != z {
+		return errors.New("zlib: checkpoint was taken by another reader")
+	}
+	C.zs_inflate_end(&z.zs[0])
+	ret := C.zs_inflate_copy(&z.zs[0], &cp.zs[0])
+	runtime.KeepAlive(cp)
+	if ret != C.Z_OK {
+		// zstream is unusable until the next successful Restore.
+		z.err = zlibReturnCodeToError(ret)
+		return z.err
+	}
+	if cp.hdr != nil {
+		C.zs_header_copy(z.hdr, cp.hdr)
+	}
+
+	z.setSource(r)
+	z.inErr = nil
+	if len(z.inBuf) < len(cp.input) {
+		z.inBuf = make([]byte, z.bufSize)
+	}
+	z.inPos, z.inEnd = 0, copy(z.inBuf, cp.input)
+	z.inEOF = cp.inEOF
+	if len(cp.stage) > 0 && z.stage == nil {
+		z.stage = make([]byte, stageBufferSize)
+	}
+	z.stagePos, z.stageEnd = 0, copy(z.stage, cp.stage)
+	z.detected = cp.detected
+	z.multistream = cp.multistream
+	z.memberEOF = cp.memberEOF
+	z.header = cp.header
+	z.headerDone = cp.headerDone
+	z.memberOut = cp.memberOut
+	z.lastSize = cp.lastSize
+	z.lastCheck = cp.lastCheck
+	z.inMember = cp.inMember
+	z.consumed = cp.consumed
+	z.produced = cp.produced
+	z.members = append(z.members[:0], cp.members...)
+	z.inRead = cp.inRead
+	z.returned = cp.returned
+	z.dictID = cp.dictID
+	z.corrupt = cp.corrupt
+	z.sniffed, z.plain = cp.sniffed, cp.plain
+	z.err = cp.err
+	return nil
+}
+
+// eofError returns the error to report once the input is exhausted: io.EOF at
+// a member boundary, io.ErrUnexpectedEOF if the input stopped inside a member.
+func (z *reader) eofError() error {
+	if z.inMember && !z.isGarbage() {
+		return io.ErrUnexpectedEOF
+	}
+	return io.EOF
+}
+
+// isGarbage reports whether the input fed to zstream since the last member
+// ended is trailing garbage to be ignored, i.e. it hasn't formed a header.
+func (z *reader) isGarbage() bool {
+	return z.ignoreGarbage && len(z.members) > 0 && !z.headerDone
+}
+
+// Format returns the format of the stream. For FormatAuto readers, it is the
+// format detected from the header of the current member, or FormatAuto until
+// that header has been parsed.
+func (z *reader) Format() Format {
+	if z.format == FormatAuto {
+		return z.detected
+	}
+	return z.format
+}
+
+// UncompressedSize returns the decoded size of the last gzip member whose
+// trailer has been read and verified. The size is not truncated to 32 bits
+// like the ISIZE field. In multistream mode it is the size of the final
+// member once Read has returned io.EOF.
+func (z *reader) UncompressedSize() int64 {
+	return z.lastSize
+}
+
+// inflateError converts an error code returned by zs_inflate to an error.
+// zlib itself verifies the gzip trailer; only its message tells which check
+// failed.
+func inflateError(zs *zstream, ret C.int) error {
+	if ret == C.Z_DATA_ERROR {
+		switch C.GoString(C.zs_get_msg(&zs[0])) {
+		case "incorrect header check", "unknown compression method", "unknown header flags set":
+			return ErrHeader
+		case "header crc mismatch":
+			return ErrHeaderChecksum
+		case "incorrect data check":
+			return ErrChecksum
+		case "incorrect length check":
+			return ErrSize
+		}
+	}
+	return zstreamError(zs, ret)
+}
+
+// SetDictionary sets the preset dictionary, like ReaderOptions.Dictionary. If
+// Read has failed with ErrDictionaryRequired, the dictionary is installed
+// right away and Read continues decoding the stream.
+func (z *reader) SetDictionary(dict []byte) error {
+	if z.closed {
+		return ErrReaderClosed
+	}
+	z.dict = nil
+	if len(dict) > 0 {
+		z.dict = dict
+	}
+	if z.dict == nil || (z.err != ErrDictionaryRequired && z.format != FormatRaw) {
+		return nil
+	}
+	if ret := z.setDictionary(); ret != C.Z_OK {
+		return zlibReturnCodeToError(ret)
+	}
+	if z.err == ErrDictionaryRequired {
+		z.err = nil
+	}
+	return nil
+}
+
+// DictID returns the ID, i.e. the Adler-32 checksum, of the preset dictionary
+// that the stream asked for, or 0 if it hasn't asked for one. It is valid once
+// Read has returned ErrDictionaryRequired, so that the caller can pick the
+// dictionary to pass to SetDictionary.
+func (z *reader) DictID() uint32 {
+	return z.dictID
+}
+
+// setDictionary installs z.dict in zstream.
+func (z *reader) setDictionary() C.int {
+	ret := C.zs_inflate_set_dictionary(&z.zs[0], unsafe.Pointer(&z.dict[0]), C.int(len(z.dict)))
+	runtime.KeepAlive(z.dict)
+	return ret
+}
+
+// resetMember prepares zstream for decoding the next member.
+func (z *reader) resetMember() C.int {
+	ret := C.zs_inflate_reset(&z.zs[0])
+	if ret != C.Z_OK {
+		return ret
+	}
+	z.headerDone = false
+	if z.format == FormatRaw && z.dict != nil {
+		return z.setDictionary()
+	}
+	if z.hdr == nil {
+		return C.Z_OK
+	}
+	// inflateReset forgets the gz_header, so it has to be installed again.
+	return C.zs_inflate_get_header(&z.zs[0], z.hdr)
+}
+
+// readHeader fills z.header once inflate has finished parsing the header of
+// the current member. ret is the result of the last zs_inflate call.
+func (z *reader) readHeader(ret C.int) {
+	h := &z.hdr.head
+	if h.done == 0 {
+		return
+	}
+	if h.done < 0 {
+		// Not a gzip header. Unless inflate rejected it, FormatAuto found a
+		// zlib header.
+		if ret != C.Z_OK && ret != C.Z_STREAM_END && ret != C.Z_NEED_DICT {
+			return
+		}
+		z.headerDone = true
+		z.header = Header{}
+		z.detected = FormatZlib
+		return
+	}
+	z.headerDone = true
+	z.detected = FormatGzip
+	z.header = Header{OS: byte(h.os), Text: h.text != 0, HeaderCRC: h.hcrc != 0}
+	if h.extra != nil {
+		n := h.extra_len
+		if n > h.extra_max {
+			n = h.extra_max
+		}
+		z.header.Extra = C.GoBytes(unsafe.Pointer(h.extra), C.int(n))
+	}
+	if h.time > 0 {
+		z.header.ModTime = time.Unix(int64(h.time), 0)
+	}
+	if h.name != nil {
+		z.header.Name = cLatin1String(h.name, C.ZS_NAME_MAX)
+	}
+	if h.comment != nil {
+		z.header.Comment = cLatin1String(h.comment, C.ZS_COMMENT_MAX)
+	}
+}
+
+// cLatin1String converts a NUL-terminated ISO 8859-1 string of at most max
+// bytes to UTF-8, the same way gzip.Reader decodes header strings.
+func cLatin1String(p *C.Bytef, max C.size_t) string {
+	n := C.strnlen((*C.char)(unsafe.Pointer(p)), max)
+	b := C.GoBytes(unsafe.Pointer(p), C.int(n))
+	for _, c := range b {
+		if c >= 0x80 {
+			s := make([]rune, len(b))
+			for i, c := range b {
+				s[i] = rune(c)
+			}
+			return string(s)
+		}
+	}
+	return string(b)
+}
+
+// Header returns the gzip header of the member being decoded. It is populated
+// by Read once the header has been parsed, and is the zero Header before that.
+func (z *reader) Header() Header {
+	return z.header
+}
+
+// Multistream controls whether the reader supports multistream files, similar
+// to gzip.Reader.Multistream. Multistream mode is enabled by default.
+//
+// If disabled, Read returns io.EOF at the end of each gzip member. Compressed
+// bytes of the following member that were already buffered are kept. Calling
+// Multistream again, with either value, after such an io.EOF lets Read
+// continue with the next member.
+func (z *reader) Multistream(ok bool) {
+	z.multistream = ok
+	if z.memberEOF {
+		z.memberEOF = false
+		z.err = nil
+	}
+}
+
+// NextMember advances to the next gzip member when multistream mode is
+// disabled, as an alternative to calling Multistream after each io.EOF. The
+// rest of the current member, if it hasn't been read to io.EOF, is decoded and
+// thrown away. NextMember then parses the header of the next member, so that
+// Header describes it, and reports whether there is one; it returns false and
+// no error at the end of the stream. In multistream mode the members form a
+// single stream, so NextMember skips to its end and returns false.
+func (z *reader) NextMember() (bool, error) {
+	if z.closed {
+		return false, ErrReaderClosed
+	}
+	z.returned += int64(z.stageEnd - z.stagePos)
+	z.stagePos = z.stageEnd
+	if !z.memberEOF && z.err == nil && z.outBuf == nil {
+		z.outBuf = make([]byte, outBufferSize)
+	}
+	for !z.memberEOF && z.err == nil {
+		n, _ := z.read(z.outBuf)
+		z.returned += int64(n)
+	}
+	if !z.memberEOF {
+		if z.err == io.EOF {
+			return false, nil
+		}
+		return false, z.err
+	}
+	z.memberEOF = false
+	z.err = nil
+
+	// Decode the start of the member into stage, which Read returns first.
+	if z.stage == nil {
+		z.stage = make([]byte, stageBufferSize)
+	}
+	n, err := z.read(z.stage)
+	z.stagePos, z.stageEnd = 0, n
+	switch {
+	case n > 0 || z.memberEOF:
+		// The member may be empty; it still has a header.
+		return true, nil
+	case err == io.EOF:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// Drain decodes the rest of the current member into a buffer owned by the
+// reader and throws it away, verifying the trailer as Read would. It returns
+// the decoded size of the whole member and the checksum that matched its
+// trailer: the CRC-32 of a gzip member, the Adler-32 of a zlib stream, and 0
+// for raw streams or with SkipChecksum. Drain stops at the end of the member
+// even in multistream mode; Read then continues with the next member. If the
+// member has already been read to its end, Drain only reports it. For plain
+// input in passthrough mode, the rest of the input is skipped and size is
+// the size of the whole input.
+func (z *reader) Drain() (size int64, crc uint32, err error) {
+	if z.closed {
+		return 0, 0, ErrReaderClosed
+	}
+	z.returned += int64(z.stageEnd - z.stagePos)
+	z.stagePos = z.stageEnd
+	if z.err != nil {
+		return z.drained()
+	}
+	if z.outBuf == nil {
+		z.outBuf = make([]byte, outBufferSize)
+	}
+	multistream := z.multistream
+	z.multistream = false
+	for z.err == nil {
+		n, _ := z.read(z.outBuf)
+		z.returned += int64(n)
+	}
+	z.multistream = multistream
+	return z.drained()
+}
+
+// drained returns the result of Drain once the reader stopped at the end of
+// a member, or with an error.
+func (z *reader) drained() (int64, uint32, error) {
+	if z.err != io.EOF {
+		return 0, 0, z.err
+	}
+	if z.plain {
+		return z.produced, 0, nil
+	}
+	if z.memberEOF && z.multistream {
+		z.memberEOF = false
+		z.err = nil
+	}
+	return z.lastSize, z.lastCheck, nil
+}
+
+type Writer interface {
+	Close() error
+	Flush() error
+	Write([]byte) (int, error)
+	Reset(io.Writer) error
+	SetHeader(h Header) error
+	SetParams(level int, strategy Strategy) error
+	FullFlush() error
+	FlushMode(mode FlushMode) error
+	Pending() (bytes int, bits int)
+	Bound(n int) int
+	InputBytes() int64
+	OutputBytes() int64
+	Ratio() float64
+	Checksum() uint32
+	ReadFrom(r io.Reader) (int64, error)
+	WriteString(s string) (int, error)
+	NewMember() error
+	Tune(goodLength, maxLazy, niceLength, maxChain int) error
+	Checkpoint() (*WriterCheckpoint, error)
+	Restore(cp *WriterCheckpoint, w io.Writer) error
+	Abort() error
+}
+
+type writer struct {
+	out        io.Writer
 	zs         zstream // underlying zlib implementation.
-	inBuf      []byte
-	err        error
+	format     Format  // FormatGzip, FormatZlib or FormatRaw.
+	level      int
+	strategy   Strategy
+	windowBits int
+	memLevel   int
+	outBuf     []byte
+	poolBuf    bool                     // see WriterOptions.PoolBuffer.
+	pooled     *[defaultBufferSize]byte // backs outBuf if it came from outBufPool.
+	inBuf      []byte                   // input buffer of ReadFrom, allocated on first use.
+	// inLen and outLen are the in/out arguments of zs_deflate. Locals would
+	// escape to the heap on every call.
+	inLen, outLen C.int
+	// head is the header installed by SetHeader, in C memory because zlib
+	// keeps a pointer to it; nil for the default header.
+	head          *C.gz_header
+	deterministic bool  // true if the header only depends on the level.
+	closeOut      bool  // see WriterOptions.CloseUnderlying.
+	autoFlush     bool  // see WriterOptions.AutoFlush.
+	noFinalizer   bool  // see WriterOptions.NoFinalizer.
+	splitSize     int64 // see WriterOptions.SplitSize; 0 if the output isn't split.
+	nextWriter    func() (io.Writer, error)
+	progress      func(Progress) error // see WriterOptions.Progress; nil if none.
+	dict          []byte               // preset dictionary; nil if none.
+	tune          *tuning              // parameters set by Tune; nil for those of the level.
+	pushed        int64                // bytes of the stream written to out.
+	memberStart   int64                // value of pushed at the start of the current member.
+	outStart      int64                // value of pushed when out became the underlying writer.
+	consumed      int64                // bytes of input accepted by Write.
+	// memberConsumed is the value of consumed at the start of the current
+	// member, and memberSum the checksum of the data before it.
+	memberConsumed int64
+	memberSum      uint32
+	started        bool  // true once deflate has been called, and has begun the header.
+	closed         bool  // true once Close has freed zs.
+	err            error // first error, returned by every later call until Reset.
+}
+
+// WriterOptions configures a writer created by NewWriterOpts. The zero value
+// yields the same writer as NewWriter: a gzip stream at the default level,
+// with a 512KB output buffer.
+type WriterOptions struct {
+	// Format is the format of the output: FormatGzip, the default,
+	// FormatZlib or FormatRaw. SetHeader only works for FormatGzip.
+	Format Format
+	// Level is the compression level, from BestSpeed (1) to BestCompression
+	// (9). Zero and DefaultCompression select the default level, 6.
+	// HuffmanOnly selects StrategyHuffmanOnly. Use Store for no compression.
+	Level int
+	// Store writes the data in stored deflate blocks, without compressing
+	// it, i.e. compression level 0. Level must be zero then.
+	Store bool
+	// Strategy tunes the compression for the kind of data.
+	Strategy Strategy
+	// WindowBits is the base two logarithm of the window size, 9 to 15. It
+	// defaults to 15. Smaller windows take less memory, see DeflateMemory,
+	// and usually compress less.
+	WindowBits int
+	// MemLevel sizes the other tables of deflate, from 1 to 9. It defaults
+	// to 8. Like WindowBits, it trades memory for compression.
+	MemLevel int
+	// BufferSize is the size of the output buffer. It defaults to 512KB.
+	BufferSize int
+	// Buffer, if non-nil, is used as the output buffer instead of allocating
+	// one, and BufferSize is ignored. The writer owns it from its creation or
+	// Reset until Close returns; the caller must not touch it in between. The
+	// writer keeps it across Reset, and never grows or frees it.
+	Buffer []byte
+	// PoolBuffer takes the output buffer from a pool shared by all writers,
+	// and returns it there on Close, so that closed writers use no buffer and
+	// busy programs recycle them. Reset after Close takes a buffer again. It
+	// requires the default BufferSize, and no Buffer.
+	PoolBuffer bool
+	// Deterministic makes the output only depend on the input and the
+	// compression settings, whichever zlib build it runs on: the gzip header
+	// has no modification time, name or comment, and fixed XFL and OS bytes,
+	// 0 and 255 (unknown). SetHeader fails then. It requires FormatGzip.
+	Deterministic bool
+	// Dictionary is a preset dictionary: data that the input is likely to
+	// share strings with, such as boilerplate of small messages. The reader
+	// must set the same dictionary. It is installed at the start of every
+	// stream, including after Reset. zlib streams record its Adler-32, see
+	// Reader.DictID. gzip has no way to record a dictionary, so it requires
+	// FormatZlib or FormatRaw. The writer doesn't modify it, and the caller
+	// must not modify it either.
+	Dictionary []byte
+	// CloseUnderlying makes Close also close the underlying writer if it
+	// implements io.Closer, after the end of the stream has been written to
+	// it, or writing it has failed. Close returns the error of closing it
+	// unless writing the stream had failed. Reset doesn't close the writer it
+	// replaces.
+	CloseUnderlying bool
+	// AutoFlush ends every Write, WriteString and chunk read by ReadFrom
+	// with a sync flush, in the same zlib call, so that a reader can decode
+	// each write as soon as it arrives, as for server-sent events. Small
+	// writes pay the cost of FlushSync each: on text, the output grows by
+	// about 40% with 100-byte writes, 13% with 1KB writes and 1% with 16KB
+	// writes. Close still ends the stream as usual.
+	AutoFlush bool
+	// NoFinalizer skips the finalizer that frees the zlib state of a writer
+	// that is garbage collected without Close. Finalizers cost time when the
+	// writer is created and closed, and keep it in memory for an extra GC
+	// cycle, which writers whose lifetime is managed, e.g. by a pool, don't
+	// need. Close or Abort is mandatory then: the C memory of a writer
+	// dropped without them, about DeflateMemory bytes, leaks.
+	NoFinalizer bool
+	// SplitSize, if positive, splits the output into objects of about
+	// SplitSize compressed bytes, each a complete stream, e.g. a valid gzip
+	// file, for stores that favor objects of a given size. Once the output
+	// written to the current underlying writer reaches SplitSize, the next
+	// Write ends the stream there and continues with a new stream in the
+	// writer returned by NextWriter. The size is checked every 64KB of input,
+	// so an object exceeds SplitSize by the output of up to 64KB of input,
+	// plus what zlib held back and the end of the stream. Flush writes to the
+	// current object and never splits. Close ends the stream in the current
+	// object, so no object is empty. With CloseUnderlying, each writer is
+	// closed when its object is complete. OutputBytes counts the output of
+	// all the objects. Reset makes its argument the first writer of a new
+	// sequence of objects.
+	SplitSize int64
+	// NextWriter returns the underlying writer of the next object of
+	// SplitSize. Its error fails the Write that called it, and the writer,
+	// as an error of the underlying writer would. It is required with
+	// SplitSize.
+	NextWriter func() (io.Writer, error)
+	// Progress, if non-nil, is called with the counters of the writer at the
+	// end of every successful Write, WriteString, flush and Close, and after
+	// every chunk read by ReadFrom, on the goroutine of the call, so calls
+	// never overlap. Close calls it once the stream has ended. Its error
+	// fails the writer: the call returns it, as do the later ones, and Close
+	// frees the writer without ending the stream, like Abort, unless the
+	// error came from Close itself.
+	Progress func(Progress) error
+}
+
+// NewWriter creates a gzip writer with default settings.
+func NewWriter(w io.Writer) (Writer, error) {
+	return NewWriterOpts(w, WriterOptions{})
+}
+
+// NewWriterLevel creates a gzip writer. Level is the compression level, from
+// BestSpeed (1) to BestCompression (9), or DefaultCompression (-1),
+// NoCompression (0) or HuffmanOnly (-2), like in compress/gzip. Other values
+// are rejected with a descriptive error before any zlib state is allocated.
+// bufSize is the size of the output buffer; zero selects 512KB.
+func NewWriterLevel(w io.Writer, level int, bufSize int) (Writer, error) {
+	return NewWriterOpts(w, levelOptions(level, bufSize))
+}
+
+// levelOptions returns the options for the level and bufSize arguments of the
+// NewWriter functions, where level 0 means no compression like in zlib.
+func levelOptions(level int, bufSize int) WriterOptions {
+	if level == 0 {
+		return WriterOptions{Store: true, BufferSize: bufSize}
+	}
+	return WriterOptions{Level: level, BufferSize: bufSize}
+}
+
+// NewWriterWithBuffer creates a gzip writer that uses buf as its output buffer
+// instead of allocating one. See WriterOptions.Buffer.
+func NewWriterWithBuffer(w io.Writer, level int, buf []byte) (Writer, error) {
+	if len(buf) == 0 {
+		return nil, errors.New("zlib: empty buffer")
+	}
+	opts := levelOptions(level, 0)
+	opts.Buffer = buf
+	return NewWriterOpts(w, opts)
+}
+
+// NewWriterAppend creates a gzip writer that adds a member at the end of the
+// gzip file f, as RFC 1952 allows. It first checks with CheckMembers that the
+// content of f, from its start, is a sequence of complete members, so that the
+// result is a valid file, then writes from the end of f. Close doesn't close
+// f. Checking reads the whole file; if the caller knows the file to be
+// complete, a writer created by NewWriter on it, opened with os.O_APPEND or
+// positioned at its end, appends the same member without reading anything.
+func NewWriterAppend(f io.ReadWriteSeeker, level int, bufSize int) (Writer, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := CheckMembers(f); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		return nil, err
+	}
+	return NewWriterLevel(f, level, bufSize)
+}
+
+// CheckMembers decodes the gzip members read from r until EOF, and returns
+// their number. It fails if a member is corrupt or truncated, such as the last
+// one of a file whose writer didn't finish, or if garbage follows them. Empty
+// input has no members and is valid.
+func CheckMembers(r io.Reader) (int, error) {
+	zr, err := NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+	zr.Multistream(false)
+	for {
+		if _, _, err := zr.Drain(); err != nil {
+			return zr.MemberCount(), err
+		}
+		more, err := zr.NextMember()
+		if err != nil || !more {
+			return zr.MemberCount(), err
+		}
+	}
+}
+
+// NewWriterDict creates a writer of a zlib stream compressed with the preset
+// dictionary dict, see WriterOptions.Dictionary. NewReaderDict decodes it.
+func NewWriterDict(w io.Writer, level int, bufSize int, dict []byte) (Writer, error) {
+	opts := levelOptions(level, bufSize)
+	opts.Format = FormatZlib
+	opts.Dictionary = dict
+	return NewWriterOpts(w, opts)
+}
+
+// NewWriterDeterministic creates a gzip writer with reproducible output, see
+// WriterOptions.Deterministic.
+func NewWriterDeterministic(w io.Writer, level int, bufSize int) (Writer, error) {
+	opts := levelOptions(level, bufSize)
+	opts.Deterministic = true
+	return NewWriterOpts(w, opts)
+}
+
+// NewWriterRaw creates a writer of a raw deflate stream, without any header or
+// trailer, such as the contents of a zip archive entry. It can be registered
+// as the zip.Deflate compressor of a zip.Writer, since Writer is an
+// io.WriteCloser. SetHeader fails on such a writer.
+func NewWriterRaw(w io.Writer, level int, bufSize int) (Writer, error) {
+	opts := levelOptions(level, bufSize)
+	opts.Format = FormatRaw
+	return NewWriterOpts(w, opts)
+}
+
+// NewWriterZlib creates a writer of a zlib stream, which Close ends with the
+// Adler-32 trailer. SetHeader fails on such a writer.
+func NewWriterZlib(w io.Writer, level int, bufSize int) (Writer, error) {
+	opts := levelOptions(level, bufSize)
+	opts.Format = FormatZlib
+	return NewWriterOpts(w, opts)
+}
+
+// NewWriterStrategy creates a gzip writer that compresses with the given
+// strategy. See NewWriterLevel for the other arguments.
+func NewWriterStrategy(w io.Writer, level int, strategy Strategy, bufSize int) (Writer, error) {
+	opts := levelOptions(level, bufSize)
+	opts.Strategy = strategy
+	return NewWriterOpts(w, opts)
+}
+
+// NewWriterWindow creates a gzip writer with a window of 1<<windowBits bytes,
+// for windowBits from 9 to 15, and the given memLevel, from 1 to 9, which
+// sizes the other tables of deflate. Smaller values take less memory, see
+// DeflateMemory, and usually compress less. Zero selects the defaults, 15
+// and 8. See NewWriterLevel for the other arguments.
+func NewWriterWindow(w io.Writer, level, windowBits, memLevel, bufSize int) (Writer, error) {
+	opts := levelOptions(level, bufSize)
+	opts.WindowBits = windowBits
+	opts.MemLevel = memLevel
+	return NewWriterOpts(w, opts)
+}
+
+// defaultMemLevel is the memLevel of deflateInit.
+const defaultMemLevel = 8
+
+// DeflateMemory returns the approximate size in bytes of the zlib state of a
+// writer created with windowBits and memLevel, as documented in zlib.h. It
+// doesn't include the output buffer. Zero selects the defaults, like in
+// WriterOptions.
+func DeflateMemory(windowBits, memLevel int) int {
+	if windowBits == 0 {
+		windowBits = maxWindowBits
+	}
+	if memLevel == 0 {
+		memLevel = defaultMemLevel
+	}
+	// deflate_state itself takes about 6KB.
+	return 1<<uint(windowBits+2) + 1<<uint(memLevel+9) + 6<<10
+}
+
+// CRC32Combine returns the CRC-32 of the concatenation of two inputs from
+// their CRC-32s and the length of the second one, which must not be negative,
+// without touching the data, like crc32_combine in zlib.h. It takes time
+// logarithmic in len2.
+func CRC32Combine(crc1, crc2 uint32, len2 int64) uint32 {
+	return uint32(C.zs_crc32_combine(C.ulong(crc1), C.ulong(crc2), C.longlong(len2)))
+}
+
+// Adler32Combine is like CRC32Combine for Adler-32 checksums, with
+// adler32_combine.
+func Adler32Combine(adler1, adler2 uint32, len2 int64) uint32 {
+	return uint32(C.zs_adler32_combine(C.ulong(adler1), C.ulong(adler2), C.longlong(len2)))
+}
+
+// CompressBound returns the largest size of a zlib stream of n bytes of input
+// written with the default window and memory level, as computed by
+// compressBound in zlib.h. A gzip stream is 12 bytes larger, plus the size of
+// the fields set by SetHeader, and a raw stream 6 bytes smaller. Writer.Bound
+// accounts for the settings of a writer.
+func CompressBound(n int) int {
+	return int(C.compressBound(C.uLong(n)))
+}
+
+// NewWriterOpts creates a writer configured by opts. It reports all the
+// invalid options at once.
+func NewWriterOpts(w io.Writer, opts WriterOptions) (Writer, error) {
+	var invalid []string
+	switch opts.Format {
+	case FormatGzip, FormatZlib, FormatRaw:
+	default:
+		invalid = append(invalid, fmt.Sprintf("invalid format %d", opts.Format))
+	}
+	level := opts.Level
+	switch {
+	case opts.Store && level != 0:
+		invalid = append(invalid, fmt.Sprintf("level %d with Store", level))
+	case opts.Store:
+	case level == 0:
+		level = DefaultCompression
+	case level == HuffmanOnly:
+		var err error
+		if level, opts.Strategy, err = huffmanOnly(opts.Strategy); err != nil {
+			invalid = append(invalid, err.Error())
+		}
+	case level < HuffmanOnly || level > BestCompression:
+		invalid = append(invalid, fmt.Sprintf("invalid level %d", level))
+	}
+	if opts.Strategy < StrategyDefault || opts.Strategy > StrategyFixed {
+		invalid = append(invalid, fmt.Sprintf("invalid strategy %d", opts.Strategy))
+	}
+	if opts.WindowBits == 0 {
+		opts.WindowBits = maxWindowBits
+	}
+	if opts.WindowBits < 9 || opts.WindowBits > maxWindowBits {
+		invalid = append(invalid, fmt.Sprintf("invalid window bits %d", opts.WindowBits))
+	}
+	if opts.MemLevel == 0 {
+		opts.MemLevel = defaultMemLevel
+	}
+	if opts.MemLevel < 1 || opts.MemLevel > 9 {
+		invalid = append(invalid, fmt.Sprintf("invalid mem level %d", opts.MemLevel))
+	}
+	if opts.Buffer != nil {
+		opts.BufferSize = len(opts.Buffer)
+		if opts.BufferSize == 0 {
+			invalid = append(invalid, "empty buffer")
+		}
+	}
+	if opts.PoolBuffer && opts.Buffer != nil {
+		invalid = append(invalid, "PoolBuffer with Buffer")
+	} else if opts.PoolBuffer && opts.BufferSize != 0 && opts.BufferSize != defaultBufferSize {
+		invalid = append(invalid, fmt.Sprintf("PoolBuffer with buffer size %d", opts.BufferSize))
+	}
+	if opts.BufferSize == 0 {
+		opts.BufferSize = defaultBufferSize
+	}
+	if opts.BufferSize < 0 {
+		invalid = append(invalid, fmt.Sprintf("invalid buffer size %d", opts.BufferSize))
+	}
+	if opts.Deterministic && opts.Format != FormatGzip {
+		invalid = append(invalid, "Deterministic without FormatGzip")
+	}
+	if len(opts.Dictionary) > 0 && opts.Format == FormatGzip {
+		invalid = append(invalid, "Dictionary with FormatGzip")
+	}
+	if opts.SplitSize < 0 {
+		invalid = append(invalid, fmt.Sprintf("invalid split size %d", opts.SplitSize))
+	} else if opts.SplitSize > 0 && opts.NextWriter == nil {
+		invalid = append(invalid, "SplitSize without NextWriter")
+	} else if opts.SplitSize == 0 && opts.NextWriter != nil {
+		invalid = append(invalid, "NextWriter without SplitSize")
+	}
+	if len(invalid) > 0 {
+		return nil, errors.New("zlib: " + strings.Join(invalid, ", "))
+	}
+	z := &writer{
+		out:           w,
+		format:        opts.Format,
+		level:         level,
+		strategy:      opts.Strategy,
+		windowBits:    opts.WindowBits,
+		memLevel:      opts.MemLevel,
+		deterministic: opts.Deterministic,
+		outBuf:        opts.Buffer,
+		poolBuf:       opts.PoolBuffer,
+		closeOut:      opts.CloseUnderlying,
+		autoFlush:     opts.AutoFlush,
+		noFinalizer:   opts.NoFinalizer,
+		splitSize:     opts.SplitSize,
+		nextWriter:    opts.NextWriter,
+		progress:      opts.Progress,
+	}
+	if z.outBuf == nil && !z.poolBuf {
+		z.outBuf = make([]byte, opts.BufferSize)
+	}
+	if len(opts.Dictionary) > 0 {
+		z.dict = opts.Dictionary
+	}
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// init allocates zs for a new stream.
+func (z *writer) init() error {
+	ec := C.zs_deflate_init(&z.zs[0], C.int(z.level), C.int(z.format.windowBits(z.windowBits)), C.int(z.memLevel), C.int(z.strategy))
+	if ec != 0 {
+		return zlibReturnCodeToError(ec)
+	}
+	z.closed = false
+	if z.poolBuf {
+		z.pooled = outBufPool.Get().(*[defaultBufferSize]byte)
+		z.outBuf = z.pooled[:]
+	}
+	if !z.noFinalizer {
+		runtime.SetFinalizer(z, gcWriter)
+	}
+	return z.startStream()
+}
+
+// startStream installs the settings of z that deflateReset drops.
+func (z *writer) startStream() error {
+	if err := z.resetHeader(); err != nil {
+		return err
+	}
+	if z.dict != nil {
+		ret := C.zs_deflate_set_dictionary(&z.zs[0], unsafe.Pointer(&z.dict[0]), C.int(len(z.dict)))
+		runtime.KeepAlive(z.dict)
+		if ret != C.Z_OK {
+			return zlibReturnCodeToError(ret)
+		}
+	}
+	if z.tune != nil {
+		return z.tune.apply(&z.zs)
+	}
+	return nil
+}
+
+func gcWriter(z *writer) {
+	C.zs_deflate_end(&z.zs[0])
+	z.freeHeader()
+}
+
+// freeHeader frees the header installed by SetHeader. zs must not point to it
+// any more.
+func (z *writer) freeHeader() {
+	if z.head != nil {
+		C.zs_gz_header_free(z.head)
+		z.head = nil
+	}
+}
+
+// resetHeader installs the default header of z in zs.
+func (z *writer) resetHeader() error {
+	if z.head != nil {
+		C.zs_deflate_set_header(&z.zs[0], nil)
+		z.freeHeader()
+	}
+	if z.deterministic {
+		return z.setHeader(Header{OS: unknownOS})
+	}
+	return nil
+}
+
+// unknownOS is the OS byte of a gzip header for an unknown operating system.
+const unknownOS = 255
+
+// SetHeader sets the gzip header fields Name, Comment, ModTime, Extra, OS and
+// Text, like the Header of gzip.Writer. HeaderCRC adds the CRC16 of the header
+// in the FHCRC field, which some old decoders require and others reject, so it
+// is off by default. It must be called before the first Write, Flush or Close,
+// and after Reset, which restores the default header. Name and Comment must be
+// representable in Latin-1, and are converted to it. ModTime is written if it
+// is after the Unix epoch, truncated to 32 bits.
+func (z *writer) SetHeader(h Header) error {
+	if z.closed {
+		return ErrWriterClosed
+	}
+	if z.started {
+		return errors.New("zlib: SetHeader after Write")
+	}
+	if z.format != FormatGzip {
+		return errors.New("zlib: SetHeader on a writer of a stream without a gzip header")
+	}
+	if z.deterministic {
+		return errors.New("zlib: SetHeader on a deterministic writer")
+	}
+	return z.setHeader(h)
+}
+
+// setHeader installs h in zs.
+func (z *writer) setHeader(h Header) error {
+	name, nameOK := latin1(h.Name)
+	comment, commentOK := latin1(h.Comment)
+	if !nameOK || !commentOK {
+		return errors.New("zlib: non-Latin-1 header string")
+	}
+	if len(h.Extra) > 0xffff {
+		return errors.New("zlib: extra data is too large")
+	}
+	head := C.zs_gz_header_new()
+	if head == nil {
+		return zlibErrors[C.Z_MEM_ERROR]
+	}
+	head.text = 0
+	if h.Text {
+		head.text = 1
+	}
+	if h.ModTime.After(time.Unix(0, 0)) {
+		head.time = C.uLong(uint32(h.ModTime.Unix()))
+	}
+	head.os = C.int(h.OS)
+	if h.HeaderCRC {
+		head.hcrc = 1
+	}
+	if h.Extra != nil {
+		head.extra = (*C.Bytef)(C.CBytes(append(h.Extra[:len(h.Extra):len(h.Extra)], 0)))
+		head.extra_len = C.uInt(len(h.Extra))
+	}
+	if h.Name != "" {
+		head.name = (*C.Bytef)(C.CBytes(append(name, 0)))
+	}
+	if h.Comment != "" {
+		head.comment = (*C.Bytef)(C.CBytes(append(comment, 0)))
+	}
+	if ret := C.zs_deflate_set_header(&z.zs[0], head); ret != C.Z_OK {
+		C.zs_gz_header_free(head)
+		return zlibReturnCodeToError(ret)
+	}
+	z.freeHeader()
+	z.head = head
+	return nil
+}
+
+// latin1 converts s to ISO 8859-1 like gzip.Writer, which rejects NUL and
+// runes beyond 0xff.
+func latin1(s string) ([]byte, bool) {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r == 0 || r > 0xff {
+			return nil, false
+		}
+		b = append(b, byte(r))
+	}
+	return b, true
+}
+
+func (z *writer) push(data []byte) error {
+	// xflOffset is the offset of the XFL byte, which zlib derives from the
+	// level.
+	const xflOffset = 8
+	offset := z.pushed - z.memberStart
+	if z.deterministic && offset <= xflOffset && offset+int64(len(data)) > xflOffset {
+		data[xflOffset-offset] = 0
+	}
+	n, err := writeFull(z.out, data)
+	z.pushed += int64(n)
+	return err
+}
+
+// writeFull writes data to w. Writers may write less than asked without an
+// error, so it retries the rest, and fails with io.ErrShortWrite after
+// maxConsecutiveEmptyWrites writes in a row that make no progress.
+func writeFull(w io.Writer, data []byte) (int, error) {
+	total, empty := 0, 0
+	for len(data) > 0 {
+		n, err := w.Write(data)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			empty++
+			if empty >= maxConsecutiveEmptyWrites {
+				return total, io.ErrShortWrite
+			}
+		} else {
+			empty = 0
+		}
+		data = data[n:]
+	}
+	return total, nil
+}
+
+// Close implements io.Closer. It writes the rest of the stream and frees the
+// zlib state right away, without waiting for the finalizer. With
+// WriterOptions.CloseUnderlying, it then closes the underlying writer. Closing
+// again returns the same result without doing anything. Reset makes the writer
+// usable again.
+func (z *writer) Close() error {
+	if z.closed {
+		return z.err
+	}
+	if z.err == nil {
+		z.err = z.finish()
+		runtime.KeepAlive(z)
+	}
+	if z.err == nil {
+		z.err = z.report()
+	}
+	z.end()
+	if c, ok := z.out.(io.Closer); ok && z.closeOut {
+		if err := c.Close(); z.err == nil {
+			z.err = err
+		}
+	}
+	return z.err
+}
+
+// Abort discards the stream without writing anything more to the underlying
+// writer, not even the output that zlib holds or the trailer, and frees the
+// zlib state like Close, e.g. once the client of a response has gone away.
+// With WriterOptions.CloseUnderlying, it closes the underlying writer, and
+// returns the error of closing it. Later calls behave as after Close, and
+// Close returns the error of the call that failed before Abort, if any.
+// Reset makes the writer usable again.
+func (z *writer) Abort() error {
+	if z.closed {
+		return nil
+	}
+	z.end()
+	if c, ok := z.out.(io.Closer); ok && z.closeOut {
+		return c.Close()
+	}
+	return nil
+}
+
+// end frees zs.
+func (z *writer) end() {
+	z.closed = true
+	C.zs_deflate_end(&z.zs[0])
+	z.freeHeader()
+	if !z.noFinalizer {
+		runtime.SetFinalizer(z, nil)
+	}
+	// The closed writer never touches outBuf again.
+	if z.pooled != nil {
+		outBufPool.Put(z.pooled)
+		z.pooled = nil
+		z.outBuf = nil
+	}
+}
+
+// finish writes the rest of the stream and the trailer.
+func (z *writer) finish() error {
+	z.started = true
+	for {
+		outLen := C.int(len(z.outBuf))
+		ret := C.zs_deflate_finish(&z.zs[0], unsafe.Pointer(&z.outBuf[0]), &outLen)
+		if ret != 0 && ret != C.Z_STREAM_END {
+			return zstreamError(&z.zs, ret)
+		}
+		nOut := len(z.outBuf) - int(outLen)
+		if err := z.push(z.outBuf[:nOut]); err != nil {
+			return err
+		}
+		if ret == C.Z_STREAM_END {
+			return nil
+		}
+	}
+}
+
+// Write implements io.Writer. If it fails, it returns the number of bytes of
+// in that zlib consumed before, though their output may not have reached the
+// underlying writer. Once Write, Flush or Close fails, every later call
+// returns the same error without writing anything, until Reset.
+func (z *writer) Write(in []byte) (int, error) {
+	if z.closed {
+		return 0, ErrWriterClosed
+	}
+	if z.err != nil {
+		return 0, z.err
+	}
+	n, err := z.write(in)
+	// Keep the finalizer from freeing zstream while a cgo call is using it.
+	runtime.KeepAlive(z)
+	if err == nil {
+		err = z.report()
+	}
+	if err != nil {
+		z.err = err
+	}
+	return n, err
+}
+
+// WriteString implements io.StringWriter. It behaves like Write, but hands the
+// bytes of s to zlib without converting s to a []byte.
+func (z *writer) WriteString(s string) (int, error) {
+	if z.closed {
+		return 0, ErrWriterClosed
+	}
+	if z.err != nil {
+		return 0, z.err
+	}
+	if len(s) == 0 {
+		return 0, nil
+	}
+	// zlib only reads the input, so passing the bytes of s is safe. It keeps
+	// a pointer to them between the calls to deflate in z.deflate, so s must
+	// stay alive until it returns.
+	n, err := z.deflate((*stringHeader)(unsafe.Pointer(&s)).data, len(s))
+	runtime.KeepAlive(s)
+	runtime.KeepAlive(z)
+	if err == nil {
+		err = z.report()
+	}
+	if err != nil {
+		z.err = err
+	}
+	return n, err
 }
 
-// defaultBufferSize is the default buffer size used by NewBuffer.
-const defaultBufferSize = 512 * 1024
+// stringHeader is the runtime representation of a string.
+type stringHeader struct {
+	data unsafe.Pointer
+	len  int
+}
 
-// NewReader creates a gzip reader with 512KB buffer.
-func NewReader(r io.Reader) (io.ReadCloser, error) {
-	return NewReaderBuffer(r, defaultBufferSize)
+func (z *writer) write(in []byte) (int, error) {
+	if len(in) == 0 {
+		return 0, nil
+	}
+	return z.deflate(unsafe.Pointer(&in[0]), len(in))
 }
 
-// NewReaderBuffer creates a new gzip reader with a given prefetch buffer size.
-func NewReaderBuffer(in io.Reader, bufSize int) (io.ReadCloser, error) {
-	z := &reader{
-		in:         in,
-		inBuf:      make([]byte, bufSize),
-		inConsumed: true, // force in.Read
+// splitChunk is the amount of input deflated at a time with
+// WriterOptions.SplitSize, between the checks of the size of the object.
+const splitChunk = 64 << 10
+
+// deflate compresses the n bytes at in, and adds the bytes it consumed to
+// z.consumed. With SplitSize, it moves to the next object when the current one
+// is full.
+func (z *writer) deflate(in unsafe.Pointer, n int) (int, error) {
+	if z.splitSize <= 0 {
+		m, err := z.deflateChunk(in, n)
+		z.consumed += int64(m)
+		return m, err
 	}
-	ec := C.zs_inflate_init(&z.zs[0])
-	if ec != 0 {
-		return nil, zlibReturnCodeToError(ec)
+	done := 0
+	for done < n {
+		if z.pushed-z.outStart >= z.splitSize {
+			if err := z.split(); err != nil {
+				return done, err
+			}
+		}
+		m := n - done
+		if m > splitChunk {
+			m = splitChunk
+		}
+		m, err := z.deflateChunk(unsafe.Pointer(uintptr(in)+uintptr(done)), m)
+		done += m
+		z.consumed += int64(m)
+		if err != nil {
+			return done, err
+		}
 	}
-	return z, nil
+	return done, nil
 }
 
-// Close implements io.Closer.
-func (z *reader) Close() error {
-	C.zs_inflate_end(&z.zs[0])
-	if z.err == io.EOF {
-		return nil
+// split ends the stream in the current object, closes its writer with
+// CloseUnderlying, and starts a new stream in the writer returned by
+// nextWriter.
+func (z *writer) split() error {
+	if err := z.newMember(); err != nil {
+		return err
 	}
-	return z.err
+	if c, ok := z.out.(io.Closer); ok && z.closeOut {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	// Close must not close the previous writer again if nextWriter fails.
+	z.out = nil
+	w, err := z.nextWriter()
+	if err != nil {
+		return err
+	}
+	z.out = w
+	z.outStart = z.pushed
+	return nil
 }
 
-// Read implements io.Reader.
-func (z *reader) Read(out []byte) (int, error) {
-	var orgOut = out
-	for z.err == nil && len(out) > 0 {
-		var (
-			outLen     = C.int(len(out))
-			ret        C.int
-			inConsumed C.int
-		)
-		if !z.inConsumed {
-			ret = C.zs_inflate(&z.zs[0], nil, 0, unsafe.Pointer(&out[0]), &outLen, &inConsumed)
-		} else {
-			if z.inEOF {
-				z.err = io.EOF
-				break
-			}
-			n, err := z.in.Read(z.inBuf)
-			if err != nil {
-				if err != io.EOF {
-					z.err = err
-					break
-				}
-				z.inEOF = true
-				// fall through
-			}
-			if n == 0 {
-				if !z.inEOF {
-					panic(z)
-				}
-				z.err = io.EOF
-				break
-			}
-			ret = C.zs_inflate(&z.zs[0], unsafe.Pointer(&z.inBuf[0]), C.int(n), unsafe.Pointer(&out[0]), &outLen, &inConsumed)
+// deflateChunk compresses the n bytes at in into the current member. On error,
+// it returns the number of bytes that zlib consumed.
+func (z *writer) deflateChunk(in unsafe.Pointer, n int) (int, error) {
+	z.started = true
+	// With AutoFlush, the same deflate calls flush the output, unless outBuf
+	// is too small for flushes, see flush.
+	flush := C.int(C.Z_NO_FLUSH)
+	if z.autoFlush && len(z.outBuf) >= minFlushBufferSize {
+		flush = C.Z_SYNC_FLUSH
+	}
+	z.inLen = C.int(n)
+	z.outLen = C.int(len(z.outBuf))
+	ret := C.zs_deflate(&z.zs[0], in, &z.inLen, unsafe.Pointer(&z.outBuf[0]), &z.outLen, flush)
+	for {
+		if ret == C.Z_BUF_ERROR {
+			// All the input has been consumed and no output is pending.
+			break
 		}
-		z.inConsumed = (inConsumed != 0)
-		if ret != C.Z_STREAM_END && ret != C.Z_OK {
-			z.err = zlibReturnCodeToError(ret)
+		if ret != 0 {
+			return n - int(z.inLen), zstreamError(&z.zs, ret)
+		}
+		nOut := len(z.outBuf) - int(z.outLen)
+		if err := z.push(z.outBuf[:nOut]); err != nil {
+			return n - int(z.inLen), err
+		}
+		if z.outLen > 0 { // outbuf didn't fillup, i.e., the input was fully consumed.
 			break
 		}
+		// Continue with the input that zlib holds.
+		z.inLen = 0
+		z.outLen = C.int(len(z.outBuf))
+		ret = C.zs_deflate(&z.zs[0], nil, &z.inLen, unsafe.Pointer(&z.outBuf[0]), &z.outLen, flush)
+	}
+	if z.autoFlush && flush == C.Z_NO_FLUSH {
+		if err := z.flush(FlushSync); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Flush writes the output for all the data written so far to the underlying
+// writer, with FlushSync.
+func (z *writer) Flush() error {
+	return z.FlushMode(FlushSync)
+}
+
+// FullFlush writes the output for all the data written so far with FlushFull,
+// creating a point where decoding can restart.
+func (z *writer) FullFlush() error {
+	return z.FlushMode(FlushFull)
+}
+
+// FlushMode writes the output for all the data written so far to the
+// underlying writer, ending it as selected by mode.
+func (z *writer) FlushMode(mode FlushMode) error {
+	if z.closed {
+		return ErrWriterClosed
+	}
+	if mode < FlushSync || mode > FlushBlock {
+		return fmt.Errorf("zlib: invalid flush mode %d", mode)
+	}
+	if z.err == nil {
+		z.err = z.flush(mode)
+		runtime.KeepAlive(z)
+	}
+	if z.err == nil {
+		z.err = z.report()
+	}
+	return z.err
+}
+
+func (z *writer) flush(mode FlushMode) error {
+	z.started = true
+	out := z.outBuf
+	for {
+		outLen := C.int(len(out))
+		ret := C.zs_deflate_flush(&z.zs[0], mode.zlibFlush(), unsafe.Pointer(&out[0]), &outLen)
+		if ret == C.Z_BUF_ERROR {
+			// no output
+			return nil
+		}
+		if ret != 0 {
+			return zstreamError(&z.zs, ret)
+		}
 		nOut := len(out) - int(outLen)
-		out = out[nOut:]
-		if ret == C.Z_STREAM_END {
-			ret = C.zs_inflate_reset(&z.zs[0])
-			if ret != C.Z_OK {
-				z.err = zlibReturnCodeToError(ret)
+		if err := z.push(out[:nOut]); err != nil {
+			return err
+		}
+		if outLen > 0 { // out didn't fill up, i.e., the flush is complete.
+			return nil
+		}
+		if len(out) < minFlushBufferSize {
+			// Called again after filling the output, deflate starts
+			// the flush over with another marker, which may never fit
+			// in a buffer this small. Finish in a larger one.
+			out = make([]byte, minFlushBufferSize)
+		}
+	}
+}
+
+// Pending returns the amount of compressed output that zlib has generated but
+// not handed to the writer yet, as whole bytes and bits of a partial byte, see
+// deflatePending in zlib.h. It doesn't count the input that zlib holds to find
+// matches, so zero doesn't mean that the output is complete for the input so
+// far; it is after a Flush, unless Write has been called since. It returns
+// zero after Close.
+func (z *writer) Pending() (bytes int, bits int) {
+	if z.closed {
+		return 0, 0
+	}
+	var cBytes C.uint
+	var cBits C.int
+	if C.zs_deflate_pending(&z.zs[0], &cBytes, &cBits) != C.Z_OK {
+		return 0, 0
+	}
+	return int(cBytes), int(cBits)
+}
+
+// Bound returns the largest size of the output of a stream of n bytes of input
+// with the settings of z, including the header and trailer, as computed by
+// deflateBound in zlib.h. Flushes add to it. It returns zero after Close.
+func (z *writer) Bound(n int) int {
+	if z.closed {
+		return 0
+	}
+	return int(C.zs_deflate_bound(&z.zs[0], C.ulong(n)))
+}
+
+// minReadFromSize is the smallest read of ReadFrom, the buffer size of
+// io.Copy.
+const minReadFromSize = 32 << 10
+
+// ReadFrom implements io.ReaderFrom, which io.Copy uses. It compresses the
+// data of r until EOF, reading it in chunks of the output buffer size, or at
+// least 32KB, straight into a buffer allocated on the first call and kept
+// across Reset. It returns the number of bytes read from r. The data read
+// before an error of r is compressed, and the writer remains usable; errors of
+// the writer are sticky, like those of Write.
+func (z *writer) ReadFrom(r io.Reader) (int64, error) {
+	if z.closed {
+		return 0, ErrWriterClosed
+	}
+	if z.err != nil {
+		return 0, z.err
+	}
+	if z.inBuf == nil {
+		size := len(z.outBuf)
+		if size < minReadFromSize {
+			size = minReadFromSize
+		}
+		z.inBuf = make([]byte, size)
+	}
+	var total int64
+	for {
+		n, err := r.Read(z.inBuf)
+		if n > 0 {
+			m, werr := z.write(z.inBuf[:n])
+			runtime.KeepAlive(z)
+			if werr == nil {
+				werr = z.report()
+			}
+			total += int64(m)
+			if werr != nil {
+				z.err = werr
+				return total, werr
 			}
-			break
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
 		}
 	}
-	return len(orgOut) - len(out), z.err
 }
 
-type Writer interface {
-	Close() error
-	Flush() error
-	Write([]byte) (int, error)
-	Reset(io.Writer) error
+// InputBytes returns the number of bytes accepted by Write and ReadFrom since
+// the writer was created or Reset. Part of them may not be compressed yet.
+func (z *writer) InputBytes() int64 {
+	return z.consumed
 }
 
-type writer struct {
-	out    io.Writer
-	zs     zstream // underlying zlib implementation.
-	outBuf []byte
-	err    error
+// OutputBytes returns the number of bytes written to the underlying writer
+// since the writer was created or Reset. It lags behind InputBytes by the data
+// that zlib holds until the next Flush or Close.
+func (z *writer) OutputBytes() int64 {
+	return z.pushed
 }
 
-// NewWriter creates a gzip writer with default settings.
-func NewWriter(w io.Writer) (Writer, error) {
-	return NewWriterLevel(w, -1, defaultBufferSize)
+// Ratio returns InputBytes divided by OutputBytes, e.g. 4 if the output is a
+// quarter of the input, or zero if there is no output yet. It is only accurate
+// after Flush or Close.
+func (z *writer) Ratio() float64 {
+	return Progress{InputBytes: z.consumed, OutputBytes: z.pushed}.Ratio()
 }
 
-// NewWriterLevel creates a gzip writer. Level is the compression level; -1
-// means the default level. bufSize is the internal buffer size. It defaults to
-// 512KB.
-func NewWriterLevel(w io.Writer, level int, bufSize int) (Writer, error) {
-	z := &writer{
-		out:    w,
-		outBuf: make([]byte, bufSize),
+// Progress is the state of a writer passed to WriterOptions.Progress.
+type Progress struct {
+	InputBytes  int64 // see Writer.InputBytes.
+	OutputBytes int64 // see Writer.OutputBytes.
+}
+
+// Ratio returns InputBytes divided by OutputBytes, or zero if there is no
+// output yet, like Writer.Ratio.
+func (p Progress) Ratio() float64 {
+	if p.OutputBytes == 0 {
+		return 0
 	}
-	ec := C.zs_deflate_init(&z.zs[0], C.int(level))
-	if ec != 0 {
-		return nil, zlibReturnCodeToError(ec)
+	return float64(p.InputBytes) / float64(p.OutputBytes)
+}
+
+// report calls the Progress callback, if any.
+func (z *writer) report() error {
+	if z.progress == nil {
+		return nil
 	}
-	runtime.SetFinalizer(z, gcWriter)
-	return z, nil
+	return z.progress(Progress{InputBytes: z.consumed, OutputBytes: z.pushed})
 }
 
-func gcWriter(z *writer) {
-	C.zs_deflate_end(&z.zs[0])
+// Checksum returns the checksum of the data accepted by Write and ReadFrom
+// since the writer was created or Reset, i.e. of InputBytes bytes, which zlib
+// computes for the trailer: the CRC-32 for FormatGzip, or the Adler-32 for
+// FormatZlib. It is up to date after every call, and remains valid after
+// Close. After NewMember, it covers all the members, not only the current
+// one. FormatRaw has no checksum, and Checksum returns 0.
+func (z *writer) Checksum() uint32 {
+	n := z.consumed - z.memberConsumed
+	switch {
+	case z.format == FormatRaw:
+		return 0
+	case n == 0:
+		// Before the header is written, zlib holds the Adler-32 of the
+		// dictionary instead.
+		if z.memberConsumed == 0 && z.format == FormatZlib {
+			return 1 // Adler-32 of no data.
+		}
+		return z.memberSum
+	case z.memberConsumed == 0:
+		return uint32(C.zs_get_adler(&z.zs[0]))
+	case z.format == FormatGzip:
+		return CRC32Combine(z.memberSum, uint32(C.zs_get_adler(&z.zs[0])), n)
+	default:
+		return Adler32Combine(z.memberSum, uint32(C.zs_get_adler(&z.zs[0])), n)
+	}
 }
 
-func (z *writer) push(data []byte) error {
-	n, err := z.out.Write(data)
-	if err != nil {
+// SetParams changes the compression level and strategy for the input written
+// from now on, with the level as in NewWriterLevel. The data written so far is
+// first compressed with the old parameters and its output flushed to the
+// underlying writer, ending the current deflate block, so calling it often
+// costs some ratio. The stream remains a single gzip member. The new
+// parameters also apply after Reset.
+func (z *writer) SetParams(level int, strategy Strategy) error {
+	if z.closed {
+		return ErrWriterClosed
+	}
+	if z.err != nil {
+		return z.err
+	}
+	if err := ValidateLevel(z.format, level); err != nil {
 		return err
 	}
-	if n < len(data) { // shouldn't happen in practice
-		return fmt.Errorf("zlib: n=%d, outLen=%d", n, len(data))
+	if level == HuffmanOnly {
+		var err error
+		if level, strategy, err = huffmanOnly(strategy); err != nil {
+			return errors.New("zlib: " + err.Error())
+		}
+	}
+	if strategy < StrategyDefault || strategy > StrategyFixed {
+		return fmt.Errorf("zlib: invalid strategy %d", strategy)
+	}
+	if err := z.setParams(level, strategy); err != nil {
+		z.err = err
+		return err
 	}
+	if level != z.level {
+		// deflateParams installed the parameters of the new level.
+		z.tune = nil
+	}
+	z.level = level
+	z.strategy = strategy
 	return nil
 }
 
-// Close implements io.Closer
-func (z *writer) Close() error {
+func (z *writer) setParams(level int, strategy Strategy) error {
 	for {
 		outLen := C.int(len(z.outBuf))
-		ret := C.zs_deflate_finish(&z.zs[0], unsafe.Pointer(&z.outBuf[0]), &outLen)
-		if ret != 0 && ret != C.Z_STREAM_END {
-			return zlibReturnCodeToError(ret)
-		}
+		ret := C.zs_deflate_params(&z.zs[0], C.int(level), C.int(strategy), unsafe.Pointer(&z.outBuf[0]), &outLen)
 		nOut := len(z.outBuf) - int(outLen)
 		if err := z.push(z.outBuf[:nOut]); err != nil {
 			return err
 		}
-		if ret == C.Z_STREAM_END {
+		if ret == C.Z_OK {
 			return nil
 		}
+		// deflateParams returns Z_BUF_ERROR when the flush of the data
+		// compressed with the old parameters filled outBuf; call it again
+		// to write the rest.
+		if ret != C.Z_BUF_ERROR || nOut == 0 {
+			return zstreamError(&z.zs, ret)
+		}
 	}
 }
 
-// Write implements io.Writer.
-func (z *writer) Write(in []byte) (int, error) {
-	if len(in) == 0 {
-		return 0, nil
-	}
-	var outLen = C.int(len(z.outBuf))
-	ret := C.zs_deflate(&z.zs[0], unsafe.Pointer(&in[0]), C.int(len(in)),
-		unsafe.Pointer(&z.outBuf[0]), &outLen)
-	if ret != 0 {
-		return 0, zlibReturnCodeToError(ret)
+// maxMatch is the longest match of deflate, MAX_MATCH in zlib.
+const maxMatch = 258
+
+// tuning holds the parameters of Writer.Tune.
+type tuning struct {
+	goodLength, maxLazy, niceLength, maxChain int
+}
+
+func (t *tuning) apply(zs *zstream) error {
+	ret := C.zs_deflate_tune(&zs[0], C.int(t.goodLength), C.int(t.maxLazy), C.int(t.niceLength), C.int(t.maxChain))
+	if ret != C.Z_OK {
+		return zlibReturnCodeToError(ret)
 	}
-	nOut := len(z.outBuf) - int(outLen)
-	if err := z.push(z.outBuf[:nOut]); err != nil {
-		return 0, err
+	return nil
+}
+
+// Tune replaces the parameters of the match search that the compression level
+// selects, see deflateTune in zlib.h and the configuration table in deflate.c:
+// the search is cut short for matches of goodLength bytes or more, lazy
+// matching is skipped after matches of maxLazy or more (levels 1 to 3 use it
+// as the longest match that is inserted in the hash table instead), the search
+// stops at a match of niceLength, and it follows at most maxChain hash chain
+// entries. Lengths range from 0 to 258, and maxChain from 1 to 65536. Shorter
+// searches trade ratio for speed. The parameters apply to the data written
+// from now on, and after NewMember and Reset, until SetParams changes the
+// level. They make no difference to Store, and to StrategyHuffmanOnly and
+// StrategyRLE.
+func (z *writer) Tune(goodLength, maxLazy, niceLength, maxChain int) error {
+	if z.closed {
+		return ErrWriterClosed
 	}
-	if outLen > 0 { // outbuf didn't fillup, i.e., the input was fully consumed.
-		return len(in), nil
+	if z.err != nil {
+		return z.err
 	}
-	for {
-		outLen = C.int(len(z.outBuf))
-		ret = C.zs_deflate(&z.zs[0], nil, 0, unsafe.Pointer(&z.outBuf[0]), &outLen)
-		if ret != 0 {
-			return 0, zlibReturnCodeToError(ret)
-		}
-		nOut := len(z.outBuf) - int(outLen)
-		if err := z.push(z.outBuf[:nOut]); err != nil {
-			return 0, err
-		}
-		if outLen > 0 { // outbuf didn't fillup, i.e., the input was fully consumed.
-			break
+	for _, n := range []int{goodLength, maxLazy, niceLength} {
+		if n < 0 || n > maxMatch {
+			return fmt.Errorf("zlib: invalid tuning length %d", n)
 		}
 	}
-	return len(in), nil
+	if maxChain < 1 || maxChain > 1<<16 {
+		return fmt.Errorf("zlib: invalid tuning chain %d", maxChain)
+	}
+	t := &tuning{goodLength, maxLazy, niceLength, maxChain}
+	if err := t.apply(&z.zs); err != nil {
+		return err
+	}
+	z.tune = t
+	return nil
 }
 
-func (z *writer) Flush() error {
-	outLen := C.int(len(z.outBuf))
-	ret := C.zs_deflate_flush(&z.zs[0], unsafe.Pointer(&z.outBuf[0]), &outLen)
-	if ret == C.Z_BUF_ERROR {
-		// no output
-		return nil
+// NewMember ends the current gzip member, trailer included, and starts a new
+// one in the same output, so that the output is a multi-member gzip file. The
+// output is the same as that of two writers with the same settings, one for
+// each member. The new member has the default header, unless SetHeader is
+// called before writing to it. For FormatZlib and FormatRaw, it ends the
+// current stream and starts another one.
+func (z *writer) NewMember() error {
+	if z.closed {
+		return ErrWriterClosed
+	}
+	if z.err != nil {
+		return z.err
 	}
-	if ret != 0 {
+	err := z.newMember()
+	runtime.KeepAlive(z)
+	if err != nil {
+		z.err = err
+		return err
+	}
+	return nil
+}
+
+// newMember ends the current member and starts the next one.
+func (z *writer) newMember() error {
+	if err := z.finish(); err != nil {
+		return err
+	}
+	z.memberSum = z.Checksum()
+	z.memberConsumed = z.consumed
+	if ret := C.zs_deflate_reset(&z.zs[0]); ret != C.Z_OK {
 		return zlibReturnCodeToError(ret)
 	}
-	nOut := len(z.outBuf) - int(outLen)
-	if err := z.push(z.outBuf[:nOut]); err != nil {
+	if err := z.startStream(); err != nil {
 		return err
 	}
+	z.started = false
+	z.memberStart = z.pushed
 	return nil
 }
 
-func (z *writer) Reset(w io.Writer) error {
-	ret := C.zs_deflate_reset(&z.zs[0])
+// WriterCheckpoint is a snapshot of the state of a writer, taken by
+// Writer.Checkpoint. It holds a copy of the zlib state in C memory, about
+// DeflateMemory bytes, and must be closed once it's no longer needed.
+type WriterCheckpoint struct {
+	z      *writer // the writer that took the checkpoint.
+	zs     zstream
+	head   *C.gz_header // copy of z.head; nil if z has none.
+	closed bool
+
+	level          int
+	strategy       Strategy
+	tune           *tuning
+	pushed         int64
+	memberStart    int64
+	outStart       int64
+	consumed       int64
+	memberConsumed int64
+	memberSum      uint32
+	started        bool
+}
+
+// InputOffset returns the number of bytes of input that the writer had
+// accepted when the checkpoint was taken. After Restore, the input goes on
+// from there.
+func (cp *WriterCheckpoint) InputOffset() int64 {
+	return cp.consumed
+}
+
+// OutputOffset returns the number of bytes that the writer had written to the
+// underlying writer when the checkpoint was taken. The writer passed to
+// Restore receives the output from that offset onwards.
+func (cp *WriterCheckpoint) OutputOffset() int64 {
+	return cp.pushed
+}
+
+// Close frees the C memory held by the checkpoint. It can be called more than
+// once.
+func (cp *WriterCheckpoint) Close() error {
+	if !cp.closed {
+		cp.closed = true
+		cp.end()
+		runtime.SetFinalizer(cp, nil)
+	}
+	return nil
+}
+
+func gcWriterCheckpoint(cp *WriterCheckpoint) {
+	cp.end()
+}
+
+// end releases the C state of cp.
+func (cp *WriterCheckpoint) end() {
+	C.zs_deflate_end(&cp.zs[0])
+	if cp.head != nil {
+		C.zs_gz_header_free(cp.head)
+		cp.head = nil
+	}
+}
+
+// copyHeader installs a copy of head in zs, so that it doesn't point to a
+// header that SetHeader or Close may free. It returns the copy; nil if head is
+// nil.
+func copyHeader(zs *zstream, head *C.gz_header) (*C.gz_header, error) {
+	if head == nil {
+		return nil, nil
+	}
+	dup := C.zs_gz_header_dup(head)
+	if dup == nil {
+		return nil, zlibErrors[C.Z_MEM_ERROR]
+	}
+	if ret := C.zs_deflate_set_header(&zs[0], dup); ret != C.Z_OK {
+		C.zs_gz_header_free(dup)
+		return nil, zlibReturnCodeToError(ret)
+	}
+	return dup, nil
+}
+
+// Checkpoint takes a snapshot of the writer that Restore can return to later,
+// e.g. to retry the part of an upload that failed. All the output for the
+// input so far has been written when it is taken, and the output after
+// Restore is the same, byte for byte, as after Checkpoint. The checkpoint only
+// lives in memory; it can be restored any number of times into the writer
+// that took it, and must be closed to free its C memory. It fails if the
+// writer has failed.
+func (z *writer) Checkpoint() (*WriterCheckpoint, error) {
+	if z.closed {
+		return nil, ErrWriterClosed
+	}
+	if z.err != nil {
+		return nil, z.err
+	}
+	cp := &WriterCheckpoint{z: z}
+	ret := C.zs_deflate_copy(&cp.zs[0], &z.zs[0])
+	runtime.KeepAlive(z)
 	if ret != C.Z_OK {
-		return zlibReturnCodeToError(ret)
+		return nil, zlibReturnCodeToError(ret)
+	}
+	head, err := copyHeader(&cp.zs, z.head)
+	if err != nil {
+		C.zs_deflate_end(&cp.zs[0])
+		return nil, err
+	}
+	cp.head = head
+	runtime.SetFinalizer(cp, gcWriterCheckpoint)
+
+	cp.level = z.level
+	cp.strategy = z.strategy
+	cp.tune = z.tune
+	cp.pushed = z.pushed
+	cp.memberStart = z.memberStart
+	cp.outStart = z.outStart
+	cp.consumed = z.consumed
+	cp.memberConsumed = z.memberConsumed
+	cp.memberSum = z.memberSum
+	cp.started = z.started
+	return cp, nil
+}
+
+// Restore returns the writer to the state captured by cp, which must have
+// been taken by this writer, including after Write or Flush has failed, and
+// clears the error. The output goes on to w, which must take it from
+// cp.OutputOffset() onwards, and the input from cp.InputOffset().
+func (z *writer) Restore(cp *WriterCheckpoint, w io.Writer) error {
+	if z.closed {
+		return ErrWriterClosed
+	}
+	if cp.closed {
+		return errors.New("zlib: checkpoint is closed")
+	}
+	if cp.z != z {
+		return errors.New("zlib: checkpoint was taken by another writer")
+	}
+	C.zs_deflate_end(&z.zs[0])
+	z.freeHeader()
+	ret := C.zs_deflate_copy(&z.zs[0], &cp.zs[0])
+	runtime.KeepAlive(cp)
+	if ret != C.Z_OK {
+		// zstream is unusable until the next successful Restore.
+		z.err = zlibReturnCodeToError(ret)
+		return z.err
+	}
+	head, err := copyHeader(&z.zs, cp.head)
+	if err != nil {
+		z.err = err
+		return err
+	}
+	z.head = head
+
+	z.out = w
+	z.level = cp.level
+	z.strategy = cp.strategy
+	z.tune = cp.tune
+	z.pushed = cp.pushed
+	z.memberStart = cp.memberStart
+	z.outStart = cp.outStart
+	z.consumed = cp.consumed
+	z.memberConsumed = cp.memberConsumed
+	z.memberSum = cp.memberSum
+	z.started = cp.started
+	z.err = nil
+	return nil
+}
+
+// Reset discards the writer's state, including a sticky error, and makes it
+// equivalent to the result of NewWriterLevel on w with the same settings. It
+// also works after Close, which makes writers reusable from a sync.Pool.
+func (z *writer) Reset(w io.Writer) error {
+	if !z.closed && C.zs_deflate_reset(&z.zs[0]) != C.Z_OK {
+		// Start over with a new stream.
+		z.end()
+	}
+	var err error
+	if z.closed {
+		err = z.init()
+	} else {
+		err = z.startStream()
+	}
+	runtime.KeepAlive(z)
+	if err != nil {
+		return err
 	}
+	z.started = false
+	z.pushed = 0
+	z.memberStart = 0
+	z.outStart = 0
+	z.consumed = 0
+	z.memberConsumed = 0
+	z.memberSum = 0
+	z.err = nil
 
 	z.out = w
 
 	return nil
 }
 
+var (
+	// ErrHeader is returned when the input doesn't start with a header of the
+	// expected format.
+	ErrHeader = errors.New("zlib: invalid header")
+	// ErrChecksum is returned when the CRC-32 in a gzip trailer or the Adler-32
+	// in a zlib trailer doesn't match the decoded data.
+	ErrChecksum = errors.New("zlib: invalid checksum")
+	// ErrHeaderChecksum is returned when the CRC16 of a gzip header with the
+	// FHCRC flag doesn't match the header.
+	ErrHeaderChecksum = errors.New("zlib: invalid header checksum")
+	// ErrDictionaryRequired is returned by Read when the stream was compressed
+	// with a preset dictionary and none has been set. Calling SetDictionary
+	// lets Read continue.
+	ErrDictionaryRequired = errors.New("zlib: dictionary required")
+	// ErrLimitExceeded is returned by Read once the stream decodes to more
+	// than ReaderOptions.Limit bytes.
+	ErrLimitExceeded = errors.New("zlib: decompressed size limit exceeded")
+	// ErrSize is returned when the ISIZE field of a gzip trailer doesn't match
+	// the decoded size modulo 2^32.
+	ErrSize = errors.New("zlib: invalid uncompressed size")
+	// ErrWindowTooSmall is returned by Read when the stream was compressed
+	// with a larger window than ReaderOptions.WindowBits allows.
+	ErrWindowTooSmall = errors.New("zlib: window too small for the stream")
+	// ErrNoSyncPoint is returned by Recover when the rest of the input has no
+	// flush point to resume decoding from.
+	ErrNoSyncPoint = errors.New("zlib: no sync point found")
+	// ErrShortBuffer is returned by DecompressWithSize when the stream
+	// decodes to more than the given size.
+	ErrShortBuffer = errors.New("zlib: decoded data larger than the given size")
+	// ErrSizeMismatch is returned by DecompressWithSize when the stream
+	// decodes to less than the given size.
+	ErrSizeMismatch = errors.New("zlib: decoded data smaller than the given size")
+)
+
+// ErrReaderClosed is returned by Read and Reset after Close.
+var ErrReaderClosed = errors.New("zlib: reader is closed")
+
+// ErrWriterClosed is returned by Write and Flush after Close, until Reset.
+var ErrWriterClosed = errors.New("zlib: writer is closed")
+
+// Error is an error returned by a zlib function, such as a Z_DATA_ERROR for a
+// corrupt stream that doesn't map to one of the Err variables.
+type Error struct {
+	Code int    // zlib return code, e.g. -3 for Z_DATA_ERROR.
+	Msg  string // reason given by zlib in z_stream.msg; empty if there's none.
+}
+
+func (e *Error) Error() string {
+	s, ok := zlibErrorNames[e.Code]
+	if !ok {
+		s = fmt.Sprintf("unknown error %d", e.Code)
+	}
+	if e.Msg != "" {
+		return "zlib: " + s + ": " + e.Msg
+	}
+	return "zlib: " + s
+}
+
+var zlibErrorNames = map[int]string{
+	C.Z_STREAM_ERROR:  "stream error",
+	C.Z_DATA_ERROR:    "data error",
+	C.Z_MEM_ERROR:     "mem error",
+	C.Z_BUF_ERROR:     "buf error",
+	C.Z_VERSION_ERROR: "version error",
+}
+
 var zlibErrors = map[C.int]error{
 	C.Z_OK:            nil,
 	C.Z_STREAM_END:    io.EOF,
 	C.Z_ERRNO:         nil, // handled separately
-	C.Z_STREAM_ERROR:  errors.New("zlib: stream error"),
-	C.Z_DATA_ERROR:    errors.New("zlib: data error"),
-	C.Z_MEM_ERROR:     errors.New("zlib: mem error"),
-	C.Z_BUF_ERROR:     errors.New("zlib: buf error"),
-	C.Z_VERSION_ERROR: errors.New("zlib: version error"),
+	C.Z_STREAM_ERROR:  &Error{Code: C.Z_STREAM_ERROR},
+	C.Z_DATA_ERROR:    &Error{Code: C.Z_DATA_ERROR},
+	C.Z_MEM_ERROR:     &Error{Code: C.Z_MEM_ERROR},
+	C.Z_BUF_ERROR:     &Error{Code: C.Z_BUF_ERROR},
+	C.Z_VERSION_ERROR: &Error{Code: C.Z_VERSION_ERROR},
 }
 
 func zlibReturnCodeToError(r C.int) error {
@@ -263,7 +3193,34 @@ func zlibReturnCodeToError(r C.int) error {
 	if err, ok := zlibErrors[r]; ok {
 		return err
 	}
-	return fmt.Errorf("zlib: unknown error %d", r)
+	return &Error{Code: int(r)}
+}
+
+// zstreamError is like zlibReturnCodeToError, and adds the reason zlib left in
+// the msg of zs, if any.
+func zstreamError(zs *zstream, r C.int) error {
+	err := zlibReturnCodeToError(r)
+	if e, ok := err.(*Error); ok {
+		if msg := C.zs_get_msg(&zs[0]); msg != nil {
+			return &Error{Code: e.Code, Msg: C.GoString(msg)}
+		}
+	}
+	return err
+}
+
+// CopyContext decompresses the gzip stream read from src into dst, like
+// io.Copy on a reader from NewReader, and stops with ctx.Err() once ctx is
+// done. It returns the number of decompressed bytes written to dst.
+func CopyContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	z, err := NewReaderOpts(src, ReaderOptions{Context: ctx})
+	if err != nil {
+		return 0, err
+	}
+	n, err := z.WriteTo(dst)
+	if cerr := z.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
 }
 
 func Version() string {
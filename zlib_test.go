@@ -1,17 +1,32 @@
 package zlib_test
 
 import (
+	"archive/zip"
 	"bufio"
 	"bytes"
+	"compress/flate"
 	"compress/gzip"
+	stdzlib "compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
 	"flag"
+	"fmt"
+	"hash/adler32"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	zlib "github.com/wongnai/cloudflare-zlib"
 	"github.com/grailbio/testutil/assert"
@@ -92,113 +107,4656 @@ func TestInflateRandomPacked(t *testing.T) {
 	}
 }
 
+// compressGzip compresses each chunk with compress/gzip and concatenates the
+// resulting members.
+func compressGzip(t testing.TB, chunks ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, chunk := range chunks {
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write(chunk)
+		assert.NoError(t, err)
+		assert.NoError(t, gz.Close())
+	}
+	return buf.Bytes()
+}
+
+func TestInflateReset(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	data0 := make([]byte, 1<<20)
+	data1 := make([]byte, 1<<20)
+	_, err := r.Read(data0)
+	assert.NoError(t, err)
+	_, err = r.Read(data1)
+	assert.NoError(t, err)
+
+	zin, err := zlib.NewReaderBuffer(bytes.NewReader(compressGzip(t, data0)), 4096)
+	assert.NoError(t, err)
+	// Abandon the first stream in the middle of the member.
+	buf := make([]byte, 1000)
+	_, err = io.ReadFull(zin, buf)
+	assert.NoError(t, err)
+	assert.EQ(t, buf, data0[:1000])
+
+	assert.NoError(t, zin.Reset(bytes.NewReader(compressGzip(t, data1))))
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, len(got), len(data1))
+	if !bytes.Equal(got, data1) {
+		t.Fatal("fail")
+	}
+
+	assert.NoError(t, zin.Close())
+
+	// A reader of small blobs sizes its input buffer for the first one, and
+	// reuses it for the next ones.
+	blob := compressGzip(t, data1[:100])
+	src := bytes.NewReader(blob)
+	zin, err = zlib.NewReader(src)
+	assert.NoError(t, err)
+	allocs := testing.AllocsPerRun(100, func() {
+		src.Reset(blob)
+		if err := zin.Reset(src); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			_, err := zin.Read(buf)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	assert.EQ(t, allocs, 0.0)
+	assert.NoError(t, zin.Close())
+}
+
+func TestInflateMultistream(t *testing.T) {
+	src := compressGzip(t, []byte("hello"), []byte("world"), []byte("!"))
+	zin, err := zlib.NewReader(bytes.NewReader(src))
+	assert.NoError(t, err)
+
+	zin.Multistream(false)
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), "hello")
+	n, err := zin.Read(make([]byte, 10))
+	assert.EQ(t, n, 0)
+	assert.EQ(t, err, io.EOF)
+
+	// The following members were buffered together with the first one.
+	zin.Multistream(false)
+	got, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), "world")
+
+	zin.Multistream(true)
+	got, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), "!")
+	assert.NoError(t, zin.Close())
+}
+
+func TestInflateHeader(t *testing.T) {
+	var buf bytes.Buffer
+	modTime := time.Unix(1500000000, 0)
+	for _, hdr := range []gzip.Header{
+		{Name: "caf\u00e9.txt", Comment: "first", ModTime: modTime, OS: 3},
+		{OS: 255},
+	} {
+		gz := gzip.NewWriter(&buf)
+		gz.Header = hdr
+		_, err := gz.Write([]byte("data"))
+		assert.NoError(t, err)
+		assert.NoError(t, gz.Close())
+	}
+
+	zin, err := zlib.NewReader(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.EQ(t, zin.Header(), zlib.Header{})
+	zin.Multistream(false)
+	_, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	hdr := zin.Header()
+	assert.EQ(t, hdr.Name, "caf\u00e9.txt")
+	assert.EQ(t, hdr.Comment, "first")
+	assert.True(t, hdr.ModTime.Equal(modTime))
+	assert.EQ(t, hdr.OS, byte(3))
+
+	zin.Multistream(false)
+	_, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, zin.Header(), zlib.Header{OS: 255})
+	assert.NoError(t, zin.Close())
+}
+
+func TestInflateHeaderExtra(t *testing.T) {
+	var buf bytes.Buffer
+	extra := bytes.Repeat([]byte("0123456789"), 100)
+	gz := gzip.NewWriter(&buf)
+	gz.Header.Extra = extra
+	_, err := gz.Write([]byte("data"))
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+	src := buf.Bytes()
+	src[3] |= 1 // FTEXT
+
+	read := func(opts zlib.ReaderOptions, src []byte) zlib.Header {
+		zin, err := zlib.NewReaderOpts(bytes.NewReader(src), opts)
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		assert.EQ(t, string(got), "data")
+		assert.NoError(t, zin.Close())
+		return zin.Header()
+	}
+	// The extra field spans many input buffer refills.
+	hdr := read(zlib.ReaderOptions{BufferSize: 5}, src)
+	assert.EQ(t, hdr.Extra, extra)
+	assert.True(t, hdr.Text)
+	assert.EQ(t, hdr.OS, byte(255))
+
+	hdr = read(zlib.ReaderOptions{MaxExtraSize: 4}, src)
+	assert.EQ(t, hdr.Extra, extra[:4])
+	hdr = read(zlib.ReaderOptions{MaxExtraSize: -1}, src)
+	assert.True(t, hdr.Extra == nil)
+	hdr = read(zlib.ReaderOptions{}, compressGzip(t, []byte("data")))
+	assert.True(t, hdr.Extra == nil)
+	assert.False(t, hdr.Text)
+}
+
+func TestInflateTrailer(t *testing.T) {
+	src := compressGzip(t, []byte("hello"), []byte("hello, world"))
+	zin, err := zlib.NewReader(bytes.NewReader(src))
+	assert.NoError(t, err)
+	assert.EQ(t, zin.UncompressedSize(), int64(0))
+	zin.Multistream(false)
+	_, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, zin.UncompressedSize(), int64(5))
+	zin.Multistream(true)
+	_, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, zin.UncompressedSize(), int64(12))
+	assert.NoError(t, zin.Close())
+
+	corrupt := func(off int) error {
+		src := compressGzip(t, []byte("hello"))
+		src[len(src)-off]++
+		zin, err := zlib.NewReader(bytes.NewReader(src))
+		assert.NoError(t, err)
+		_, err = ioutil.ReadAll(zin)
+		zin.Close()
+		return err
+	}
+	assert.EQ(t, corrupt(8), zlib.ErrChecksum)
+	assert.EQ(t, corrupt(4), zlib.ErrSize)
+}
+
+func TestInflateTruncated(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(0)).Read(data)
+	src := compressGzip(t, []byte("hello"), data)
+	member0 := len(compressGzip(t, []byte("hello")))
+
+	read := func(src []byte) error {
+		zin, err := zlib.NewReaderBuffer(bytes.NewReader(src), 4096)
+		assert.NoError(t, err)
+		_, err = ioutil.ReadAll(zin)
+		assert.EQ(t, zin.Close(), err)
+		return err
+	}
+	assert.NoError(t, read(src))
+	assert.NoError(t, read(src[:member0]))
+	assert.NoError(t, read(nil))
+	for _, n := range []int{
+		5,            // inside the first header
+		member0 - 8,  // missing the first trailer
+		member0 + 5,  // inside the second header
+		len(src) / 2, // inside the deflate stream
+		len(src) - 8, // missing the final trailer
+		len(src) - 1, // missing the last byte of ISIZE
+	} {
+		assert.EQ(t, read(src[:n]), io.ErrUnexpectedEOF, "n=%d", n)
+	}
+}
+
+// emptyReader returns (0, nil) from every other Read, or from every Read if
+// r is nil.
+type emptyReader struct {
+	r     io.Reader
+	empty bool
+}
+
+func (r *emptyReader) Read(p []byte) (int, error) {
+	r.empty = !r.empty
+	if r.r == nil || r.empty {
+		return 0, nil
+	}
+	return r.r.Read(p)
+}
+
+func TestInflateEmptyReads(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(0)).Read(data)
+	src := compressGzip(t, data, []byte("hello"))
+	zin, err := zlib.NewReaderBuffer(&emptyReader{r: iotest.OneByteReader(bytes.NewReader(src))}, 4096)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	if !bytes.Equal(got, append(data, "hello"...)) {
+		t.Fatal("fail")
+	}
+	assert.NoError(t, zin.Close())
+
+	zin, err = zlib.NewReader(&emptyReader{})
+	assert.NoError(t, err)
+	_, err = zin.Read(make([]byte, 10))
+	assert.EQ(t, err, io.ErrNoProgress)
+	assert.EQ(t, zin.Close(), io.ErrNoProgress)
+}
+
+// rss returns the resident set size of the process in bytes.
+func rss(t *testing.T) int64 {
+	data, err := ioutil.ReadFile("/proc/self/statm")
+	assert.NoError(t, err)
+	var size, resident int64
+	_, err = fmt.Sscan(string(data), &size, &resident)
+	assert.NoError(t, err)
+	return resident * int64(os.Getpagesize())
+}
+
+func TestInflateFinalizer(t *testing.T) {
+	src := compressGzip(t, bytes.Repeat([]byte("hello"), 10000))
+	open := func(n int) {
+		for i := 0; i < n; i++ {
+			zin, err := zlib.NewReaderBuffer(bytes.NewReader(src), 1024)
+			assert.NoError(t, err)
+			_, err = zin.Read(make([]byte, 10))
+			assert.NoError(t, err)
+			if i%1000 == 0 {
+				runtime.GC()
+			}
+		}
+		runtime.GC()
+	}
+	open(2000)
+	before := rss(t)
+	// Each dropped reader holds about 40KB of inflate state.
+	open(20000)
+	after := rss(t)
+	assert.LT(t, after-before, int64(200<<20), "before=%d after=%d", before, after)
+}
+
+func TestInflateCloseTwice(t *testing.T) {
+	zin, err := zlib.NewReader(bytes.NewReader(compressGzip(t, []byte("hello"))))
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.NoError(t, zin.Close())
+	assert.NoError(t, zin.Close())
+	_, err = zin.Read(make([]byte, 10))
+	assert.EQ(t, err, zlib.ErrReaderClosed)
+	assert.EQ(t, zin.Reset(bytes.NewReader(nil)), zlib.ErrReaderClosed)
+	assert.NoError(t, zin.Close())
+
+	zin, err = zlib.NewReader(bytes.NewReader([]byte("not gzip")))
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zin)
+	assert.NotNil(t, err)
+	assert.EQ(t, zin.Close(), err)
+	assert.EQ(t, zin.Close(), err)
+}
+
+// countingReader counts the Read calls made to r.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.n++
+	return r.r.Read(p)
+}
+
+func TestInflateStickyError(t *testing.T) {
+	src := compressGzip(t, []byte("hello"))
+	src[15]++ // corrupt the deflate stream
+	src = append(src, compressGzip(t, []byte("world"))...)
+	in := &countingReader{r: iotest.OneByteReader(bytes.NewReader(src))}
+	zin, err := zlib.NewReader(in)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zin)
+	assert.NotNil(t, err)
+	n := in.n
+	for i := 0; i < 3; i++ {
+		_, err2 := zin.Read(make([]byte, 10))
+		assert.EQ(t, err2, err)
+	}
+	assert.EQ(t, in.n, n)
+	assert.EQ(t, zin.Close(), err)
+	_, err = zin.Read(make([]byte, 10))
+	assert.EQ(t, err, zlib.ErrReaderClosed)
+}
+
+func TestInflateRaw(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(0)).Read(data)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("data")
+	assert.NoError(t, err)
+	_, err = w.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.NoError(t, err)
+	f := zr.File[0]
+	assert.EQ(t, f.Method, zip.Deflate)
+	off, err := f.DataOffset()
+	assert.NoError(t, err)
+	src := buf.Bytes()[off : off+int64(f.CompressedSize64)]
+
+	zin, err := zlib.NewReaderRaw(bytes.NewReader(src), 4096)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	if !bytes.Equal(got, data) {
+		t.Fatal("fail")
+	}
+	assert.EQ(t, zin.Header(), zlib.Header{})
+	assert.NoError(t, zin.Close())
+
+	zin, err = zlib.NewReaderRaw(bytes.NewReader(src[:len(src)/2]), 4096)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zin)
+	assert.EQ(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestInflateZlib(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(0)).Read(data)
+	var buf bytes.Buffer
+	zw := stdzlib.NewWriter(&buf)
+	_, err := zw.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	src := buf.Bytes()
+
+	zin, err := zlib.NewReaderZlib(bytes.NewReader(src), 4096)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	if !bytes.Equal(got, data) {
+		t.Fatal("fail")
+	}
+	assert.NoError(t, zin.Close())
+
+	// A gzip reader in the same binary is unaffected.
+	testInflate(t, nil, compressGzip(t, data), data)
+
+	src[len(src)-1]++
+	zin, err = zlib.NewReaderZlib(bytes.NewReader(src), 4096)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zin)
+	assert.EQ(t, err, zlib.ErrChecksum)
+}
+
+func TestInflateAuto(t *testing.T) {
+	var buf bytes.Buffer
+	zw := stdzlib.NewWriter(&buf)
+	_, err := zw.Write([]byte("zlib"))
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	zlibSrc := buf.Bytes()
+	gzipSrc := compressGzip(t, []byte("gzip"), []byte(" and more"))
+
+	for _, test := range []struct {
+		src    []byte
+		format zlib.Format
+		want   string
+	}{
+		{zlibSrc, zlib.FormatZlib, "zlib"},
+		{gzipSrc, zlib.FormatGzip, "gzip and more"},
+	} {
+		zin, err := zlib.NewReaderAuto(bytes.NewReader(test.src), 4096)
+		assert.NoError(t, err)
+		assert.EQ(t, zin.Format(), zlib.FormatAuto)
+		got, err := ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		assert.EQ(t, string(got), test.want)
+		assert.EQ(t, zin.Format(), test.format)
+		assert.NoError(t, zin.Close())
+	}
+
+	zin, err := zlib.NewReaderAuto(bytes.NewReader([]byte("neither gzip nor zlib")), 4096)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zin)
+	assert.EQ(t, err, zlib.ErrHeader)
+}
+
+func TestInflateDict(t *testing.T) {
+	dict := []byte("the quick brown fox jumps over the lazy dog")
+	data := bytes.Repeat([]byte("the lazy dog and the quick fox "), 100)
+	var buf bytes.Buffer
+	zw, err := stdzlib.NewWriterLevelDict(&buf, stdzlib.DefaultCompression, dict)
+	assert.NoError(t, err)
+	_, err = zw.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	src := buf.Bytes()
+
+	zin, err := zlib.NewReaderDict(bytes.NewReader(src), dict, 4096)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, got, data)
+	assert.NoError(t, zin.Close())
+
+	zin, err = zlib.NewReaderZlib(bytes.NewReader(src), 4096)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zin)
+	assert.EQ(t, err, zlib.ErrDictionaryRequired)
+	assert.NotNil(t, zin.SetDictionary([]byte("wrong dictionary")))
+	assert.NoError(t, zin.SetDictionary(dict))
+	got, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, got, data)
+	assert.NoError(t, zin.Close())
+
+	buf.Reset()
+	fw, err := flate.NewWriterDict(&buf, flate.DefaultCompression, dict)
+	assert.NoError(t, err)
+	_, err = fw.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, fw.Close())
+	zin, err = zlib.NewReaderOpts(bytes.NewReader(buf.Bytes()), zlib.ReaderOptions{Format: zlib.FormatRaw, Dictionary: dict})
+	assert.NoError(t, err)
+	got, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, got, data)
+	assert.NoError(t, zin.Close())
+}
+
+func TestInflateDictID(t *testing.T) {
+	dicts := map[uint32][]byte{}
+	var srcs [][]byte
+	for _, dict := range [][]byte{[]byte("first dictionary"), []byte("second dictionary")} {
+		dicts[adler32.Checksum(dict)] = dict
+		var buf bytes.Buffer
+		zw, err := stdzlib.NewWriterLevelDict(&buf, stdzlib.DefaultCompression, dict)
+		assert.NoError(t, err)
+		_, err = zw.Write(dict)
+		assert.NoError(t, err)
+		assert.NoError(t, zw.Close())
+		srcs = append(srcs, buf.Bytes())
+	}
+	assert.EQ(t, len(dicts), 2)
+
+	for _, src := range srcs {
+		zin, err := zlib.NewReaderZlib(bytes.NewReader(src), 4096)
+		assert.NoError(t, err)
+		assert.EQ(t, zin.DictID(), uint32(0))
+		_, err = ioutil.ReadAll(zin)
+		assert.EQ(t, err, zlib.ErrDictionaryRequired)
+		dict := dicts[zin.DictID()]
+		assert.NotNil(t, dict)
+		assert.NoError(t, zin.SetDictionary(dict))
+		got, err := ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		assert.EQ(t, got, dict)
+		assert.NoError(t, zin.Close())
+	}
+}
+
+// failingWriter accepts n bytes, then fails.
+type failingWriter struct {
+	n int
+}
+
+var errFailingWriter = errors.New("failingWriter")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errFailingWriter
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestInflateWriteTo(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(0)).Read(data)
+	src := compressGzip(t, data[:1000], data[1000:])
+
+	zin, err := zlib.NewReaderBuffer(bytes.NewReader(src), 4096)
+	assert.NoError(t, err)
+	var got bytes.Buffer
+	n, err := io.Copy(&got, zin)
+	assert.NoError(t, err)
+	assert.EQ(t, n, int64(len(data)))
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Fatal("fail")
+	}
+	assert.NoError(t, zin.Close())
+
+	zin, err = zlib.NewReader(bytes.NewReader(src))
+	assert.NoError(t, err)
+	zin.Multistream(false)
+	got.Reset()
+	n, err = zin.WriteTo(&got)
+	assert.NoError(t, err)
+	assert.EQ(t, n, int64(1000))
+	assert.EQ(t, got.Bytes(), data[:1000])
+
+	zin.Multistream(false)
+	n, err = zin.WriteTo(&failingWriter{n: 12345})
+	assert.EQ(t, err, errFailingWriter)
+	assert.EQ(t, n, int64(12345))
+	assert.NoError(t, zin.Close())
+}
+
+func TestInflateReadByte(t *testing.T) {
+	uvarints := func(from, to uint64) []byte {
+		var b []byte
+		tmp := make([]byte, binary.MaxVarintLen64)
+		for i := from; i < to; i++ {
+			b = append(b, tmp[:binary.PutUvarint(tmp, i*i)]...)
+		}
+		return b
+	}
+	data := uvarints(0, 10000)
+	zin, err := zlib.NewReader(bytes.NewReader(compressGzip(t, data[:100], data[100:])))
+	assert.NoError(t, err)
+	for i := uint64(0); i < 5000; i++ {
+		v, err := binary.ReadUvarint(zin)
+		assert.NoError(t, err)
+		assert.EQ(t, v, i*i)
+	}
+	// Read continues exactly after the last byte returned by ReadByte.
+	rest, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, rest, uvarints(5000, 10000))
+	_, err = zin.ReadByte()
+	assert.EQ(t, err, io.EOF)
+	assert.NoError(t, zin.Close())
+}
+
+func TestInflateMembers(t *testing.T) {
+	chunks := [][]byte{[]byte("hello"), bytes.Repeat([]byte("world"), 1000), []byte("!")}
+	src := compressGzip(t, chunks...)
+	zin, err := zlib.NewReaderBuffer(bytes.NewReader(src), 4096)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, zin.MemberCount(), 3)
+
+	var cOff, uOff int64
+	for i, m := range zin.Members() {
+		member := compressGzip(t, chunks[i])
+		assert.EQ(t, m, zlib.MemberBoundary{
+			CompressedStart:   cOff,
+			CompressedEnd:     cOff + int64(len(member)),
+			UncompressedStart: uOff,
+			UncompressedEnd:   uOff + int64(len(chunks[i])),
+		})
+		cOff, uOff = m.CompressedEnd, m.UncompressedEnd
+	}
+	assert.EQ(t, cOff, int64(len(src)))
+	assert.NoError(t, zin.Reset(bytes.NewReader(src)))
+	assert.EQ(t, zin.MemberCount(), 0)
+	assert.NoError(t, zin.Close())
+}
+
+func TestInflateRemaining(t *testing.T) {
+	footer := []byte("footer after the stream")
+	src := append(compressGzip(t, []byte("hello")), footer...)
+	zin, err := zlib.NewReader(bytes.NewReader(src))
+	assert.NoError(t, err)
+	zin.Multistream(false)
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), "hello")
+	assert.EQ(t, zin.Remaining(), footer)
+	assert.NoError(t, zin.Close())
+
+	var buf bytes.Buffer
+	zw := stdzlib.NewWriter(&buf)
+	_, err = zw.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	buf.Write(footer)
+	// The footer arrives partly with the compressed data, partly in a
+	// separate read from the source. Hide io.ByteReader, which would make the
+	// reader give the first part back.
+	in := bytes.NewReader(buf.Bytes())
+	zin, err = zlib.NewReaderZlib(struct{ io.Reader }{in}, buf.Len()-5)
+	assert.NoError(t, err)
+	got, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), "hello")
+	rest, err := ioutil.ReadAll(in)
+	assert.NoError(t, err)
+	assert.EQ(t, append(zin.Remaining(), rest...), footer)
+	assert.NoError(t, zin.Close())
+}
+
+func TestInflateTrailingGarbage(t *testing.T) {
+	member := compressGzip(t, []byte("hello"))
+	read := func(src []byte, ignore bool) ([]byte, error) {
+		zin, err := zlib.NewReaderOpts(bytes.NewReader(src), zlib.ReaderOptions{IgnoreTrailingGarbage: ignore})
+		assert.NoError(t, err)
+		defer zin.Close()
+		return ioutil.ReadAll(zin)
+	}
+	for _, garbage := range [][]byte{
+		make([]byte, 1),
+		make([]byte, 512),
+		[]byte("junk"),
+	} {
+		src := append(append([]byte{}, member...), garbage...)
+		got, err := read(src, true)
+		assert.NoError(t, err)
+		assert.EQ(t, string(got), "hello")
+		_, err = read(src, false)
+		assert.NotNil(t, err)
+	}
+	// Garbage without any complete member before it is still an error.
+	_, err := read([]byte("junk"), true)
+	assert.EQ(t, err, zlib.ErrHeader)
+	// So is a member that is corrupt after its header.
+	src := append([]byte{}, member...)
+	src = append(src, member[:12]...)
+	_, err = read(src, true)
+	assert.EQ(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestInflateLimit(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 1<<20)
+	src := compressGzip(t, data[:1000], data[1000:])
+	read := func(limit int64, copy func(io.Writer, io.Reader) (int64, error)) (int64, error) {
+		zin, err := zlib.NewReaderLimit(bytes.NewReader(src), limit)
+		assert.NoError(t, err)
+		defer zin.Close()
+		return copy(ioutil.Discard, zin)
+	}
+	copyBuffer := func(w io.Writer, r io.Reader) (int64, error) {
+		return io.CopyBuffer(w, struct{ io.Reader }{r}, make([]byte, 777))
+	}
+	for _, copy := range []func(io.Writer, io.Reader) (int64, error){io.Copy, copyBuffer} {
+		n, err := read(int64(len(data)), copy)
+		assert.NoError(t, err)
+		assert.EQ(t, n, int64(len(data)))
+		// The limit applies across members.
+		n, err = read(5000, copy)
+		assert.EQ(t, err, zlib.ErrLimitExceeded)
+		assert.EQ(t, n, int64(5000))
+		n, err = read(int64(len(data))-1, copy)
+		assert.EQ(t, err, zlib.ErrLimitExceeded)
+		assert.EQ(t, n, int64(len(data))-1)
+	}
+}
+
+func TestInflateBufferSize(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	src := compressGzip(t, data[:7], data[7:5000], data[5000:])
+	for _, size := range []int{0, 1, 7} {
+		zin, err := zlib.NewReaderBuffer(bytes.NewReader(src), size)
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(zin)
+		assert.NoError(t, err, "size=%d", size)
+		assert.EQ(t, got, data, "size=%d", size)
+		assert.EQ(t, zin.MemberCount(), 3)
+		assert.NoError(t, zin.Close())
+	}
+	_, err := zlib.NewReaderBuffer(bytes.NewReader(src), -1)
+	assert.HasSubstr(t, err, "invalid buffer size")
+}
+
+func TestInflateBufferPool(t *testing.T) {
+	src := compressGzip(t, []byte("hello"))
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	const n = 100
+	for i := 0; i < n; i++ {
+		zin, err := zlib.NewReader(bytes.NewReader(src))
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		assert.EQ(t, string(got), "hello")
+		assert.NoError(t, zin.Close())
+
+		_, err = zin.Read(make([]byte, 10))
+		assert.EQ(t, err, zlib.ErrReaderClosed)
+		assert.EQ(t, len(zin.Remaining()), 0)
+	}
+	runtime.ReadMemStats(&after)
+	// Without the pool, every reader allocates a 512KB buffer.
+	assert.LT(t, after.TotalAlloc-before.TotalAlloc, uint64(n*512<<10/4))
+}
+
+func TestInflateLazyBuffer(t *testing.T) {
+	src := compressGzip(t, []byte("hello"))
+	allocated := func(f func()) uint64 {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		f()
+		runtime.ReadMemStats(&after)
+		return after.TotalAlloc - before.TotalAlloc
+	}
+	const bufSize = 1 << 20
+	var zin zlib.Reader
+	// Constructed but unused readers don't allocate their buffer.
+	n := allocated(func() {
+		var err error
+		zin, err = zlib.NewReaderBuffer(bytes.NewReader(src), bufSize)
+		assert.NoError(t, err)
+	})
+	assert.LT(t, n, uint64(bufSize/2))
+	// The buffer is no larger than the bytes.Reader's contents.
+	n = allocated(func() {
+		got, err := ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		assert.EQ(t, string(got), "hello")
+	})
+	assert.LT(t, n, uint64(bufSize/2))
+
+	// Reset to a larger source gets a larger buffer.
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	assert.NoError(t, zin.Reset(bytes.NewReader(compressGzip(t, data))))
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, got, data)
+	assert.NoError(t, zin.Close())
+}
+
+func TestInflateWithBuffer(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	src := compressGzip(t, data)
+	buf := make([]byte, 1000)
+	zin, err := zlib.NewReaderWithBuffer(bytes.NewReader(src), buf)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, got, data)
+	// The input went through the caller's buffer.
+	assert.LT(t, len(src), len(buf))
+	assert.EQ(t, buf[:len(src)], src)
+
+	br := bytes.NewReader(nil)
+	out := make([]byte, 4096)
+	allocs := testing.AllocsPerRun(10, func() {
+		br.Reset(src)
+		if err := zin.Reset(br); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			_, err := zin.Read(out)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	assert.EQ(t, allocs, 0.0)
+	assert.NoError(t, zin.Close())
+
+	_, err = zlib.NewReaderWithBuffer(bytes.NewReader(src), nil)
+	assert.NotNil(t, err)
+	_, err = zlib.NewReaderWithBuffer(bytes.NewReader(src), []byte{})
+	assert.NotNil(t, err)
+}
+
+func TestInflateByteCounts(t *testing.T) {
+	data := make([]byte, 100000)
+	rand.New(rand.NewSource(0)).Read(data)
+	src := compressGzip(t, data[:10], data[10:])
+	zin, err := zlib.NewReaderBuffer(bytes.NewReader(src), 4096)
+	assert.NoError(t, err)
+	_, err = zin.Read(make([]byte, 100))
+	assert.NoError(t, err)
+	assert.EQ(t, zin.InputBytes(), int64(4096))
+	assert.EQ(t, zin.OutputBytes(), int64(10)) // stopped at the member boundary
+	_, err = zin.ReadByte()
+	assert.NoError(t, err)
+	assert.EQ(t, zin.OutputBytes(), int64(11))
+	_, err = io.Copy(ioutil.Discard, zin)
+	assert.NoError(t, err)
+	assert.EQ(t, zin.InputBytes(), int64(len(src)))
+	assert.EQ(t, zin.OutputBytes(), int64(len(data)))
+
+	assert.NoError(t, zin.Reset(bytes.NewReader(src)))
+	assert.EQ(t, zin.InputBytes(), int64(0))
+	assert.EQ(t, zin.OutputBytes(), int64(0))
+	assert.NoError(t, zin.Close())
+}
+
+func TestInflateOffsets(t *testing.T) {
+	src := compressGzip(t, []byte("hello"), []byte("world"))
+	zin, err := zlib.NewReader(bytes.NewReader(src))
+	assert.NoError(t, err)
+	c, u := zin.Offsets()
+	assert.EQ(t, c, int64(0))
+	assert.EQ(t, u, int64(0))
+	zin.Multistream(false)
+	_, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	// The whole input is buffered, but only the first member is consumed.
+	assert.EQ(t, zin.InputBytes(), int64(len(src)))
+	c, u = zin.Offsets()
+	assert.EQ(t, c, zin.Members()[0].CompressedEnd)
+	assert.EQ(t, c, int64(len(src)-len(zin.Remaining())))
+	assert.EQ(t, u, int64(5))
+	assert.NoError(t, zin.Close())
+}
+
+// gzipFlushed compresses chunks without back references, with a sync flush
+// after each chunk, so that decoding can resume at any chunk boundary.
+func gzipFlushed(t *testing.T, chunks ...[]byte) []byte {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.HuffmanOnly)
+	assert.NoError(t, err)
+	for _, c := range chunks {
+		_, err = w.Write(c)
+		assert.NoError(t, err)
+		assert.NoError(t, w.Flush())
+	}
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestInflateRecover(t *testing.T) {
+	chunk1 := bytes.Repeat([]byte("lost data "), 100)
+	chunk2 := bytes.Repeat([]byte("recovered "), 100)
+	src := gzipFlushed(t, chunk1, chunk2)
+	// Turn the first deflate block into one of the reserved type.
+	src[10] |= 0x06
+	sync := bytes.Index(src[10:], []byte{0, 0, 0xff, 0xff}) + 10 + 4
+
+	zin, err := zlib.NewReader(bytes.NewReader(src))
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zin)
+	assert.HasSubstr(t, err, "data error")
+	c, _ := zin.Offsets()
+	n, err := zin.Recover()
+	assert.NoError(t, err)
+	assert.EQ(t, n, int64(sync)-c)
+	c, _ = zin.Offsets()
+	assert.EQ(t, c, int64(sync))
+	data, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, data, chunk2)
+	assert.NoError(t, zin.Close())
+}
+
+func TestInflateRecoverNoSyncPoint(t *testing.T) {
+	src := compressGzip(t, []byte("hello world"))
+	src[10] |= 0x06
+
+	zin, err := zlib.NewReader(bytes.NewReader(src))
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zin)
+	assert.NotNil(t, err)
+	_, err = zin.Recover()
+	assert.EQ(t, err, zlib.ErrNoSyncPoint)
+	_, err = zin.Read(make([]byte, 1))
+	assert.EQ(t, err, zlib.ErrNoSyncPoint)
+	c, _ := zin.Offsets()
+	assert.EQ(t, c, int64(len(src)))
+
+	// Nothing to recover from.
+	zin, err = zlib.NewReader(bytes.NewReader(compressGzip(t, []byte("hello"))))
+	assert.NoError(t, err)
+	n, err := zin.Recover()
+	assert.NoError(t, err)
+	assert.EQ(t, n, int64(0))
+	assert.NoError(t, zin.Close())
+}
+
+func TestInflateCheckpoint(t *testing.T) {
+	var data []byte
+	for i := 0; len(data) < 1<<20; i++ {
+		data = append(data, fmt.Sprintf("line %d\n", i)...)
+	}
+	src := compressGzip(t, data[:300000], data[300000:])
+	zin, err := zlib.NewReaderBuffer(bytes.NewReader(src), 4096)
+	assert.NoError(t, err)
+	head := make([]byte, 123457)
+	_, err = io.ReadFull(zin, head)
+	assert.NoError(t, err)
+	b, err := zin.ReadByte()
+	assert.NoError(t, err)
+	head = append(head, b)
+	cp, err := zin.Checkpoint()
+	assert.NoError(t, err)
+	assert.EQ(t, cp.OutputOffset(), int64(len(head)))
+
+	rest, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, append(head, rest...), data)
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, zin.Restore(cp, bytes.NewReader(src[cp.InputOffset():])))
+		c, u := zin.Offsets()
+		assert.EQ(t, u, cp.OutputOffset())
+		assert.LT(t, c, cp.InputOffset())
+		again, err := ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		assert.EQ(t, again, rest)
+		assert.EQ(t, zin.MemberCount(), 2)
+	}
+
+	assert.NoError(t, cp.Close())
+	assert.NoError(t, cp.Close())
+	assert.NotNil(t, zin.Restore(cp, bytes.NewReader(src)))
+	other, err := zlib.NewReader(bytes.NewReader(src))
+	assert.NoError(t, err)
+	cp, err = other.Checkpoint()
+	assert.NoError(t, err)
+	assert.NotNil(t, zin.Restore(cp, bytes.NewReader(src)))
+	assert.NoError(t, cp.Close())
+	assert.NoError(t, other.Close())
+	assert.NoError(t, zin.Close())
+}
+
+func TestInflateNextMember(t *testing.T) {
+	var buf bytes.Buffer
+	for _, name := range []string{"a", "b", "c"} {
+		gz := gzip.NewWriter(&buf)
+		gz.Header.Name = name
+		_, err := gz.Write(bytes.Repeat([]byte(name), 10000))
+		assert.NoError(t, err)
+		assert.NoError(t, gz.Close())
+	}
+
+	zin, err := zlib.NewReader(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	zin.Multistream(false)
+	data, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, len(data), 10000)
+	assert.EQ(t, zin.Header().Name, "a")
+
+	// The next header is already buffered.
+	ok, err := zin.NextMember()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.EQ(t, zin.Header().Name, "b")
+	p := make([]byte, 10)
+	_, err = io.ReadFull(zin, p)
+	assert.NoError(t, err)
+	assert.EQ(t, string(p), "bbbbbbbbbb")
+
+	// The rest of "b" is skipped.
+	ok, err = zin.NextMember()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.EQ(t, zin.Header().Name, "c")
+	data, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, data, bytes.Repeat([]byte("c"), 10000))
+	assert.EQ(t, zin.OutputBytes(), int64(30000))
+
+	ok, err = zin.NextMember()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = zin.NextMember()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.NoError(t, zin.Close())
+}
+
+func TestInflateDrain(t *testing.T) {
+	a := bytes.Repeat([]byte("a"), 10000)
+	b := randomText(rand.New(rand.NewSource(1)), 100000)
+	src := compressGzip(t, a, b)
+
+	zin, err := zlib.NewReader(bytes.NewReader(src))
+	assert.NoError(t, err)
+	p := make([]byte, 10)
+	_, err = io.ReadFull(zin, p)
+	assert.NoError(t, err)
+	size, crc, err := zin.Drain()
+	assert.NoError(t, err)
+	assert.EQ(t, size, int64(len(a)))
+	assert.EQ(t, crc, crc32.ChecksumIEEE(a))
+	assert.EQ(t, zin.OutputBytes(), int64(len(a)))
+
+	// Multistream mode continues with the next member.
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(got, b))
+	size, crc, err = zin.Drain()
+	assert.NoError(t, err)
+	assert.EQ(t, size, int64(len(b)))
+	assert.EQ(t, crc, crc32.ChecksumIEEE(b))
+
+	// A corrupt trailer is reported.
+	bad := append([]byte(nil), src...)
+	bad[len(bad)-5]++
+	assert.NoError(t, zin.Reset(bytes.NewReader(bad)))
+	size, _, err = zin.Drain()
+	assert.NoError(t, err)
+	assert.EQ(t, size, int64(len(a)))
+	_, _, err = zin.Drain()
+	assert.EQ(t, err, zlib.ErrChecksum)
+
+	// Drain allocates no more than WriteTo; both only allocate the headers.
+	br := bytes.NewReader(src)
+	drainAllocs := testing.AllocsPerRun(10, func() {
+		br.Reset(src)
+		zin.Reset(br)
+		zin.Drain()
+		zin.Drain()
+	})
+	copyAllocs := testing.AllocsPerRun(10, func() {
+		br.Reset(src)
+		zin.Reset(br)
+		zin.WriteTo(ioutil.Discard)
+	})
+	assert.EQ(t, drainAllocs, copyAllocs)
+	assert.NoError(t, zin.Close())
+}
+
+func TestInflateZeroLengthRead(t *testing.T) {
+	src := compressGzip(t, []byte("first"), []byte("second"))
+	zin, err := zlib.NewReader(bytes.NewReader(src))
+	assert.NoError(t, err)
+	zin.Multistream(false)
+
+	// Probing doesn't read input.
+	n, err := zin.Read(nil)
+	assert.NoError(t, err)
+	assert.EQ(t, n, 0)
+	assert.EQ(t, zin.InputBytes(), int64(0))
+
+	p := make([]byte, 100)
+	n, err = zin.Read(p)
+	assert.EQ(t, string(p[:n]), "first")
+	n, err = zin.Read(p[:0])
+	assert.NoError(t, err)
+	assert.EQ(t, n, 0)
+	// The end of the member is only reported to a non-empty Read.
+	n, err = zin.Read(p)
+	assert.EQ(t, n, 0)
+	assert.EQ(t, err, io.EOF)
+	n, err = zin.Read(nil)
+	assert.NoError(t, err)
+	assert.EQ(t, n, 0)
+	n, err = zin.Read(p)
+	assert.EQ(t, err, io.EOF)
+
+	zin.Multistream(false)
+	n, err = zin.Read(nil)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), "second")
+
+	// Nor is a sticky error.
+	assert.NoError(t, zin.Reset(bytes.NewReader(src[:len(src)-3])))
+	_, err = ioutil.ReadAll(zin)
+	assert.EQ(t, err, io.ErrUnexpectedEOF)
+	n, err = zin.Read(nil)
+	assert.NoError(t, err)
+	assert.EQ(t, n, 0)
+	_, err = zin.Read(p)
+	assert.EQ(t, err, io.ErrUnexpectedEOF)
+
+	assert.EQ(t, zin.Close(), io.ErrUnexpectedEOF)
+	_, err = zin.Read(nil)
+	assert.EQ(t, err, zlib.ErrReaderClosed)
+}
+
+func TestInflateDiscard(t *testing.T) {
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i * 7 / 3)
+	}
+	zin, err := zlib.NewReader(bytes.NewReader(compressGzip(t, data)))
+	assert.NoError(t, err)
+	// Part of it comes from what ReadByte staged.
+	b, err := zin.ReadByte()
+	assert.NoError(t, err)
+	assert.EQ(t, b, data[0])
+	n, err := zin.Discard(600000)
+	assert.NoError(t, err)
+	assert.EQ(t, n, int64(600000))
+	b, err = zin.ReadByte()
+	assert.NoError(t, err)
+	assert.EQ(t, b, data[600001])
+	assert.EQ(t, zin.OutputBytes(), int64(600002))
+
+	n, err = zin.Discard(int64(len(data)))
+	assert.EQ(t, err, io.ErrUnexpectedEOF)
+	assert.EQ(t, n, int64(len(data)-600002))
+	n, err = zin.Discard(0)
+	assert.NoError(t, err)
+	assert.EQ(t, n, int64(0))
+	assert.NoError(t, zin.Close())
+}
+
+// randomText returns n bytes of words picked at random, which compress with
+// plenty of back references.
+func randomText(r *rand.Rand, n int) []byte {
+	words := []string{"alpha ", "beta ", "gamma ", "delta ", "epsilon\n", "zeta ", "eta "}
+	var b []byte
+	for len(b) < n {
+		b = append(b, words[r.Intn(len(words))]...)
+	}
+	return b[:n]
+}
+
+func TestIndex(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	chunks := [][]byte{randomText(r, 1<<20), nil, randomText(r, 300000)}
+	data := bytes.Join(chunks, nil)
+	var zsrc bytes.Buffer
+	zw := stdzlib.NewWriter(&zsrc)
+	_, err := zw.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+
+	for _, src := range [][]byte{compressGzip(t, chunks...), zsrc.Bytes()} {
+		x, err := zlib.BuildIndex(bytes.NewReader(src), 64*1024)
+		assert.NoError(t, err)
+		assert.EQ(t, x.Size(), int64(len(data)))
+		assert.GT(t, x.Len(), 3)
+
+		zr := zlib.NewIndexedReader(bytes.NewReader(src), x)
+		for i := 0; i < 100; i++ {
+			off := r.Intn(len(data))
+			p := make([]byte, r.Intn(200000))
+			n, err := zr.ReadAt(p, int64(off))
+			if off+len(p) > len(data) {
+				assert.EQ(t, err, io.EOF)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.True(t, bytes.Equal(p[:n], data[off:off+n]))
+		}
+		// Across the member boundaries and to the end.
+		p := make([]byte, 400000)
+		n, err := zr.ReadAt(p, int64(len(chunks[0])-100000))
+		assert.EQ(t, err, io.EOF)
+		assert.True(t, bytes.Equal(p[:n], data[len(chunks[0])-100000:]))
+		_, err = zr.ReadAt(p, int64(len(data)))
+		assert.EQ(t, err, io.EOF)
+	}
+
+	_, err = zlib.BuildIndex(bytes.NewReader(zsrc.Bytes()[:1000]), 1024)
+	assert.EQ(t, err, io.ErrUnexpectedEOF)
+}
+
+func TestIndexMarshal(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	data := randomText(r, 1<<20)
+	src := compressGzip(t, data[:400000], data[400000:])
+	x, err := zlib.BuildIndex(bytes.NewReader(src), 100000)
+	assert.NoError(t, err)
+	enc, err := x.MarshalBinary()
+	assert.NoError(t, err)
+
+	var y zlib.Index
+	assert.NoError(t, y.UnmarshalBinary(enc))
+	assert.EQ(t, y.Size(), x.Size())
+	assert.EQ(t, y.Len(), x.Len())
+	assert.EQ(t, y.Span(), int64(100000))
+	zr := zlib.NewIndexedReader(bytes.NewReader(src), &y)
+	p := make([]byte, 1000)
+	_, err = zr.ReadAt(p, 500000)
+	assert.EQ(t, err, zlib.ErrIndexUnverified)
+
+	assert.EQ(t, y.Verify(bytes.NewReader(src), int64(len(src)-1)), zlib.ErrIndexMismatch)
+	other := append([]byte(nil), src...)
+	other[len(other)-1]++
+	assert.EQ(t, y.Verify(bytes.NewReader(other), int64(len(other))), zlib.ErrIndexMismatch)
+	assert.NoError(t, y.Verify(bytes.NewReader(src), int64(len(src))))
+	_, err = zr.ReadAt(p, 500000)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(p, data[500000:501000]))
+
+	for i := 0; i < len(enc); i += 997 {
+		bad := append([]byte(nil), enc...)
+		bad[i] ^= 0x10
+		err := y.UnmarshalBinary(bad)
+		assert.True(t, err == zlib.ErrIndexCorrupt || err == zlib.ErrIndexVersion)
+	}
+	assert.EQ(t, y.UnmarshalBinary(enc[:len(enc)-1]), zlib.ErrIndexCorrupt)
+	assert.EQ(t, y.UnmarshalBinary(nil), zlib.ErrIndexCorrupt)
+	bad := append([]byte(nil), enc...)
+	bad[4] = 2
+	assert.EQ(t, y.UnmarshalBinary(bad), zlib.ErrIndexVersion)
+	// Failed loads leave y alone.
+	assert.EQ(t, y.Size(), x.Size())
+}
+
+// bgzfBlock compresses data into a BGZF block.
+func bgzfBlock(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Header.Extra = []byte{'B', 'C', 2, 0, 0, 0}
+	gz.Header.OS = 255
+	_, err := gz.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+	b := buf.Bytes()
+	binary.LittleEndian.PutUint16(b[16:], uint16(len(b)-1))
+	return b
+}
+
+func TestBGZF(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	var (
+		file, data []byte
+		offsets    []int64
+	)
+	for i := 0; i < 10; i++ {
+		chunk := randomText(r, 60000)
+		if i == 5 {
+			chunk = nil
+		}
+		offsets = append(offsets, int64(len(file)))
+		file = append(file, bgzfBlock(t, chunk)...)
+		data = append(data, chunk...)
+	}
+	eof := bgzfBlock(t, nil)
+	file = append(file, eof...)
+
+	br, err := zlib.NewBGZFReader(bytes.NewReader(file))
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(br)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(got, data))
+	assert.EQ(t, br.Tell(), zlib.NewVirtualOffset(int64(len(file)), 0))
+
+	v := zlib.NewVirtualOffset(offsets[3], 1234)
+	assert.EQ(t, v.Compressed(), offsets[3])
+	assert.EQ(t, v.Uncompressed(), 1234)
+	assert.NoError(t, br.Seek(v))
+	assert.EQ(t, br.Tell(), v)
+	p := make([]byte, 100000)
+	_, err = io.ReadFull(br, p)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(p, data[3*60000+1234:][:len(p)]))
+	assert.EQ(t, br.Tell(), zlib.NewVirtualOffset(offsets[4], 3*60000+1234+len(p)-4*60000))
+
+	assert.NotNil(t, br.Seek(zlib.NewVirtualOffset(offsets[3], 60001)))
+	assert.NoError(t, br.Seek(zlib.NewVirtualOffset(int64(len(file)), 0)))
+	_, err = br.Read(p)
+	assert.EQ(t, err, io.EOF)
+	assert.NoError(t, br.Close())
+
+	// Without the EOF marker, the file may have been truncated.
+	br, err = zlib.NewBGZFReader(bytes.NewReader(file[:len(file)-len(eof)]))
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(br)
+	assert.EQ(t, err, io.ErrUnexpectedEOF)
+	assert.NoError(t, br.Close())
+
+	_, err = zlib.NewBGZFReader(bytes.NewReader(compressGzip(t, []byte("hello"))))
+	assert.EQ(t, err, zlib.ErrNotBGZF)
+}
+
+func TestBGZFWriter(t *testing.T) {
+	r := rand.New(rand.NewSource(23))
+	random := make([]byte, 200000)
+	r.Read(random)
+	for _, data := range [][]byte{randomText(r, 300000), random} {
+		for _, blockSize := range []int{0, 10000} {
+			var file bytes.Buffer
+			bw, err := zlib.NewBGZFWriter(&file, 9, blockSize)
+			assert.NoError(t, err)
+			assert.EQ(t, bw.Tell(), zlib.NewVirtualOffset(0, 0))
+			// Write in odd pieces, with a flush in the middle.
+			var offsets []zlib.VirtualOffset
+			for i := 0; i < len(data); i += 7777 {
+				end := i + 7777
+				if end > len(data) {
+					end = len(data)
+				}
+				offsets = append(offsets, bw.Tell())
+				_, err = bw.Write(data[i:end])
+				assert.NoError(t, err)
+				if i == 7777*10 {
+					assert.NoError(t, bw.Flush())
+					assert.EQ(t, bw.Tell().Uncompressed(), 0)
+					assert.EQ(t, bw.Tell().Compressed(), int64(file.Len()))
+				}
+			}
+			assert.NoError(t, bw.Close())
+			assert.NoError(t, bw.Close())
+			_, err = bw.Write(data)
+			assert.EQ(t, err, zlib.ErrWriterClosed)
+			assert.EQ(t, bw.Tell(), zlib.NewVirtualOffset(int64(file.Len()), 0))
+
+			src := file.Bytes()
+			eof := bgzfBlock(t, nil)
+			assert.True(t, bytes.Equal(src[len(src)-len(eof):], eof))
+			assert.True(t, bytes.Equal(src[:16], eof[:16]))
+
+			br, err := zlib.NewBGZFReader(bytes.NewReader(src))
+			assert.NoError(t, err)
+			got, err := ioutil.ReadAll(br)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(got, data))
+			for i, v := range offsets {
+				assert.NoError(t, br.Seek(v))
+				p := make([]byte, 100)
+				n, err := io.ReadFull(br, p)
+				if err != io.ErrUnexpectedEOF {
+					assert.NoError(t, err)
+				}
+				assert.True(t, bytes.Equal(p[:n], data[i*7777:][:n]), i)
+			}
+			assert.NoError(t, br.Close())
+
+			pr, err := zlib.NewParallelBGZFReader(bytes.NewReader(src), 2)
+			assert.NoError(t, err)
+			got, err = ioutil.ReadAll(pr)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(got, data))
+			assert.NoError(t, pr.Close())
+
+			gz, err := gzip.NewReader(bytes.NewReader(src))
+			assert.NoError(t, err)
+			got, err = ioutil.ReadAll(gz)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(got, data))
+		}
+	}
+
+	_, err := zlib.NewBGZFWriter(ioutil.Discard, 6, zlib.BGZFDefaultBlockSize+1)
+	assert.HasSubstr(t, err, "invalid BGZF block size 65281")
+	_, err = zlib.NewBGZFWriter(ioutil.Discard, 10, 0)
+	assert.HasSubstr(t, err, "invalid level 10")
+}
+
+func TestParallelWriter(t *testing.T) {
+	r := rand.New(rand.NewSource(24))
+	random := make([]byte, 300000)
+	r.Read(random)
+	text := randomText(r, 1000000)
+	for _, data := range [][]byte{nil, []byte("x"), text, random} {
+		for _, chunkSize := range []int{0, 1000} {
+			var want []byte
+			for _, workers := range []int{1, 3, 8} {
+				var out bytes.Buffer
+				pw, err := zlib.NewParallelWriter(&out, zlib.ParallelWriterOptions{
+					Workers:   workers,
+					ChunkSize: chunkSize,
+					InFlight:  workers,
+				})
+				assert.NoError(t, err)
+				for i := 0; i < len(data); i += 77777 {
+					end := i + 77777
+					if end > len(data) {
+						end = len(data)
+					}
+					_, err = pw.Write(data[i:end])
+					assert.NoError(t, err)
+				}
+				assert.NoError(t, pw.Close())
+				assert.NoError(t, pw.Close())
+				_, err = pw.Write(data)
+				assert.EQ(t, err, zlib.ErrWriterClosed)
+
+				// The output doesn't depend on the number of workers.
+				if want == nil {
+					want = out.Bytes()
+				} else {
+					assert.True(t, bytes.Equal(out.Bytes(), want), workers)
+				}
+
+				// A single member.
+				gz, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+				assert.NoError(t, err)
+				gz.Multistream(false)
+				got, err := ioutil.ReadAll(gz)
+				assert.NoError(t, err)
+				assert.True(t, bytes.Equal(got, data))
+				_, err = gz.Read(make([]byte, 1))
+				assert.EQ(t, err, io.EOF)
+				zin, err := zlib.NewReader(bytes.NewReader(out.Bytes()))
+				assert.NoError(t, err)
+				got, err = ioutil.ReadAll(zin)
+				assert.NoError(t, err)
+				assert.True(t, bytes.Equal(got, data))
+				assert.EQ(t, zin.MemberCount(), 1)
+				assert.NoError(t, zin.Close())
+			}
+			if chunkSize == 0 && len(data) == len(text) {
+				// The dictionaries keep the ratio close to that of one
+				// stream.
+				var serial bytes.Buffer
+				zout, err := zlib.NewWriter(&serial)
+				assert.NoError(t, err)
+				_, err = zout.Write(data)
+				assert.NoError(t, err)
+				assert.NoError(t, zout.Close())
+				assert.True(t, len(want) < serial.Len()*102/100, len(want), serial.Len())
+			}
+		}
+	}
+
+	pw, err := zlib.NewParallelWriter(&failingWriter{n: 100}, zlib.ParallelWriterOptions{Workers: 2, ChunkSize: 1000, InFlight: 2})
+	assert.NoError(t, err)
+	_, err = pw.Write(text[:100000])
+	assert.EQ(t, err, errFailingWriter)
+	assert.EQ(t, pw.Close(), errFailingWriter)
+
+	_, err = zlib.NewParallelWriter(ioutil.Discard, zlib.ParallelWriterOptions{Level: 10})
+	assert.HasSubstr(t, err, "invalid level 10")
+}
+
+func TestCombineChecksums(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(79)), 1<<20)
+	for _, split := range []int{0, 1, 1000, len(data) - 1, len(data)} {
+		a, b := data[:split], data[split:]
+		assert.EQ(t, zlib.CRC32Combine(crc32.ChecksumIEEE(a), crc32.ChecksumIEEE(b), int64(len(b))),
+			crc32.ChecksumIEEE(data), "split %d", split)
+		assert.EQ(t, zlib.Adler32Combine(adler32.Checksum(a), adler32.Checksum(b), int64(len(b))),
+			adler32.Checksum(data), "split %d", split)
+	}
+	// Combining a neutral value over len2 == 0 leaves the first one as is.
+	assert.EQ(t, zlib.CRC32Combine(0x12345678, 0, 0), uint32(0x12345678))
+	assert.EQ(t, zlib.Adler32Combine(0x12345678, 1, 0), uint32(0x12345678))
+
+	if testing.Short() {
+		t.Skip("skipping the 4GB checksums in short mode")
+	}
+	// Follow the data with more than 4GB of zeros so that len2 overflows 32 bits.
+	zeros := make([]byte, 1<<20)
+	const n = 1<<32 + 1<<20
+	crc := uint32(0)
+	crcAll, adlerAll := crc32.NewIEEE(), adler32.New()
+	crcAll.Write(data)
+	adlerAll.Write(data)
+	for i := 0; i < n/len(zeros); i++ {
+		crc = crc32.Update(crc, crc32.IEEETable, zeros)
+		crcAll.Write(zeros)
+		adlerAll.Write(zeros)
+	}
+	assert.EQ(t, zlib.CRC32Combine(crc32.ChecksumIEEE(data), crc, n), crcAll.Sum32())
+	assert.EQ(t, zlib.Adler32Combine(adler32.Checksum(data), adler32Zeros(n), n), adlerAll.Sum32())
+}
+
+// adler32Zeros returns the Adler-32 of n zero bytes: the byte sum stays at 1
+// and the sum of sums grows by 1 for each byte.
+func adler32Zeros(n int64) uint32 {
+	return uint32(n%65521)<<16 | 1
+}
+
+func TestSyncWriter(t *testing.T) {
+	var out bytes.Buffer
+	zout, err := zlib.NewWriter(&out)
+	assert.NoError(t, err)
+	var sw zlib.Writer = zlib.NewSyncWriter(zout)
+	const goroutines, lines = 8, 500
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < lines; i++ {
+				if _, err := fmt.Fprintf(sw, "goroutine %d line %d\n", g, i); err != nil {
+					panic(err)
+				}
+				if i%50 == 0 {
+					if err := sw.Flush(); err != nil {
+						panic(err)
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.NoError(t, sw.Close())
+	gz, err := gzip.NewReader(&out)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	// Each Write comes out whole, and the lines of a goroutine in order.
+	next := make([]int, goroutines)
+	for _, line := range bytes.Split(bytes.TrimSuffix(got, []byte("\n")), []byte("\n")) {
+		var g, i int
+		_, err := fmt.Sscanf(string(line), "goroutine %d line %d", &g, &i)
+		assert.NoError(t, err, line)
+		assert.EQ(t, i, next[g], line)
+		next[g]++
+	}
+	for g := range next {
+		assert.EQ(t, next[g], lines)
+	}
+
+	// Close waits for the Writes in progress, and the later ones fail.
+	out.Reset()
+	assert.NoError(t, sw.Reset(&out))
+	line := bytes.Repeat([]byte("x"), 999)
+	line = append(line, '\n')
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if _, err := sw.Write(line); err != nil {
+					if err != zlib.ErrWriterClosed {
+						panic(err)
+					}
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, sw.Close())
+	wg.Wait()
+	gz, err = gzip.NewReader(&out)
+	assert.NoError(t, err)
+	got, err = ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.True(t, len(got) > 0)
+	assert.EQ(t, len(got)%len(line), 0)
+}
+
+func TestAsyncWriter(t *testing.T) {
+	r := rand.New(rand.NewSource(81))
+	text := randomText(r, 1000000)
+	for _, opts := range []zlib.AsyncWriterOptions{
+		{},
+		{ChunkSize: 1000, Buffers: 1, Writer: zlib.WriterOptions{BufferSize: 100}},
+		{ChunkSize: 100000, Buffers: 4, Writer: zlib.WriterOptions{Level: 9, Deterministic: true}},
+	} {
+		// The output is that of a Writer with the same writes and flushes.
+		var want, got bytes.Buffer
+		zout, err := zlib.NewWriterOpts(&want, opts.Writer)
+		assert.NoError(t, err)
+		aw, err := zlib.NewAsyncWriter(&got, opts)
+		assert.NoError(t, err)
+		for i := 0; i < len(text); {
+			n := r.Intn(50000)
+			if i+n > len(text) {
+				n = len(text) - i
+			}
+			chunk := append([]byte(nil), text[i:i+n]...)
+			_, err = zout.Write(chunk)
+			assert.NoError(t, err)
+			_, err = aw.Write(chunk)
+			assert.NoError(t, err)
+			// The writer copies the input, so it may be reused right away.
+			copy(chunk, "garbage")
+			i += n
+			if r.Intn(10) == 0 {
+				assert.NoError(t, zout.Flush())
+				assert.NoError(t, aw.Flush())
+				assert.True(t, bytes.Equal(got.Bytes(), want.Bytes()))
+			}
+		}
+		assert.NoError(t, zout.Close())
+		assert.NoError(t, aw.Close())
+		assert.NoError(t, aw.Close())
+		_, err = aw.Write(text)
+		assert.EQ(t, err, zlib.ErrWriterClosed)
+		assert.EQ(t, aw.Flush(), zlib.ErrWriterClosed)
+		assert.True(t, bytes.Equal(got.Bytes(), want.Bytes()))
+		gz, err := gzip.NewReader(&got)
+		assert.NoError(t, err)
+		data, err := ioutil.ReadAll(gz)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(data, text))
+	}
+
+	// Errors of the underlying writer surface in Write, Flush and Close.
+	random := make([]byte, 1<<20)
+	r.Read(random)
+	aw, err := zlib.NewAsyncWriter(&failingWriter{n: 100}, zlib.AsyncWriterOptions{})
+	assert.NoError(t, err)
+	i := 0
+	for ; i < 1000; i++ {
+		if _, err = aw.Write(random); err != nil {
+			break
+		}
+	}
+	assert.EQ(t, err, errFailingWriter)
+	assert.True(t, i < 1000)
+	assert.EQ(t, aw.Flush(), errFailingWriter)
+	assert.EQ(t, aw.Close(), errFailingWriter)
+	assert.EQ(t, aw.Close(), errFailingWriter)
+
+	aw, err = zlib.NewAsyncWriter(&failingWriter{n: 5}, zlib.AsyncWriterOptions{})
+	assert.NoError(t, err)
+	_, err = aw.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.EQ(t, aw.Flush(), errFailingWriter)
+
+	sink := &writeCloseRecorder{Writer: ioutil.Discard}
+	aw, err = zlib.NewAsyncWriter(sink, zlib.AsyncWriterOptions{Writer: zlib.WriterOptions{CloseUnderlying: true}})
+	assert.NoError(t, err)
+	assert.NoError(t, aw.Close())
+	assert.NoError(t, aw.Close())
+	assert.EQ(t, sink.closed, 1)
+
+	_, err = zlib.NewAsyncWriter(ioutil.Discard, zlib.AsyncWriterOptions{Writer: zlib.WriterOptions{Level: 10}})
+	assert.HasSubstr(t, err, "invalid level 10")
+}
+
+// stdDecompress decodes a stream of format f with the standard library.
+func stdDecompress(t *testing.T, f zlib.Format, stream []byte) []byte {
+	var zin io.Reader
+	var err error
+	switch f {
+	case zlib.FormatGzip:
+		zin, err = gzip.NewReader(bytes.NewReader(stream))
+	case zlib.FormatZlib:
+		zin, err = stdzlib.NewReader(bytes.NewReader(stream))
+	default:
+		zin = flate.NewReader(bytes.NewReader(stream))
+	}
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	if data == nil {
+		data = []byte{}
+	}
+	return data
+}
+
+func TestCompress(t *testing.T) {
+	r := rand.New(rand.NewSource(96))
+	text := randomText(r, 30000)
+	random := make([]byte, 30000)
+	r.Read(random)
+	for _, src := range [][]byte{nil, []byte("a"), text, random} {
+		for _, f := range []zlib.Format{zlib.FormatGzip, zlib.FormatZlib, zlib.FormatRaw} {
+			for level := zlib.HuffmanOnly; level <= zlib.BestCompression; level++ {
+				var want bytes.Buffer
+				zout, err := zlib.NewWriterOpts(&want, zlib.WriterOptions{Format: f, Level: level, Store: level == 0})
+				assert.NoError(t, err)
+				_, err = zout.Write(src)
+				assert.NoError(t, err)
+				assert.NoError(t, zout.Close())
+				got, err := zlib.CompressFormat([]byte("prefix"), src, f, level)
+				assert.NoError(t, err)
+				assert.EQ(t, string(got[:6]), "prefix")
+				assert.EQ(t, stdDecompress(t, f, got[6:]), src, "format %d, level %d", f, level)
+				// Apart from the stored blocks of level 0, which Close ends
+				// with an empty one, the output is that of a writer.
+				if level != zlib.NoCompression {
+					assert.EQ(t, got[6:], want.Bytes(), "format %d, level %d", f, level)
+				}
+			}
+		}
+	}
+	got, err := zlib.Compress(nil, text, zlib.DefaultCompression)
+	assert.NoError(t, err)
+	assert.EQ(t, stdDecompress(t, zlib.FormatGzip, got), text)
+
+	// With room for the bound in dst, the output goes there without
+	// allocating.
+	dst := make([]byte, 0, zlib.CompressBound(len(text))+12)
+	got, err = zlib.Compress(dst, text, zlib.DefaultCompression)
+	assert.NoError(t, err)
+	assert.True(t, &got[:1][0] == &dst[:1][0])
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := zlib.Compress(dst, text[:1000], zlib.DefaultCompression); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.EQ(t, allocs, 0.0)
+
+	_, err = zlib.Compress(nil, text, 10)
+	assert.EQ(t, err.Error(), "zlib: invalid level 10")
+	_, err = zlib.CompressFormat(nil, text, zlib.FormatAuto, 1)
+	assert.EQ(t, err.Error(), "zlib: invalid format 3")
+}
+
+func TestDecompress(t *testing.T) {
+	r := rand.New(rand.NewSource(97))
+	text := randomText(r, 300000)
+	random := make([]byte, 30000)
+	r.Read(random)
+	for _, src := range [][]byte{[]byte("a"), text, random} {
+		for _, f := range []zlib.Format{zlib.FormatGzip, zlib.FormatZlib, zlib.FormatRaw} {
+			stream, err := zlib.CompressFormat(nil, src, f, zlib.DefaultCompression)
+			assert.NoError(t, err)
+			got, err := zlib.DecompressFormat([]byte("prefix"), stream, f)
+			assert.NoError(t, err)
+			assert.EQ(t, string(got[:6]), "prefix")
+			assert.EQ(t, got[6:], src, "format %d", f)
+			// From a nil dst, and into a dst too small, which grows.
+			got, err = zlib.DecompressFormat(nil, stream, f)
+			assert.NoError(t, err)
+			assert.EQ(t, got, src, "format %d", f)
+			got, err = zlib.DecompressFormat(make([]byte, 0, 10), stream, f)
+			assert.NoError(t, err)
+			assert.EQ(t, got, src, "format %d", f)
+			if f != zlib.FormatRaw {
+				got, err = zlib.DecompressFormat(nil, stream, zlib.FormatAuto)
+				assert.NoError(t, err)
+				assert.EQ(t, got, src, "format %d", f)
+			}
+		}
+	}
+	got, err := zlib.Decompress(nil, nil)
+	assert.NoError(t, err)
+	assert.EQ(t, len(got), 0)
+	// A member of empty data, whose ISIZE is 0.
+	empty, err := zlib.Compress(nil, nil, zlib.DefaultCompression)
+	assert.NoError(t, err)
+	got, err = zlib.Decompress(nil, empty)
+	assert.NoError(t, err)
+	assert.EQ(t, len(got), 0)
+	got, err = zlib.Decompress(nil, append(empty, "abc"...))
+	assert.EQ(t, err, zlib.ErrHeader)
+
+	// All the members of a gzip file, whose ISIZE only tells the size of the
+	// last one.
+	var stream []byte
+	for i := 0; i < 3; i++ {
+		stream, err = zlib.Compress(stream, text[:100000*(3-i)], zlib.BestSpeed)
+		assert.NoError(t, err)
+	}
+	got, err = zlib.Decompress(nil, stream)
+	assert.NoError(t, err)
+	assert.EQ(t, got, append(append(text[:300000:300000], text[:200000]...), text[:100000]...))
+
+	// With room in dst, it doesn't allocate.
+	stream, err = zlib.Compress(nil, text, zlib.DefaultCompression)
+	assert.NoError(t, err)
+	dst := make([]byte, 0, len(text))
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := zlib.Decompress(dst, stream); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.EQ(t, allocs, 0.0)
+
+	// The errors are those of a reader.
+	corrupt := func(i int) []byte {
+		b := append([]byte(nil), stream...)
+		b[i] ^= 1
+		return b
+	}
+	for _, test := range []struct {
+		src []byte
+		err error
+	}{
+		{corrupt(0), zlib.ErrHeader},
+		{corrupt(len(stream) - 8), zlib.ErrChecksum},
+		{corrupt(len(stream) - 4), zlib.ErrSize},
+		{stream[:len(stream)-1], io.ErrUnexpectedEOF},
+		{stream[:len(stream)/2], io.ErrUnexpectedEOF},
+		{append(stream[:len(stream):len(stream)], "garbage"...), zlib.ErrHeader},
+	} {
+		got, err := zlib.Decompress([]byte("prefix"), test.src)
+		assert.EQ(t, err, test.err)
+		assert.EQ(t, string(got), "prefix")
+		zin, err := zlib.NewReader(bytes.NewReader(test.src))
+		assert.NoError(t, err)
+		_, err = ioutil.ReadAll(zin)
+		assert.EQ(t, err, test.err)
+	}
+	var buf bytes.Buffer
+	zout, err := zlib.NewWriterDict(&buf, zlib.DefaultCompression, 0, []byte("alpha beta"))
+	assert.NoError(t, err)
+	_, err = zout.Write(text[:1000])
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+	_, err = zlib.DecompressFormat(nil, buf.Bytes(), zlib.FormatZlib)
+	assert.EQ(t, err, zlib.ErrDictionaryRequired)
+	_, err = zlib.DecompressFormat(nil, stream, zlib.Format(4))
+	assert.EQ(t, err.Error(), "zlib: invalid format 4")
+}
+
+func TestDecompressWithSize(t *testing.T) {
+	text := randomText(rand.New(rand.NewSource(98)), 300000)
+	stream, err := zlib.Compress(nil, text, zlib.DefaultCompression)
+	assert.NoError(t, err)
+	calls := runtime.NumCgoCall()
+	got, err := zlib.DecompressWithSize([]byte("prefix"), stream, len(text))
+	assert.NoError(t, err)
+	// Besides creating the zlib state, a single cgo call.
+	assert.LE(t, runtime.NumCgoCall()-calls, int64(2))
+	assert.EQ(t, string(got[:6]), "prefix")
+	assert.EQ(t, got[6:], text)
+	// It allocates exactly the room for size bytes.
+	assert.EQ(t, cap(got), 6+len(text))
+
+	dst := make([]byte, 0, len(text))
+	calls = runtime.NumCgoCall()
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := zlib.DecompressWithSize(dst, stream, len(text)); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.EQ(t, allocs, 0.0)
+	assert.LE(t, runtime.NumCgoCall()-calls, int64(110))
+
+	for _, test := range []struct {
+		src  []byte
+		size int
+		err  error
+	}{
+		{stream, len(text) - 1, zlib.ErrShortBuffer},
+		{stream, 0, zlib.ErrShortBuffer},
+		{stream, len(text) + 1, zlib.ErrSizeMismatch},
+		{nil, 1, zlib.ErrSizeMismatch},
+		{stream[:len(stream)-1], len(text), io.ErrUnexpectedEOF},
+		{stream[:len(stream)/2], len(text), io.ErrUnexpectedEOF},
+		// The checksum is verified whatever the size.
+		{append(stream[:len(stream)-8:len(stream)-8], 0, 0, 0, 0, 0xe0, 0x93, 0x04, 0), len(text), zlib.ErrChecksum},
+	} {
+		got, err := zlib.DecompressWithSize([]byte("prefix"), test.src, test.size)
+		assert.EQ(t, err, test.err, "size %d", test.size)
+		assert.EQ(t, string(got), "prefix")
+	}
+	_, err = zlib.DecompressWithSize(nil, stream, -1)
+	assert.EQ(t, err.Error(), "zlib: invalid size -1")
+
+	// Empty members and multiple members.
+	empty, err := zlib.Compress(nil, nil, zlib.DefaultCompression)
+	assert.NoError(t, err)
+	got, err = zlib.DecompressWithSize(nil, empty, 0)
+	assert.NoError(t, err)
+	assert.EQ(t, len(got), 0)
+	multi := append(append(stream[:len(stream):len(stream)], empty...), stream...)
+	got, err = zlib.DecompressWithSize(nil, multi, 2*len(text))
+	assert.NoError(t, err)
+	assert.EQ(t, got, append(text[:len(text):len(text)], text...))
+	_, err = zlib.DecompressWithSize(nil, multi, len(text))
+	assert.EQ(t, err, zlib.ErrShortBuffer)
+}
+
+// TestAppendRandom is a randomized test of AppendCompress and
+// AppendDecompress against compress/gzip, on inputs of random sizes and
+// contents, at random levels, and on corrupted streams. It stands in for a
+// fuzz test, which go 1.13 has no native support for; the seed is fixed so
+// that failures reproduce.
+func TestAppendRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(99))
+	iterations := 300
+	if testing.Short() {
+		iterations = 50
+	}
+	var dst []byte
+	for i := 0; i < iterations; i++ {
+		src := make([]byte, r.Intn(1<<uint(r.Intn(18))))
+		switch r.Intn(3) {
+		case 0:
+			r.Read(src)
+		case 1:
+			copy(src, randomText(r, len(src)))
+		default:
+			// Long runs.
+			for j := range src {
+				src[j] = byte(j / 1000)
+			}
+		}
+		level := zlib.HuffmanOnly + r.Intn(zlib.BestCompression-zlib.HuffmanOnly+1)
+		prefix := randomText(r, r.Intn(10))
+
+		// Reuse dst as callers do.
+		var err error
+		dst, err = zlib.AppendCompress(append(dst[:0], prefix...), src, level)
+		assert.NoError(t, err)
+		assert.EQ(t, dst[:len(prefix)], prefix)
+		stream := append([]byte(nil), dst[len(prefix):]...)
+		assert.EQ(t, stdDecompress(t, zlib.FormatGzip, stream), src, "level %d, size %d", level, len(src))
+
+		var std bytes.Buffer
+		zout, err := gzip.NewWriterLevel(&std, level)
+		assert.NoError(t, err)
+		_, err = zout.Write(src)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+		dst, err = zlib.AppendDecompress(append(dst[:0], prefix...), std.Bytes())
+		assert.NoError(t, err)
+		assert.EQ(t, dst[:len(prefix)], prefix)
+		assert.EQ(t, dst[len(prefix):], src, "level %d, size %d", level, len(src))
+
+		// A corrupt stream decodes as with compress/gzip, or both fail.
+		for j := r.Intn(3); j >= 0; j-- {
+			stream[r.Intn(len(stream))] ^= byte(1 + r.Intn(255))
+		}
+		if r.Intn(4) == 0 {
+			stream = stream[:r.Intn(len(stream))]
+		}
+		got, err := zlib.AppendDecompress(append(dst[:0], prefix...), stream)
+		want, stdErr := gunzipStd(stream)
+		assert.EQ(t, err == nil, stdErr == nil, "errors %v and %v", err, stdErr)
+		if err == nil {
+			assert.EQ(t, got[len(prefix):], want)
+		} else {
+			assert.EQ(t, got, prefix)
+		}
+	}
+	got, err := zlib.AppendCompress([]byte("prefix"), []byte("data"), 10)
+	assert.EQ(t, err.Error(), "zlib: invalid level 10")
+	assert.EQ(t, got, []byte("prefix"))
+}
+
+// gunzipStd decodes a gzip file with compress/gzip.
+func gunzipStd(stream []byte) ([]byte, error) {
+	if len(stream) == 0 {
+		return []byte{}, nil
+	}
+	zin, err := gzip.NewReader(bytes.NewReader(stream))
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(zin)
+	if data == nil {
+		data = []byte{}
+	}
+	return data, err
+}
+
+func TestGzipBytes(t *testing.T) {
+	text := randomText(rand.New(rand.NewSource(100)), 200000)
+	for _, src := range [][]byte{nil, []byte("a"), text} {
+		for _, level := range []int{zlib.HuffmanOnly, zlib.NoCompression, zlib.BestSpeed, zlib.DefaultCompression, zlib.BestCompression} {
+			out, err := zlib.GzipBytes(src, level)
+			assert.NoError(t, err)
+			assert.EQ(t, cap(out), len(out))
+			assert.EQ(t, stdDecompress(t, zlib.FormatGzip, out), append([]byte{}, src...), "level %d", level)
+			got, err := zlib.GunzipBytes(out)
+			assert.NoError(t, err)
+			assert.EQ(t, len(got), len(src))
+			assert.EQ(t, got, src[:len(got):len(got)], "level %d", level)
+		}
+	}
+	out, err := zlib.GzipBytes(text, zlib.DefaultCompression)
+	assert.NoError(t, err)
+	if gunzip, err := exec.LookPath("gunzip"); err == nil {
+		cmd := exec.Command(gunzip, "-c")
+		cmd.Stdin = bytes.NewReader(out)
+		got, err := cmd.Output()
+		assert.NoError(t, err)
+		assert.EQ(t, got, text)
+	}
+
+	// Concatenated members, such as those of compress/gzip.
+	var std bytes.Buffer
+	zout := gzip.NewWriter(&std)
+	_, err = zout.Write(text[:1000])
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+	got, err := zlib.GunzipBytes(append(out, std.Bytes()...))
+	assert.NoError(t, err)
+	assert.EQ(t, got, append(text[:len(text):len(text)], text[:1000]...))
+
+	_, err = zlib.GunzipBytes(out[:len(out)-1])
+	assert.EQ(t, err, io.ErrUnexpectedEOF)
+	_, err = zlib.GunzipBytes([]byte("not gzip"))
+	assert.EQ(t, err, zlib.ErrHeader)
+	_, err = zlib.GzipBytes(text, 10)
+	assert.EQ(t, err.Error(), "zlib: invalid level 10")
+}
+
+// dictzipFile compresses data into a dictzip file with chunks of chunkLen
+// bytes.
+func dictzipFile(t *testing.T, data []byte, chunkLen int) []byte {
+	var body bytes.Buffer
+	var sizes []int
+	for off := 0; off < len(data); off += chunkLen {
+		end := off + chunkLen
+		if end > len(data) {
+			end = len(data)
+		}
+		n := body.Len()
+		fw, err := flate.NewWriter(&body, flate.BestCompression)
+		assert.NoError(t, err)
+		_, err = fw.Write(data[off:end])
+		assert.NoError(t, err)
+		if end == len(data) {
+			assert.NoError(t, fw.Close())
+		} else {
+			assert.NoError(t, fw.Flush())
+		}
+		sizes = append(sizes, body.Len()-n)
+	}
+	ra := []byte{'R', 'A', 0, 0, 1, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(ra[2:], uint16(6+2*len(sizes)))
+	binary.LittleEndian.PutUint16(ra[6:], uint16(chunkLen))
+	binary.LittleEndian.PutUint16(ra[8:], uint16(len(sizes)))
+	for _, s := range sizes {
+		ra = append(ra, byte(s), byte(s>>8))
+	}
+	file := []byte{0x1f, 0x8b, 8, 4 | 8, 0, 0, 0, 0, 2, 3, byte(len(ra)), byte(len(ra) >> 8)}
+	file = append(file, ra...)
+	file = append(file, "dict.txt\x00"...)
+	file = append(file, body.Bytes()...)
+	var trailer [8]byte
+	binary.LittleEndian.PutUint32(trailer[:], crc32.ChecksumIEEE(data))
+	binary.LittleEndian.PutUint32(trailer[4:], uint32(len(data)))
+	return append(file, trailer[:]...)
+}
+
+func TestDictzip(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	data := randomText(r, 1000000)
+	file := dictzipFile(t, data, 58315)
+
+	// It's a valid gzip file too.
+	zin, err := zlib.NewReader(bytes.NewReader(file))
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(got, data))
+	assert.EQ(t, zin.Header().Name, "dict.txt")
+	assert.NoError(t, zin.Close())
+
+	for _, src := range [][]byte{file, compressGzip(t, data)} {
+		d, err := zlib.NewDictzipReader(bytes.NewReader(src), int64(len(src)))
+		assert.NoError(t, err)
+		assert.EQ(t, d.RandomAccess(), len(src) == len(file))
+		for i := 0; i < 20; i++ {
+			off := r.Intn(len(data))
+			p := make([]byte, r.Intn(150000))
+			n, err := d.ReadAt(p, int64(off))
+			if off+len(p) > len(data) {
+				assert.EQ(t, err, io.EOF)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.True(t, bytes.Equal(p[:n], data[off:off+n]))
+		}
+		n, err := d.ReadAt(make([]byte, 10), int64(len(data)))
+		assert.EQ(t, n, 0)
+		assert.EQ(t, err, io.EOF)
+	}
+
+	_, err = zlib.NewDictzipReader(bytes.NewReader([]byte("plain")), 5)
+	assert.EQ(t, err, zlib.ErrHeader)
+}
+
+func TestInflatePassthrough(t *testing.T) {
+	plain := []byte("just some text, not compressed")
+	gz := compressGzip(t, []byte("compressed"))
+	var zbuf bytes.Buffer
+	zw := stdzlib.NewWriter(&zbuf)
+	_, err := zw.Write([]byte("zlib"))
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+
+	zin, err := zlib.NewReaderOpts(iotest.OneByteReader(bytes.NewReader(plain)), zlib.ReaderOptions{Passthrough: true})
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, got, plain)
+	assert.True(t, zin.Passthrough())
+	assert.EQ(t, zin.OutputBytes(), int64(len(plain)))
+
+	// The decision is made again for each stream.
+	for _, tc := range []struct {
+		src  []byte
+		want string
+	}{
+		{gz, "compressed"},
+		{[]byte{0x1f}, "\x1f"},
+		{zbuf.Bytes(), string(zbuf.Bytes())},
+		{plain, string(plain)},
+	} {
+		assert.NoError(t, zin.Reset(iotest.OneByteReader(bytes.NewReader(tc.src))))
+		got, err = ioutil.ReadAll(zin)
+		if len(tc.src) == 1 {
+			// A lone 0x1f might start a gzip header.
+			assert.EQ(t, err, io.ErrUnexpectedEOF)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.EQ(t, string(got), tc.want)
+		assert.EQ(t, zin.Passthrough(), tc.want == string(tc.src))
+	}
+	assert.NoError(t, zin.Close())
+
+	zin, err = zlib.NewReaderOpts(bytes.NewReader(zbuf.Bytes()), zlib.ReaderOptions{Format: zlib.FormatAuto, Passthrough: true})
+	assert.NoError(t, err)
+	got, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), "zlib")
+	assert.False(t, zin.Passthrough())
+	assert.NoError(t, zin.Close())
+
+	// Without the option, plain input is an error.
+	zin, err = zlib.NewReader(bytes.NewReader(plain))
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zin)
+	assert.EQ(t, err, zlib.ErrHeader)
+
+	// Buffered sources are read in exact mode, where sniffing only peeks at
+	// their input. The one-byte reader makes sniff read twice.
+	long := randomText(rand.New(rand.NewSource(5)), 19000)
+	for _, tc := range []struct {
+		name string
+		in   func(b []byte) io.Reader
+	}{
+		{"bufio", func(b []byte) io.Reader { return bufio.NewReader(bytes.NewReader(b)) }},
+		{"buffer", func(b []byte) io.Reader { return bytes.NewBuffer(b) }},
+		{"onebyte", func(b []byte) io.Reader { return bufio.NewReaderSize(iotest.OneByteReader(bytes.NewReader(b)), 16) }},
+	} {
+		for _, src := range [][]byte{long, plain, gz} {
+			zin, err = zlib.NewReaderOpts(tc.in(src), zlib.ReaderOptions{Passthrough: true})
+			assert.NoError(t, err, tc.name)
+			got, err = ioutil.ReadAll(zin)
+			assert.NoError(t, err, tc.name)
+			if zin.Passthrough() {
+				assert.EQ(t, got, src, tc.name)
+			} else {
+				assert.EQ(t, string(got), "compressed", tc.name)
+			}
+			assert.NoError(t, zin.Close(), tc.name)
+		}
+		// The source is left right after the stream.
+		in := tc.in(append(gz[:len(gz):len(gz)], plain...))
+		zin, err = zlib.NewReaderOpts(in, zlib.ReaderOptions{Passthrough: true})
+		assert.NoError(t, err, tc.name)
+		zin.Multistream(false)
+		got, err = ioutil.ReadAll(zin)
+		assert.NoError(t, err, tc.name)
+		assert.EQ(t, string(got), "compressed", tc.name)
+		got, err = ioutil.ReadAll(in)
+		assert.NoError(t, err, tc.name)
+		assert.EQ(t, got, plain, tc.name)
+		assert.NoError(t, zin.Close(), tc.name)
+	}
+}
+
+func TestSniff(t *testing.T) {
+	gz := compressGzip(t, []byte("gzip"))
+	var zbuf bytes.Buffer
+	zw := stdzlib.NewWriter(&zbuf)
+	_, err := zw.Write([]byte("zlib"))
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+
+	for _, tc := range []struct {
+		src    []byte
+		format zlib.Format
+		ok     bool
+	}{
+		{gz, zlib.FormatGzip, true},
+		{zbuf.Bytes(), zlib.FormatZlib, true},
+		{[]byte("plain text"), zlib.FormatAuto, false},
+		{[]byte("p"), zlib.FormatAuto, false},
+		{nil, zlib.FormatAuto, false},
+	} {
+		f, ok, rest, err := zlib.Sniff(iotest.OneByteReader(bytes.NewReader(tc.src)))
+		assert.NoError(t, err)
+		assert.EQ(t, f, tc.format)
+		assert.EQ(t, ok, tc.ok)
+		got, err := ioutil.ReadAll(rest)
+		assert.NoError(t, err)
+		assert.EQ(t, len(got), len(tc.src))
+		assert.True(t, bytes.Equal(got, tc.src))
+		if !ok {
+			continue
+		}
+		zin, err := zlib.NewReaderOpts(bytes.NewReader(got), zlib.ReaderOptions{Format: f})
+		assert.NoError(t, err)
+		_, err = ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		assert.NoError(t, zin.Close())
+	}
+
+	_, _, rest, err := zlib.Sniff(iotest.TimeoutReader(iotest.OneByteReader(bytes.NewReader(gz))))
+	assert.EQ(t, err, iotest.ErrTimeout)
+	b, _ := ioutil.ReadAll(rest)
+	// The byte read before the error is kept.
+	assert.True(t, bytes.Equal(b, gz))
+}
+
+// emptyGzip is the output of printf ” | gzip -n.
+var emptyGzip = []byte{
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03,
+	0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+// noEmptyReads fails the test if Read returns no data and no error.
+type noEmptyReads struct {
+	t *testing.T
+	r io.Reader
+}
+
+func (r noEmptyReads) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n == 0 && err == nil {
+		r.t.Fatal("empty read")
+	}
+	return n, err
+}
+
+func TestInflateEmptyMembers(t *testing.T) {
+	// The EOF marker of bgzip is an empty member too.
+	bgzfEOF := bgzfBlock(t, nil)
+	var src []byte
+	for _, m := range [][]byte{
+		emptyGzip, compressGzip(t, []byte("a")), emptyGzip, bgzfEOF, emptyGzip,
+		bgzfBlock(t, []byte("b")), emptyGzip, bgzfEOF,
+	} {
+		src = append(src, m...)
+	}
+	zin, err := zlib.NewReader(bytes.NewReader(src))
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(noEmptyReads{t, zin})
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), "ab")
+	assert.EQ(t, zin.MemberCount(), 8)
+	assert.EQ(t, zin.UncompressedSize(), int64(0))
+
+	// Only empty members.
+	assert.NoError(t, zin.Reset(bytes.NewReader(append(append([]byte{}, emptyGzip...), emptyGzip...))))
+	got, err = ioutil.ReadAll(noEmptyReads{t, zin})
+	assert.NoError(t, err)
+	assert.EQ(t, len(got), 0)
+	assert.EQ(t, zin.MemberCount(), 2)
+
+	// One member at a time.
+	assert.NoError(t, zin.Reset(bytes.NewReader(src)))
+	zin.Multistream(false)
+	var sizes []int
+	for ok := true; ok; ok, err = zin.NextMember() {
+		got, err = ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		sizes = append(sizes, len(got))
+	}
+	assert.NoError(t, err)
+	assert.EQ(t, sizes, []int{0, 1, 0, 0, 0, 1, 0, 0})
+	assert.NoError(t, zin.Close())
+}
+
+func TestInflateHeaderCRC(t *testing.T) {
+	src := compressGzip(t, []byte("hello"))
+	// Set FHCRC and insert the CRC16 of the 10-byte header.
+	hdr := append([]byte(nil), src[:10]...)
+	hdr[3] |= 2
+	crc := crc32.ChecksumIEEE(hdr)
+	withCRC := append(append(hdr, byte(crc), byte(crc>>8)), src[10:]...)
+
+	zin, err := zlib.NewReader(bytes.NewReader(withCRC))
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), "hello")
+	assert.True(t, zin.Header().HeaderCRC)
+
+	withCRC[10]++
+	assert.NoError(t, zin.Reset(bytes.NewReader(withCRC)))
+	_, err = ioutil.ReadAll(zin)
+	assert.EQ(t, err, zlib.ErrHeaderChecksum)
+
+	assert.NoError(t, zin.Reset(bytes.NewReader(src)))
+	_, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.False(t, zin.Header().HeaderCRC)
+	assert.NoError(t, zin.Close())
+}
+
+func TestDeflateHeaderCRC(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(91)), 10000)
+	for _, h := range []zlib.Header{
+		{HeaderCRC: true},
+		{Name: "crc.txt", Comment: "with FHCRC", Extra: []byte("ab\x02\x00xy"), OS: 3, ModTime: time.Unix(1e9, 0), HeaderCRC: true},
+	} {
+		var out bytes.Buffer
+		zout, err := zlib.NewWriter(&out)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.SetHeader(h))
+		_, err = zout.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+		b := out.Bytes()
+		assert.EQ(t, b[3]&2, byte(2))
+
+		// Both readers verify the CRC16.
+		zin, err := zlib.NewReader(bytes.NewReader(b))
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(got, data))
+		assert.True(t, zin.Header().HeaderCRC)
+		assert.EQ(t, zin.Header().Name, h.Name)
+		assert.NoError(t, zin.Close())
+		gz, err := gzip.NewReader(bytes.NewReader(b))
+		assert.NoError(t, err)
+		got, err = ioutil.ReadAll(gz)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(got, data))
+
+		// The CRC16 covers the whole header, which ends right before it.
+		hdrLen := 10
+		if h.Extra != nil {
+			hdrLen += 2 + len(h.Extra)
+		}
+		if h.Name != "" {
+			hdrLen += len(h.Name) + 1
+		}
+		if h.Comment != "" {
+			hdrLen += len(h.Comment) + 1
+		}
+		crc := crc32.ChecksumIEEE(b[:hdrLen])
+		assert.EQ(t, binary.LittleEndian.Uint16(b[hdrLen:]), uint16(crc))
+		b[hdrLen]++
+		zin, err = zlib.NewReader(bytes.NewReader(b))
+		assert.NoError(t, err)
+		_, err = ioutil.ReadAll(zin)
+		assert.EQ(t, err, zlib.ErrHeaderChecksum)
+		assert.EQ(t, zin.Close(), zlib.ErrHeaderChecksum)
+	}
+
+	// It is off by default.
+	var out bytes.Buffer
+	zout, err := zlib.NewWriter(&out)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.SetHeader(zlib.Header{Name: "x"}))
+	assert.NoError(t, zout.Close())
+	assert.EQ(t, out.Bytes()[3]&2, byte(0))
+}
+
+// zlibSmallWindow compresses data into a zlib stream with a window of
+// 1<<bits bytes. The header declares a window of 1<<headerBits bytes.
+func zlibSmallWindow(t *testing.T, data []byte, bits, headerBits int) []byte {
+	var raw bytes.Buffer
+	seg := 1 << uint(bits)
+	for off := 0; off < len(data); off += seg {
+		end := off + seg
+		if end > len(data) {
+			end = len(data)
+		}
+		// A fresh compressor can't refer to the previous segments.
+		fw, err := flate.NewWriter(&raw, flate.BestCompression)
+		assert.NoError(t, err)
+		_, err = fw.Write(data[off:end])
+		assert.NoError(t, err)
+		if end == len(data) {
+			assert.NoError(t, fw.Close())
+		} else {
+			assert.NoError(t, fw.Flush())
+		}
+	}
+	cmf := byte(headerBits-8)<<4 | 8
+	flg := byte(31 - (int(cmf)<<8)%31)
+	out := append([]byte{cmf, flg}, raw.Bytes()...)
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], adler32.Checksum(data))
+	return append(out, sum[:]...)
+}
+
+func TestInflateWindowBits(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	data := randomText(r, 100000)
+	small := zlibSmallWindow(t, data, 10, 10)
+	for _, bits := range []int{10, 15} {
+		zin, err := zlib.NewReaderOpts(bytes.NewReader(small), zlib.ReaderOptions{Format: zlib.FormatZlib, WindowBits: bits})
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(got, data))
+		assert.NoError(t, zin.Close())
+	}
+	large := zlibSmallWindow(t, data, 10, 15)
+	zin, err := zlib.NewReaderOpts(bytes.NewReader(large), zlib.ReaderOptions{Format: zlib.FormatZlib, WindowBits: 10})
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zin)
+	assert.EQ(t, err, zlib.ErrWindowTooSmall)
+	assert.EQ(t, zin.Close(), zlib.ErrWindowTooSmall)
+
+	// gzip doesn't record the window size.
+	zin, err = zlib.NewReaderOpts(bytes.NewReader(compressGzip(t, data)), zlib.ReaderOptions{WindowBits: 9})
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zin)
+	assert.EQ(t, err, zlib.ErrWindowTooSmall)
+	assert.EQ(t, zin.Close(), zlib.ErrWindowTooSmall)
+
+	for _, bits := range []int{-1, 7, 16} {
+		_, err = zlib.NewReaderOpts(bytes.NewReader(nil), zlib.ReaderOptions{WindowBits: bits})
+		assert.NotNil(t, err)
+	}
+}
+
+// closeRecorder records calls to Close.
+type closeRecorder struct {
+	io.Reader
+	closed int
+	err    error
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed++
+	return c.err
+}
+
+func TestInflateCloseUnderlying(t *testing.T) {
+	src := compressGzip(t, []byte("hello"))
+	in := &closeRecorder{Reader: bytes.NewReader(src)}
+	zin, err := zlib.NewReader(in)
+	assert.NoError(t, err)
+	assert.NoError(t, zin.Close())
+	assert.EQ(t, in.closed, 0)
+
+	errClose := errors.New("close failed")
+	in = &closeRecorder{Reader: bytes.NewReader(src), err: errClose}
+	zin, err = zlib.NewReaderOpts(in, zlib.ReaderOptions{CloseUnderlying: true})
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, zin.Close(), errClose)
+	assert.EQ(t, zin.Close(), errClose)
+	assert.EQ(t, in.closed, 1)
+
+	// A decoding error takes precedence.
+	in = &closeRecorder{Reader: bytes.NewReader(src[:10]), err: errClose}
+	zin, err = zlib.NewReaderOpts(in, zlib.ReaderOptions{CloseUnderlying: true})
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zin)
+	assert.EQ(t, err, io.ErrUnexpectedEOF)
+	assert.EQ(t, zin.Close(), io.ErrUnexpectedEOF)
+	assert.EQ(t, in.closed, 1)
+
+	// Sources that can't be closed are fine.
+	zin, err = zlib.NewReaderOpts(bytes.NewReader(src), zlib.ReaderOptions{CloseUnderlying: true})
+	assert.NoError(t, err)
+	assert.NoError(t, zin.Close())
+}
+
+func TestParallelBGZF(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	var file, data []byte
+	for i := 0; i < 100; i++ {
+		chunk := randomText(r, r.Intn(65536))
+		file = append(file, bgzfBlock(t, chunk)...)
+		data = append(data, chunk...)
+	}
+	file = append(file, bgzfBlock(t, nil)...)
+
+	for _, workers := range []int{0, 1, 3} {
+		pr, err := zlib.NewParallelBGZFReader(iotest.HalfReader(bytes.NewReader(file)), workers)
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(pr)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(got, data))
+		assert.NoError(t, pr.Close())
+		_, err = pr.Read(make([]byte, 1))
+		assert.EQ(t, err, zlib.ErrReaderClosed)
+	}
+
+	// A corrupt block stops the pipeline.
+	bad := append([]byte(nil), file...)
+	bad[len(bad)/2] ^= 0xff
+	pr, err := zlib.NewParallelBGZFReader(bytes.NewReader(bad), 4)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(pr)
+	assert.NotNil(t, err)
+	assert.True(t, bytes.Equal(got, data[:len(got)]))
+	_, err2 := pr.Read(make([]byte, 1))
+	assert.EQ(t, err2, err)
+	assert.EQ(t, pr.Close(), err)
+
+	// Truncated files and files that aren't BGZF.
+	pr, err = zlib.NewParallelBGZFReader(bytes.NewReader(file[:len(file)-28]), 2)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(pr)
+	assert.EQ(t, err, io.ErrUnexpectedEOF)
+	pr.Close()
+	pr, err = zlib.NewParallelBGZFReader(bytes.NewReader(compressGzip(t, data[:100])), 2)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(pr)
+	assert.EQ(t, err, zlib.ErrNotBGZF)
+	pr.Close()
+
+	// Closing early doesn't leak the goroutines.
+	pr, err = zlib.NewParallelBGZFReader(bytes.NewReader(file), 2)
+	assert.NoError(t, err)
+	_, err = pr.Read(make([]byte, 10))
+	assert.NoError(t, err)
+	assert.NoError(t, pr.Close())
+}
+
+// dataTimeoutReader returns the last chunk of r together with errTimeout.
+type dataTimeoutReader struct {
+	r io.Reader
+}
+
+var errTimeout = errors.New("timeout")
+
+func (r dataTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	if n > 0 && r.r.(*bytes.Reader).Len() == 0 {
+		return n, errTimeout
+	}
+	return n, err
+}
+
+func TestInflateDataWithError(t *testing.T) {
+	src := compressGzip(t, bytes.Repeat([]byte("data and error "), 1000))
+
+	// DataErrReader returns io.EOF along with the last chunk.
+	zin, err := zlib.NewReaderBuffer(iotest.DataErrReader(bytes.NewReader(src)), 100)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, len(got), 15000)
+
+	// The error comes after the decoded chunk that came with it.
+	for _, bufSize := range []int{100, 1 << 20} {
+		zin, err = zlib.NewReaderBuffer(dataTimeoutReader{bytes.NewReader(src[:len(src)-4])}, bufSize)
+		assert.NoError(t, err)
+		got, err = ioutil.ReadAll(zin)
+		assert.EQ(t, err, errTimeout)
+		assert.EQ(t, len(got), 15000)
+		assert.EQ(t, zin.InputBytes(), int64(len(src)-4))
+	}
+
+	// Also when the error comes with the first bytes of a passthrough stream.
+	zin, err = zlib.NewReaderOpts(dataTimeoutReader{bytes.NewReader([]byte("p"))}, zlib.ReaderOptions{Passthrough: true})
+	assert.NoError(t, err)
+	got, err = ioutil.ReadAll(zin)
+	assert.EQ(t, err, errTimeout)
+	assert.EQ(t, string(got), "p")
+}
+
+func TestInflateTruncatedPartialRead(t *testing.T) {
+	data := bytes.Repeat([]byte("partial block "), 100)
+	src := gzipFlushed(t, data, data)
+	// Cut the stream inside the second block.
+	src = src[:len(src)*3/4]
+
+	zin, err := zlib.NewReader(bytes.NewReader(src))
+	assert.NoError(t, err)
+	buf := make([]byte, 4*len(data))
+	n, err := zin.Read(buf)
+	assert.NoError(t, err)
+	assert.True(t, n > len(data))
+	assert.True(t, bytes.Equal(buf[:len(data)], data))
+
+	// The error comes on the next call, and stays.
+	for i := 0; i < 2; i++ {
+		n, err = zin.Read(buf)
+		assert.EQ(t, n, 0)
+		assert.EQ(t, err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestInflateSkipChecksum(t *testing.T) {
+	data := []byte("trusted data")
+	gz := compressGzip(t, data, data)
+	var zbuf bytes.Buffer
+	zw := stdzlib.NewWriter(&zbuf)
+	_, err := zw.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+
+	for _, tc := range []struct {
+		src    []byte
+		format zlib.Format
+		want   error
+	}{
+		{gz, zlib.FormatGzip, zlib.ErrChecksum},
+		{gz, zlib.FormatAuto, zlib.ErrChecksum},
+		{zbuf.Bytes(), zlib.FormatZlib, zlib.ErrChecksum},
+	} {
+		bad := append([]byte(nil), tc.src...)
+		// The CRC-32 of the first gzip member, or the Adler-32.
+		if tc.format == zlib.FormatZlib {
+			bad[len(bad)-1]++
+		} else {
+			bad[len(gz)/2-8]++
+		}
+		zin, err := zlib.NewReaderOpts(bytes.NewReader(bad), zlib.ReaderOptions{Format: tc.format})
+		assert.NoError(t, err)
+		_, err = ioutil.ReadAll(zin)
+		assert.EQ(t, err, tc.want)
+
+		zin, err = zlib.NewReaderOpts(bytes.NewReader(bad), zlib.ReaderOptions{Format: tc.format, SkipChecksum: true})
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		assert.EQ(t, len(got)%len(data), 0)
+		// Reset keeps the setting.
+		assert.NoError(t, zin.Reset(bytes.NewReader(bad)))
+		_, err = ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		assert.NoError(t, zin.Close())
+	}
+
+	_, err = zlib.NewReaderOpts(bytes.NewReader(nil), zlib.ReaderOptions{Format: zlib.FormatRaw, SkipChecksum: true})
+	assert.NotNil(t, err)
+}
+
+// cancelWriter cancels a context on the first Write.
+type cancelWriter struct {
+	cancel context.CancelFunc
+	n      int
+}
+
+func (w *cancelWriter) Write(p []byte) (int, error) {
+	w.cancel()
+	w.n += len(p)
+	return len(p), nil
+}
+
+func TestInflateContext(t *testing.T) {
+	data := bytes.Repeat([]byte("context "), 1<<18)
+	src := compressGzip(t, data)
+
+	var buf bytes.Buffer
+	n, err := zlib.CopyContext(context.Background(), &buf, bytes.NewReader(src))
+	assert.NoError(t, err)
+	assert.EQ(t, n, int64(len(data)))
+	assert.True(t, bytes.Equal(buf.Bytes(), data))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &cancelWriter{cancel: cancel}
+	n, err = zlib.CopyContext(ctx, w, bytes.NewReader(src))
+	assert.EQ(t, err, context.Canceled)
+	assert.EQ(t, n, int64(w.n))
+	assert.LT(t, n, int64(len(data)))
+
+	zin, err := zlib.NewReaderOpts(bytes.NewReader(src), zlib.ReaderOptions{Context: ctx})
+	assert.NoError(t, err)
+	_, err = zin.Read(make([]byte, 10))
+	assert.EQ(t, err, context.Canceled)
+	assert.EQ(t, zin.Close(), context.Canceled)
+}
+
+func TestErrorMsg(t *testing.T) {
+	src := gzipFlushed(t, bytes.Repeat([]byte("reason "), 100))
+	// Turn the first deflate block into one of the reserved type.
+	src[10] |= 0x06
+	zin, err := zlib.NewReader(bytes.NewReader(src))
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zin)
+	assert.EQ(t, err.Error(), "zlib: data error: invalid block type")
+	var zerr *zlib.Error
+	assert.True(t, errors.As(err, &zerr))
+	assert.EQ(t, zerr.Code, -3)
+	assert.EQ(t, zerr.Msg, "invalid block type")
+
+	// Without a message from zlib.
+	assert.EQ(t, (&zlib.Error{Code: -3}).Error(), "zlib: data error")
+	assert.EQ(t, (&zlib.Error{Code: -42}).Error(), "zlib: unknown error -42")
+
+}
+
+func TestInflateExactInput(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(2)), 200000)
+	footer := []byte("footer after the stream")
+	src := append(compressGzip(t, data, data), footer...)
+	member := len(compressGzip(t, data))
+
+	for _, tc := range []struct {
+		name  string
+		exact bool
+		in    func(b []byte) io.Reader
+	}{
+		{"seeker", false, func(b []byte) io.Reader { return bytes.NewReader(b) }},
+		{"bufio", false, func(b []byte) io.Reader { return bufio.NewReaderSize(bytes.NewReader(b), 1<<16) }},
+		{"buffer", false, func(b []byte) io.Reader { return bytes.NewBuffer(b) }},
+		{"bytereader", true, func(b []byte) io.Reader {
+			r := bytes.NewReader(b)
+			return struct {
+				io.Reader
+				io.ByteReader
+			}{r, r}
+		}},
+		{"option", true, func(b []byte) io.Reader { return struct{ io.Reader }{bytes.NewReader(b)} }},
+		{"pipe", true, func(b []byte) io.Reader {
+			// An os.File that fails Seek.
+			r, w, err := os.Pipe()
+			assert.NoError(t, err)
+			go func() {
+				w.Write(b)
+				w.Close()
+			}()
+			return r
+		}},
+	} {
+		in := tc.in(src)
+		zin, err := zlib.NewReaderOpts(in, zlib.ReaderOptions{ExactInput: tc.exact})
+		assert.NoError(t, err, tc.name)
+		zin.Multistream(false)
+		got, err := ioutil.ReadAll(zin)
+		assert.NoError(t, err, tc.name)
+		assert.True(t, bytes.Equal(got, data), tc.name)
+		// The source continues with the second member.
+		next := make([]byte, 2)
+		_, err = io.ReadFull(in, next)
+		assert.NoError(t, err, tc.name)
+		assert.EQ(t, next, src[member:member+2], tc.name)
+
+		// The next member is read from the source again.
+		in = tc.in(src)
+		assert.NoError(t, zin.Reset(in), tc.name)
+		zin.Multistream(false)
+		_, _, err = zin.Drain()
+		assert.NoError(t, err, tc.name)
+		ok, err := zin.NextMember()
+		assert.NoError(t, err, tc.name)
+		assert.True(t, ok, tc.name)
+		got, err = ioutil.ReadAll(zin)
+		assert.NoError(t, err, tc.name)
+		assert.True(t, bytes.Equal(got, data), tc.name)
+		assert.EQ(t, zin.InputBytes(), int64(2*member)+int64(len(zin.Remaining())), tc.name)
+		rest, err := ioutil.ReadAll(in)
+		assert.NoError(t, err, tc.name)
+		assert.EQ(t, rest, footer, tc.name)
+		assert.NoError(t, zin.Close(), tc.name)
+	}
+}
+
 func testDeflate(t *testing.T, r *rand.Rand, src []byte) {
 	orgSrc := src
 	out := bytes.Buffer{}
 	zout, err := zlib.NewWriter(&out)
 	assert.NoError(t, err)
 
-	for len(src) > 0 {
-		n := r.Intn(8192)
-		if n > len(src) {
-			n = len(src)
+	for len(src) > 0 {
+		n := r.Intn(8192)
+		if n > len(src) {
+			n = len(src)
+		}
+		n2, err := zout.Write(src[:n])
+		assert.NoError(t, err)
+		assert.EQ(t, n, n2)
+		src = src[n:]
+	}
+	assert.NoError(t, zout.Close())
+
+	got := bytes.Buffer{}
+	zin, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+	assert.NoError(t, err)
+	n, err := io.Copy(&got, zin)
+	assert.NoError(t, err)
+	assert.EQ(t, int(n), len(orgSrc))
+	if !bytes.Equal(got.Bytes(), orgSrc) {
+		t.Fatal("fail")
+	}
+}
+
+func TestDeflateRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for i := 0; i < 20; i++ {
+		n := r.Intn(16 << 20)
+		log.Printf("%d: n=%d", i, n)
+		data := make([]byte, n)
+		_, err := r.Read(data)
+		assert.NoError(t, err)
+		testDeflate(t, r, data)
+	}
+}
+
+func TestDeflateFlush(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	data := make([]byte, 16<<20)
+	_, err := r.Read(data)
+	assert.NoError(t, err)
+
+	writtenData := data
+	out := bytes.Buffer{}
+	zout, err := zlib.NewWriter(&out)
+	assert.NoError(t, err)
+
+	for len(writtenData) > 0 {
+		n := r.Intn(8192)
+		if n > len(writtenData) {
+			n = len(writtenData)
+		}
+		n2, err := zout.Write(writtenData[:n])
+		assert.NoError(t, err)
+		assert.EQ(t, n, n2)
+		writtenData = writtenData[n:]
+		assert.NoError(t, zout.Flush())
+	}
+	assert.NoError(t, zout.Close())
+
+	got := bytes.Buffer{}
+	zin, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+	assert.NoError(t, err)
+	n, err := io.Copy(&got, zin)
+	assert.NoError(t, err)
+	assert.EQ(t, int(n), len(data))
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Fatal("fail")
+	}
+}
+
+func TestDeflateReset(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	data := make([]byte, 16<<20)
+	_, err := r.Read(data)
+	assert.NoError(t, err)
+
+	out := bytes.Buffer{}
+	zout, err := zlib.NewWriter(&out)
+	assert.NoError(t, err)
+	_, err = zout.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+
+	// Reset for second run
+	_, err = r.Read(data)
+	assert.NoError(t, err)
+	out = bytes.Buffer{}
+	assert.NoError(t, zout.Reset(&out))
+	_, err = zout.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+
+	got := bytes.Buffer{}
+	zin, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+	assert.NoError(t, err)
+	n, err := io.Copy(&got, zin)
+	assert.NoError(t, err)
+	assert.EQ(t, int(n), len(data))
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Fatal("fail")
+	}
+}
+
+func TestDeflateClose(t *testing.T) {
+	var out bytes.Buffer
+	zout, err := zlib.NewWriter(&out)
+	assert.NoError(t, err)
+	_, err = zout.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+	n := out.Len()
+
+	// The stream is freed; nothing touches it any more.
+	_, err = zout.Write([]byte("late"))
+	assert.True(t, errors.Is(err, zlib.ErrWriterClosed))
+	assert.True(t, errors.Is(zout.Flush(), zlib.ErrWriterClosed))
+	assert.NoError(t, zout.Close())
+	assert.EQ(t, out.Len(), n)
+	runtime.GC()
+
+	// With a deferred Close on top of the explicit one, the stream is written
+	// once.
+	var deferred bytes.Buffer
+	func() {
+		zout, err := zlib.NewWriter(&deferred)
+		assert.NoError(t, err)
+		defer zout.Close()
+		_, err = zout.Write([]byte("hello"))
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+	}()
+	runtime.GC()
+	assert.True(t, bytes.Equal(deferred.Bytes(), out.Bytes()))
+
+	// Reset allocates it again.
+	var out2 bytes.Buffer
+	assert.NoError(t, zout.Reset(&out2))
+	_, err = zout.Write([]byte("again"))
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+	zin, err := gzip.NewReader(&out2)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), "again")
+}
+
+func TestDeflateStickyError(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(0)).Read(data)
+	w := &failingWriter{n: 10000}
+	zout, err := zlib.NewWriterLevel(w, -1, 4096)
+	assert.NoError(t, err)
+	_, err = zout.Write(data)
+	assert.EQ(t, err, errFailingWriter)
+
+	// The writer would accept more now, but the stream is already broken.
+	w.n = len(data)
+	_, err = zout.Write(data)
+	assert.EQ(t, err, errFailingWriter)
+	assert.EQ(t, zout.Flush(), errFailingWriter)
+	assert.EQ(t, zout.Close(), errFailingWriter)
+	assert.EQ(t, zout.Close(), errFailingWriter)
+	_, err = zout.Write(data)
+	assert.EQ(t, err, zlib.ErrWriterClosed)
+	assert.EQ(t, w.n, len(data))
+
+	// Reset clears the error, and the input left over from the failure.
+	var out bytes.Buffer
+	assert.NoError(t, zout.Reset(&out))
+	_, err = zout.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+	zin, err := gzip.NewReader(&out)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(got, data))
+
+	// Also without Close in between.
+	w.n = 10000
+	assert.NoError(t, zout.Reset(w))
+	_, err = zout.Write(data)
+	assert.EQ(t, err, errFailingWriter)
+	out.Reset()
+	assert.NoError(t, zout.Reset(&out))
+	_, err = zout.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+	zin, err = gzip.NewReader(&out)
+	assert.NoError(t, err)
+	got, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(got, data))
+}
+
+func TestDeflateResetPool(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(3)), 100000)
+	compress := func(zout zlib.Writer) []byte {
+		var out bytes.Buffer
+		assert.NoError(t, zout.Reset(&out))
+		_, err := zout.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+		return out.Bytes()
+	}
+	fresh, err := zlib.NewWriterLevel(ioutil.Discard, 6, 4096)
+	assert.NoError(t, err)
+	want := compress(fresh)
+
+	pool := sync.Pool{New: func() interface{} {
+		zout, err := zlib.NewWriterLevel(ioutil.Discard, 6, 4096)
+		assert.NoError(t, err)
+		return zout
+	}}
+	for i := 0; i < 3; i++ {
+		zout := pool.Get().(zlib.Writer)
+		// Whatever the last user left behind, Reset starts over.
+		assert.True(t, bytes.Equal(compress(zout), want))
+		switch i {
+		case 0:
+			assert.NoError(t, zout.Reset(&failingWriter{n: 10}))
+			zout.Write(data)
+			assert.EQ(t, zout.Flush(), errFailingWriter)
+		case 1:
+			assert.NoError(t, zout.Reset(ioutil.Discard))
+			_, err = zout.Write(data[:100])
+			assert.NoError(t, err)
+		}
+		pool.Put(zout)
+	}
+}
+
+func TestDeflateHeader(t *testing.T) {
+	h := zlib.Header{
+		Name:    "r\u00e9sum\u00e9.txt",
+		Comment: "comment",
+		ModTime: time.Unix(1500000000, 0),
+		Extra:   []byte("BC\x02\x00\x00\x00"),
+		OS:      3,
+	}
+	var out bytes.Buffer
+	zout, err := zlib.NewWriter(&out)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.SetHeader(h))
+	_, err = zout.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NotNil(t, zout.SetHeader(h))
+	assert.NoError(t, zout.Close())
+
+	gz, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+	assert.NoError(t, err)
+	assert.EQ(t, gz.Name, h.Name)
+	assert.EQ(t, gz.Comment, h.Comment)
+	assert.True(t, gz.ModTime.Equal(h.ModTime))
+	assert.EQ(t, gz.Extra, h.Extra)
+	assert.EQ(t, gz.OS, byte(3))
+	got, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), "hello")
+
+	// Reset restores the default header; the modification time is truncated
+	// to 32 bits like in compress/gzip.
+	out.Reset()
+	assert.NoError(t, zout.Reset(&out))
+	assert.NoError(t, zout.SetHeader(zlib.Header{ModTime: time.Unix(1<<32+5, 0)}))
+	assert.NoError(t, zout.Close())
+	gz, err = gzip.NewReader(bytes.NewReader(out.Bytes()))
+	assert.NoError(t, err)
+	assert.EQ(t, gz.Name, "")
+	assert.Nil(t, gz.Extra)
+	assert.EQ(t, gz.ModTime.Unix(), int64(5))
+
+	out.Reset()
+	assert.NoError(t, zout.Reset(&out))
+	assert.NoError(t, zout.Close())
+	gz, err = gzip.NewReader(bytes.NewReader(out.Bytes()))
+	assert.NoError(t, err)
+	assert.EQ(t, gz.Name, "")
+	assert.True(t, gz.ModTime.IsZero())
+
+	assert.NoError(t, zout.Reset(&out))
+	assert.HasSubstr(t, zout.SetHeader(zlib.Header{Name: "\u4e16"}), "Latin-1")
+	assert.HasSubstr(t, zout.SetHeader(zlib.Header{Comment: "a\x00b"}), "Latin-1")
+	assert.HasSubstr(t, zout.SetHeader(zlib.Header{Extra: make([]byte, 1<<16)}), "too large")
+	assert.NoError(t, zout.Close())
+}
+
+func TestDeflateDeterministic(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(4)), 300000)
+	compress := func(level int) []byte {
+		var out bytes.Buffer
+		zout, err := zlib.NewWriterDeterministic(&out, level, 4096)
+		assert.NoError(t, err)
+		_, err = zout.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+		return out.Bytes()
+	}
+	for _, level := range []int{1, 6, 9} {
+		a, b := compress(level), compress(level)
+		assert.True(t, bytes.Equal(a, b), level)
+		// No MTIME, XFL 0 whatever the level, OS unknown.
+		assert.EQ(t, a[:10], []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255}, level)
+		gz, err := gzip.NewReader(bytes.NewReader(a))
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(gz)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(got, data))
+	}
+
+	// Also after Reset, with the header written one byte at a time.
+	var out bytes.Buffer
+	zout, err := zlib.NewWriterDeterministic(&out, 9, 1)
+	assert.NoError(t, err)
+	assert.NotNil(t, zout.SetHeader(zlib.Header{Name: "name"}))
+	assert.NoError(t, zout.Close())
+	out.Reset()
+	assert.NoError(t, zout.Reset(&out))
+	_, err = zout.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+	assert.True(t, bytes.Equal(out.Bytes(), compress(9)))
+}
+
+func TestDeflateRaw(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(5)), 100000)
+	var out bytes.Buffer
+	zout, err := zlib.NewWriterRaw(&out, 6, 4096)
+	assert.NoError(t, err)
+	assert.NotNil(t, zout.SetHeader(zlib.Header{Name: "name"}))
+	_, err = zout.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+	// flate reads exactly up to the end of the final block from a
+	// bytes.Reader.
+	in := bytes.NewReader(out.Bytes())
+	got, err := ioutil.ReadAll(flate.NewReader(in))
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(got, data))
+	assert.EQ(t, in.Len(), 0)
+
+	// As the compressor of a zip archive.
+	var zbuf bytes.Buffer
+	zw := zip.NewWriter(&zbuf)
+	zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		return zlib.NewWriterRaw(w, 6, 4096)
+	})
+	f, err := zw.Create("data.txt")
+	assert.NoError(t, err)
+	_, err = f.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+	zr, err := zip.NewReader(bytes.NewReader(zbuf.Bytes()), int64(zbuf.Len()))
+	assert.NoError(t, err)
+	rc, err := zr.File[0].Open()
+	assert.NoError(t, err)
+	got, err = ioutil.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(got, data))
+	assert.NoError(t, rc.Close())
+}
+
+func TestDeflateZlib(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(6)), 100000)
+	var out bytes.Buffer
+	zout, err := zlib.NewWriterZlib(&out, 6, 4096)
+	assert.NoError(t, err)
+	assert.NotNil(t, zout.SetHeader(zlib.Header{Name: "name"}))
+	for i := 0; i < 2; i++ {
+		out.Reset()
+		assert.NoError(t, zout.Reset(&out))
+		_, err = zout.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Flush())
+		_, err = zout.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+
+		zin, err := stdzlib.NewReader(bytes.NewReader(out.Bytes()))
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(got, append(data, data...)))
+		assert.EQ(t, binary.BigEndian.Uint32(out.Bytes()[out.Len()-4:]), adler32.Checksum(got))
+	}
+}
+
+func TestDeflateStrategy(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(7)), 100000)
+	sizes := map[zlib.Strategy]int{}
+	for _, strategy := range []zlib.Strategy{
+		zlib.StrategyDefault, zlib.StrategyFiltered, zlib.StrategyHuffmanOnly, zlib.StrategyRLE, zlib.StrategyFixed,
+	} {
+		var out bytes.Buffer
+		zout, err := zlib.NewWriterStrategy(&out, 6, strategy, 4096)
+		assert.NoError(t, err)
+		_, err = zout.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+		sizes[strategy] = out.Len()
+		gz, err := gzip.NewReader(&out)
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(gz)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(got, data), strategy)
+	}
+	// Text is full of long matches.
+	assert.True(t, sizes[zlib.StrategyDefault] < sizes[zlib.StrategyHuffmanOnly])
+	assert.True(t, sizes[zlib.StrategyDefault] < sizes[zlib.StrategyRLE])
+
+	_, err := zlib.NewWriterStrategy(ioutil.Discard, 6, zlib.StrategyFixed+1, 4096)
+	assert.HasSubstr(t, err, "invalid strategy 5")
+	_, err = zlib.NewWriterStrategy(ioutil.Discard, 6, -1, 4096)
+	assert.HasSubstr(t, err, "invalid strategy -1")
+}
+
+func TestDeflateWindow(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(8)), 100000)
+	var out bytes.Buffer
+	zout, err := zlib.NewWriterWindow(&out, 6, 9, 1, 4096)
+	assert.NoError(t, err)
+	_, err = zout.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+	gz, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(got, data))
+	// A reader with the same window decodes it.
+	zin, err := zlib.NewReaderOpts(bytes.NewReader(out.Bytes()), zlib.ReaderOptions{WindowBits: 9})
+	assert.NoError(t, err)
+	got, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(got, data))
+
+	for _, bad := range [][2]int{{8, 8}, {16, 8}, {15, 10}, {15, -1}} {
+		_, err = zlib.NewWriterWindow(ioutil.Discard, 6, bad[0], bad[1], 4096)
+		assert.NotNil(t, err, bad)
+	}
+	assert.EQ(t, zlib.DeflateMemory(0, 0), 128<<10+128<<10+6<<10)
+	assert.EQ(t, zlib.DeflateMemory(9, 1), 2<<10+1<<10+6<<10)
+}
+
+func TestDeflateOpts(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(9)), 100000)
+	compress := func(zout zlib.Writer, err error) []byte {
+		assert.NoError(t, err)
+		var out bytes.Buffer
+		assert.NoError(t, zout.Reset(&out))
+		_, err = zout.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+		return out.Bytes()
+	}
+	// The zero value means the defaults.
+	want := compress(zlib.NewWriter(ioutil.Discard))
+	assert.True(t, bytes.Equal(compress(zlib.NewWriterOpts(ioutil.Discard, zlib.WriterOptions{})), want))
+	assert.True(t, bytes.Equal(compress(zlib.NewWriterLevel(ioutil.Discard, -1, 0)), want))
+	assert.True(t, bytes.Equal(compress(zlib.NewWriterOpts(ioutil.Discard, zlib.WriterOptions{Level: 6, WindowBits: 15, MemLevel: 8})), want))
+
+	stored := compress(zlib.NewWriterOpts(ioutil.Discard, zlib.WriterOptions{Store: true}))
+	assert.True(t, len(stored) > len(data))
+	assert.True(t, bytes.Equal(compress(zlib.NewWriterLevel(ioutil.Discard, 0, 0)), stored))
+	gz, err := gzip.NewReader(bytes.NewReader(stored))
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(got, data))
+
+	// All the problems are reported together.
+	_, err = zlib.NewWriterOpts(ioutil.Discard, zlib.WriterOptions{
+		Format:     zlib.FormatAuto,
+		Level:      10,
+		WindowBits: 8,
+		MemLevel:   10,
+		BufferSize: -1,
+	})
+	assert.EQ(t, err.Error(), "zlib: invalid format 3, invalid level 10, invalid window bits 8, invalid mem level 10, invalid buffer size -1")
+	_, err = zlib.NewWriterOpts(ioutil.Discard, zlib.WriterOptions{Format: zlib.FormatRaw, Store: true, Level: 1, Deterministic: true})
+	assert.EQ(t, err.Error(), "zlib: level 1 with Store, Deterministic without FormatGzip")
+}
+
+func TestDeflateDict(t *testing.T) {
+	dict := []byte(`{"type":"event","version":2,"source":"checkout","payload":{"user_id":`)
+	msg := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"type":"event","version":2,"source":"checkout","payload":{"user_id":%d}}`, i))
+	}
+	var out bytes.Buffer
+	zout, err := zlib.NewWriterDict(&out, 9, 0, dict)
+	assert.NoError(t, err)
+	plain, err := zlib.NewWriterZlib(ioutil.Discard, 9, 0)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		// Pooled writers keep the dictionary across Reset.
+		out.Reset()
+		assert.NoError(t, zout.Reset(&out))
+		_, err = zout.Write(msg(i))
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+		src := append([]byte(nil), out.Bytes()...)
+
+		zr, err := stdzlib.NewReaderDict(bytes.NewReader(src), dict)
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(zr)
+		assert.NoError(t, err)
+		assert.EQ(t, got, msg(i))
+
+		zin, err := zlib.NewReaderDict(bytes.NewReader(src), dict, 4096)
+		assert.NoError(t, err)
+		got, err = ioutil.ReadAll(zin)
+		assert.NoError(t, err)
+		assert.EQ(t, got, msg(i))
+		assert.EQ(t, zin.DictID(), adler32.Checksum(dict))
+		assert.NoError(t, zin.Close())
+
+		var plainOut bytes.Buffer
+		assert.NoError(t, plain.Reset(&plainOut))
+		_, err = plain.Write(msg(i))
+		assert.NoError(t, err)
+		assert.NoError(t, plain.Close())
+		assert.True(t, len(src) < plainOut.Len())
+	}
+
+	out.Reset()
+	zout, err = zlib.NewWriterOpts(&out, zlib.WriterOptions{Format: zlib.FormatRaw, Dictionary: dict})
+	assert.NoError(t, err)
+	_, err = zout.Write(msg(7))
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+	got, err := ioutil.ReadAll(flate.NewReaderDict(bytes.NewReader(out.Bytes()), dict))
+	assert.NoError(t, err)
+	assert.EQ(t, got, msg(7))
+
+	_, err = zlib.NewWriterOpts(ioutil.Discard, zlib.WriterOptions{Dictionary: dict})
+	assert.EQ(t, err.Error(), "zlib: Dictionary with FormatGzip")
+}
+
+func TestDeflateSetParams(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(10)), 300000)
+	for _, bufSize := range []int{64, 4096, 0} {
+		var out bytes.Buffer
+		zout, err := zlib.NewWriterLevel(&out, 1, bufSize)
+		assert.NoError(t, err)
+		// Before any input, nothing is flushed and the header can still be
+		// set.
+		assert.NoError(t, zout.SetParams(1, zlib.StrategyDefault))
+		assert.NoError(t, zout.SetHeader(zlib.Header{Name: "params"}))
+		_, err = zout.Write(data[:100000])
+		assert.NoError(t, err)
+		assert.NoError(t, zout.SetParams(9, zlib.StrategyDefault))
+		_, err = zout.Write(data[100000:200000])
+		assert.NoError(t, err)
+		assert.NoError(t, zout.SetParams(0, zlib.StrategyHuffmanOnly))
+		_, err = zout.Write(data[200000:])
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+
+		// A single member.
+		gz, err := gzip.NewReader(&out)
+		assert.NoError(t, err)
+		assert.EQ(t, gz.Name, "params")
+		gz.Multistream(false)
+		got, err := ioutil.ReadAll(gz)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(got, data), bufSize)
+		assert.EQ(t, out.Len(), 0)
+
+		assert.EQ(t, zout.SetParams(6, zlib.StrategyDefault), zlib.ErrWriterClosed)
+	}
+
+	zout, err := zlib.NewWriterLevel(ioutil.Discard, 1, 0)
+	assert.NoError(t, err)
+	assert.HasSubstr(t, zout.SetParams(10, zlib.StrategyDefault), "invalid level 10")
+	assert.HasSubstr(t, zout.SetParams(6, zlib.StrategyFixed+1), "invalid strategy 5")
+	assert.NoError(t, zout.Close())
+
+	// Failing to flush is sticky. The writer accepts the gzip header only.
+	zout, err = zlib.NewWriterLevel(&failingWriter{n: 10}, 1, 0)
+	assert.NoError(t, err)
+	_, err = zout.Write(data[:100])
+	assert.NoError(t, err)
+	assert.EQ(t, zout.SetParams(9, zlib.StrategyDefault), errFailingWriter)
+	_, err = zout.Write(data)
+	assert.EQ(t, err, errFailingWriter)
+}
+
+func TestDeflateFlushMode(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(11)), 200000)
+	const chunk = 30000
+	for _, mode := range []zlib.FlushMode{zlib.FlushSync, zlib.FlushFull, zlib.FlushPartial, zlib.FlushBlock} {
+		for _, bufSize := range []int{64, 0} {
+			var out bytes.Buffer
+			zout, err := zlib.NewWriterLevel(&out, 6, bufSize)
+			assert.NoError(t, err)
+			var restarts []int
+			for i := 0; i < len(data); i += chunk {
+				end := i + chunk
+				if end > len(data) {
+					end = len(data)
+				}
+				_, err = zout.Write(data[i:end])
+				assert.NoError(t, err)
+				assert.NoError(t, zout.FlushMode(mode))
+				// Flushing again without input is a no-op.
+				n := out.Len()
+				assert.NoError(t, zout.FlushMode(mode))
+				assert.EQ(t, out.Len(), n)
+				restarts = append(restarts, n)
+				if mode == zlib.FlushBlock {
+					// The output may end in the middle of a byte.
+					continue
+				}
+				// All the output for the input so far has been written,
+				// even if it is larger than outBuf.
+				gz, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+				assert.NoError(t, err)
+				got, err := ioutil.ReadAll(gz)
+				assert.EQ(t, err, io.ErrUnexpectedEOF)
+				assert.True(t, bytes.Equal(got, data[:end]), mode, bufSize, end)
+			}
+			assert.NoError(t, zout.Close())
+			gz, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+			assert.NoError(t, err)
+			got, err := ioutil.ReadAll(gz)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(got, data), mode, bufSize)
+
+			if mode == zlib.FlushFull {
+				// Decoding can start right after a full flush, without the
+				// data before it.
+				const trailerSize = 8
+				src := out.Bytes()[restarts[2] : out.Len()-trailerSize]
+				got, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(src)))
+				assert.NoError(t, err)
+				assert.True(t, bytes.Equal(got, data[3*chunk:]), bufSize)
+			}
+			assert.EQ(t, zout.FlushMode(mode), zlib.ErrWriterClosed)
+		}
+	}
+
+	zout, err := zlib.NewWriter(ioutil.Discard)
+	assert.NoError(t, err)
+	assert.HasSubstr(t, zout.FlushMode(zlib.FlushBlock+1), "invalid flush mode 4")
+	assert.NoError(t, zout.FullFlush())
+	assert.NoError(t, zout.Close())
+}
+
+func TestDeflatePending(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(12)), 100000)
+	var out bytes.Buffer
+	zout, err := zlib.NewWriterLevel(&out, 6, 0)
+	assert.NoError(t, err)
+	nBytes, nBits := zout.Pending()
+	assert.EQ(t, nBytes, 0)
+	assert.EQ(t, nBits, 0)
+	for i := 0; i < 3; i++ {
+		_, err = zout.Write(data)
+		assert.NoError(t, err)
+		// Write drains the output, except for the bits of a partial byte.
+		nBytes, nBits = zout.Pending()
+		assert.EQ(t, nBytes, 0)
+		assert.True(t, nBits >= 0 && nBits < 8, nBits)
+		assert.NoError(t, zout.Flush())
+		nBytes, nBits = zout.Pending()
+		assert.EQ(t, nBytes, 0)
+		assert.EQ(t, nBits, 0)
+	}
+
+	// A flush that stops short of writing everything leaves output pending.
+	zout, err = zlib.NewWriterLevel(&failingWriter{n: 100}, 6, 64)
+	assert.NoError(t, err)
+	_, err = zout.Write(data[:10000])
+	assert.NoError(t, err)
+	assert.EQ(t, zout.Flush(), errFailingWriter)
+	nBytes, _ = zout.Pending()
+	assert.True(t, nBytes > 0, nBytes)
+
+	assert.NoError(t, zout.Reset(ioutil.Discard))
+	assert.NoError(t, zout.Close())
+	nBytes, nBits = zout.Pending()
+	assert.EQ(t, nBytes, 0)
+	assert.EQ(t, nBits, 0)
+}
+
+func TestDeflateBound(t *testing.T) {
+	assert.EQ(t, zlib.CompressBound(0), 13)
+	r := rand.New(rand.NewSource(13))
+	random := make([]byte, 100000)
+	r.Read(random)
+	for _, data := range [][]byte{nil, random[:1], random, randomText(r, 100000)} {
+		for _, opts := range []zlib.WriterOptions{
+			{Format: zlib.FormatZlib},
+			{Format: zlib.FormatZlib, Level: 9},
+			{Format: zlib.FormatZlib, Store: true},
+			{Format: zlib.FormatRaw, Level: 1},
+			{Format: zlib.FormatGzip, WindowBits: 9, MemLevel: 1},
+			{Format: zlib.FormatGzip, Strategy: zlib.StrategyHuffmanOnly},
+			{Format: zlib.FormatGzip, Level: 9, BufferSize: 64},
+		} {
+			var out bytes.Buffer
+			zout, err := zlib.NewWriterOpts(&out, opts)
+			assert.NoError(t, err)
+			if opts.Format == zlib.FormatGzip {
+				assert.NoError(t, zout.SetHeader(zlib.Header{Name: "bound.txt", Comment: "bound"}))
+			}
+			bound := zout.Bound(len(data))
+			_, err = zout.Write(data)
+			assert.NoError(t, err)
+			assert.NoError(t, zout.Close())
+			assert.True(t, out.Len() <= bound, out.Len(), bound, opts)
+			if opts.Format == zlib.FormatZlib {
+				assert.True(t, out.Len() <= zlib.CompressBound(len(data)), out.Len(), opts)
+			}
+			assert.EQ(t, zout.Bound(len(data)), 0)
+		}
+	}
+}
+
+func TestDeflateStats(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(14)), 100000)
+	var out bytes.Buffer
+	zout, err := zlib.NewWriterLevel(&out, 6, 4096)
+	assert.NoError(t, err)
+	assert.EQ(t, zout.Ratio(), 0.0)
+	for i := 0; i < 2; i++ {
+		out.Reset()
+		assert.NoError(t, zout.Reset(&out))
+		assert.EQ(t, zout.InputBytes(), int64(0))
+		assert.EQ(t, zout.OutputBytes(), int64(0))
+		_, err = zout.Write(data[:50000])
+		assert.NoError(t, err)
+		assert.EQ(t, zout.InputBytes(), int64(50000))
+		assert.EQ(t, zout.OutputBytes(), int64(out.Len()))
+		assert.NoError(t, zout.Flush())
+		assert.EQ(t, zout.OutputBytes(), int64(out.Len()))
+		_, err = zout.Write(data[50000:])
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+		assert.EQ(t, zout.InputBytes(), int64(len(data)))
+		assert.EQ(t, zout.OutputBytes(), int64(out.Len()))
+		assert.EQ(t, zout.Ratio(), float64(len(data))/float64(out.Len()))
+		assert.True(t, zout.Ratio() > 2, zout.Ratio())
+	}
+
+	// Only the bytes accepted by the underlying writer count.
+	zout, err = zlib.NewWriterLevel(&failingWriter{n: 1000}, 6, 4096)
+	assert.NoError(t, err)
+	_, err = zout.Write(data)
+	assert.NoError(t, err)
+	assert.EQ(t, zout.Close(), errFailingWriter)
+	assert.EQ(t, zout.OutputBytes(), int64(1000))
+}
+
+// writeCloseRecorder records calls to Close.
+type writeCloseRecorder struct {
+	io.Writer
+	closed int
+	err    error
+}
+
+func (c *writeCloseRecorder) Close() error {
+	c.closed++
+	return c.err
+}
+
+func TestDeflateCloseUnderlying(t *testing.T) {
+	var buf bytes.Buffer
+	out := &writeCloseRecorder{Writer: &buf}
+	zout, err := zlib.NewWriter(out)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+	assert.EQ(t, out.closed, 0)
+
+	errClose := errors.New("close failed")
+	buf.Reset()
+	out = &writeCloseRecorder{Writer: &buf, err: errClose}
+	zout, err = zlib.NewWriterOpts(out, zlib.WriterOptions{CloseUnderlying: true})
+	assert.NoError(t, err)
+	_, err = zout.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.EQ(t, zout.Close(), errClose)
+	assert.EQ(t, zout.Close(), errClose)
+	assert.EQ(t, out.closed, 1)
+	// The stream was complete before the close.
+	gz, err := gzip.NewReader(&buf)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), "hello")
+
+	// Reset leaves the old writer open, and Close closes the new one.
+	old := &writeCloseRecorder{Writer: ioutil.Discard}
+	out = &writeCloseRecorder{Writer: ioutil.Discard}
+	assert.NoError(t, zout.Reset(old))
+	assert.NoError(t, zout.Reset(out))
+	assert.NoError(t, zout.Close())
+	assert.EQ(t, old.closed, 0)
+	assert.EQ(t, out.closed, 1)
+
+	// A write error takes precedence, and the writer is closed all the same.
+	out = &writeCloseRecorder{Writer: &failingWriter{n: 5}, err: errClose}
+	zout, err = zlib.NewWriterOpts(out, zlib.WriterOptions{CloseUnderlying: true})
+	assert.NoError(t, err)
+	assert.EQ(t, zout.Close(), errFailingWriter)
+	assert.EQ(t, out.closed, 1)
+
+	// Writers that can't be closed are fine.
+	zout, err = zlib.NewWriterOpts(ioutil.Discard, zlib.WriterOptions{CloseUnderlying: true})
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+}
+
+func TestDeflateChecksum(t *testing.T) {
+	text := randomText(rand.New(rand.NewSource(82)), 300000)
+	for _, f := range []zlib.Format{zlib.FormatGzip, zlib.FormatZlib, zlib.FormatRaw} {
+		sum := func(data []byte) uint32 {
+			switch f {
+			case zlib.FormatGzip:
+				return crc32.ChecksumIEEE(data)
+			case zlib.FormatZlib:
+				return adler32.Checksum(data)
+			}
+			return 0
+		}
+		opts := zlib.WriterOptions{Format: f}
+		if f == zlib.FormatZlib {
+			opts.Dictionary = text[:1000]
+		}
+		var out bytes.Buffer
+		zout, err := zlib.NewWriterOpts(&out, opts)
+		assert.NoError(t, err)
+		assert.EQ(t, zout.Checksum(), sum(nil), "format %d", f)
+		for i := 0; i < len(text); i += 70000 {
+			end := i + 70000
+			if end > len(text) {
+				end = len(text)
+			}
+			_, err = zout.Write(text[i:end])
+			assert.NoError(t, err)
+			assert.EQ(t, zout.Checksum(), sum(text[:end]), "format %d", f)
+			assert.EQ(t, zout.InputBytes(), int64(end))
+		}
+		assert.NoError(t, zout.NewMember())
+		assert.EQ(t, zout.Checksum(), sum(text))
+		_, err = zout.Write([]byte("more"))
+		assert.NoError(t, err)
+		all := append(append([]byte(nil), text...), "more"...)
+		assert.EQ(t, zout.Checksum(), sum(all), "format %d", f)
+		assert.NoError(t, zout.Close())
+		assert.EQ(t, zout.Checksum(), sum(all), "format %d", f)
+		if f == zlib.FormatGzip {
+			// The trailer of the last member has the checksum of that member.
+			b := out.Bytes()
+			assert.EQ(t, binary.LittleEndian.Uint32(b[len(b)-8:]), sum([]byte("more")))
+		}
+
+		assert.NoError(t, zout.Reset(ioutil.Discard))
+		assert.EQ(t, zout.Checksum(), sum(nil), "format %d", f)
+		_, err = zout.Write(text[:10])
+		assert.NoError(t, err)
+		assert.EQ(t, zout.Checksum(), sum(text[:10]), "format %d", f)
+		assert.NoError(t, zout.Close())
+	}
+}
+
+// sizeRecordingReader records the size of the buffers passed to Read.
+type sizeRecordingReader struct {
+	r     io.Reader
+	sizes []int
+}
+
+func (r *sizeRecordingReader) Read(p []byte) (int, error) {
+	r.sizes = append(r.sizes, len(p))
+	return r.r.Read(p)
+}
+
+func TestDeflateReadFrom(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(15)), 1000000)
+	var out bytes.Buffer
+	zout, err := zlib.NewWriterLevel(&out, 6, 128<<10)
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		out.Reset()
+		assert.NoError(t, zout.Reset(&out))
+		in := &sizeRecordingReader{r: bytes.NewReader(data)}
+		n, err := io.Copy(zout, in)
+		assert.NoError(t, err)
+		assert.EQ(t, n, int64(len(data)))
+		assert.EQ(t, zout.InputBytes(), int64(len(data)))
+		for _, size := range in.sizes {
+			assert.EQ(t, size, 128<<10)
+		}
+		assert.NoError(t, zout.Close())
+		gz, err := gzip.NewReader(&out)
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(gz)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(got, data))
+	}
+
+	// The data read before an error of the source is kept.
+	out.Reset()
+	zout, err = zlib.NewWriterLevel(&out, 6, 0)
+	assert.NoError(t, err)
+	n, err := zout.ReadFrom(dataTimeoutReader{bytes.NewReader(data[:1000])})
+	assert.EQ(t, err, errTimeout)
+	assert.EQ(t, n, int64(1000))
+	_, err = zout.Write(data[1000:2000])
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+	gz, err := gzip.NewReader(&out)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(got, data[:2000]))
+	_, err = zout.ReadFrom(bytes.NewReader(data))
+	assert.EQ(t, err, zlib.ErrWriterClosed)
+
+	// Errors of the underlying writer are sticky.
+	zout, err = zlib.NewWriterLevel(&failingWriter{n: 1000}, 6, 4096)
+	assert.NoError(t, err)
+	_, err = zout.ReadFrom(bytes.NewReader(data))
+	assert.EQ(t, err, errFailingWriter)
+	_, err = zout.Write(data)
+	assert.EQ(t, err, errFailingWriter)
+}
+
+func TestDeflateWriteString(t *testing.T) {
+	data := string(randomText(rand.New(rand.NewSource(16)), 100000))
+	var out bytes.Buffer
+	zout, err := zlib.NewWriterLevel(&out, 6, 4096)
+	assert.NoError(t, err)
+	n, err := io.WriteString(zout, data[:50000])
+	assert.NoError(t, err)
+	assert.EQ(t, n, 50000)
+	n, err = zout.WriteString("")
+	assert.NoError(t, err)
+	assert.EQ(t, n, 0)
+	n, err = zout.WriteString(data[50000:])
+	assert.NoError(t, err)
+	assert.EQ(t, n, 50000)
+	assert.EQ(t, zout.InputBytes(), int64(len(data)))
+	assert.NoError(t, zout.Close())
+	gz, err := gzip.NewReader(&out)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), data)
+	_, err = zout.WriteString(data)
+	assert.EQ(t, err, zlib.ErrWriterClosed)
+
+	// The string isn't copied: WriteString allocates as much as Write of a
+	// slice.
+	zout, err = zlib.NewWriterLevel(ioutil.Discard, 1, 0)
+	assert.NoError(t, err)
+	b := []byte(data)
+	writeAllocs := testing.AllocsPerRun(10, func() {
+		if _, err := zout.Write(b); err != nil {
+			panic(err)
+		}
+	})
+	allocs := testing.AllocsPerRun(10, func() {
+		if _, err := zout.WriteString(data); err != nil {
+			panic(err)
+		}
+	})
+	assert.EQ(t, allocs, writeAllocs)
+	assert.NoError(t, zout.Close())
+
+	// The writer fails on the gzip header.
+	zout, err = zlib.NewWriterLevel(&failingWriter{n: 5}, 6, 4096)
+	assert.NoError(t, err)
+	_, err = zout.WriteString(data)
+	assert.EQ(t, err, errFailingWriter)
+	_, err = zout.WriteString(data)
+	assert.EQ(t, err, errFailingWriter)
+}
+
+func TestDeflateBuffer(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(17)), 100000)
+	check := func(src []byte) {
+		gz, err := gzip.NewReader(bytes.NewReader(src))
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(gz)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(got, data))
+	}
+
+	buf := make([]byte, 100)
+	var out bytes.Buffer
+	zout, err := zlib.NewWriterWithBuffer(&out, 6, buf)
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		out.Reset()
+		assert.NoError(t, zout.Reset(&out))
+		_, err = zout.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+		check(out.Bytes())
+		// The output went through buf.
+		assert.True(t, bytes.Contains(out.Bytes(), buf[:10]))
+	}
+	_, err = zlib.NewWriterWithBuffer(&out, 6, nil)
+	assert.HasSubstr(t, err, "empty buffer")
+
+	// Pooled buffers are recycled across Close and Reset.
+	zout, err = zlib.NewWriterOpts(ioutil.Discard, zlib.WriterOptions{PoolBuffer: true})
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		out.Reset()
+		assert.NoError(t, zout.Reset(&out))
+		_, err = zout.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Flush())
+		_, err = zout.Write(data[:0])
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+		check(out.Bytes())
+	}
+
+	_, err = zlib.NewWriterOpts(ioutil.Discard, zlib.WriterOptions{PoolBuffer: true, Buffer: buf})
+	assert.EQ(t, err.Error(), "zlib: PoolBuffer with Buffer")
+	_, err = zlib.NewWriterOpts(ioutil.Discard, zlib.WriterOptions{PoolBuffer: true, BufferSize: 4096})
+	assert.EQ(t, err.Error(), "zlib: PoolBuffer with buffer size 4096")
+	_, err = zlib.NewWriterOpts(ioutil.Discard, zlib.WriterOptions{Buffer: buf[:0]})
+	assert.EQ(t, err.Error(), "zlib: empty buffer")
+}
+
+func TestDeflateInvalidLevel(t *testing.T) {
+	for _, test := range []struct {
+		level, bufSize int
+		err            string
+	}{
+		{42, 0, "zlib: invalid level 42"},
+		{10, 4096, "zlib: invalid level 10"},
+		{-3, 4096, "zlib: invalid level -3"},
+		{6, -1, "zlib: invalid buffer size -1"},
+		{-5, -5, "zlib: invalid level -5, invalid buffer size -5"},
+	} {
+		_, err := zlib.NewWriterLevel(ioutil.Discard, test.level, test.bufSize)
+		assert.EQ(t, err.Error(), test.err)
+		// The options are rejected without calling zlib. Finalizers of
+		// other tests may call it concurrently, so try a few times.
+		called := true
+		for i := 0; i < 3 && called; i++ {
+			n := runtime.NumCgoCall()
+			for j := 0; j < 10; j++ {
+				_, err = zlib.NewWriterLevel(ioutil.Discard, test.level, test.bufSize)
+				assert.NotNil(t, err)
+			}
+			called = runtime.NumCgoCall() != n
+		}
+		assert.False(t, called, test)
+	}
+	for level := -2; level <= 9; level++ {
+		zout, err := zlib.NewWriterLevel(ioutil.Discard, level, 1)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+	}
+}
+
+func TestDeflateFlushDrains(t *testing.T) {
+	// Flush writes all the output that zlib holds, however small outBuf is
+	// compared to it.
+	data := randomText(rand.New(rand.NewSource(86)), 1<<20)
+	for _, mode := range []zlib.FlushMode{zlib.FlushSync, zlib.FlushFull, zlib.FlushPartial, zlib.FlushBlock} {
+		var out bytes.Buffer
+		zout, err := zlib.NewWriterLevel(&out, 9, 64)
+		assert.NoError(t, err)
+		_, err = zout.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.FlushMode(mode))
+		if mode == zlib.FlushSync || mode == zlib.FlushFull {
+			n, bits := zout.Pending()
+			assert.EQ(t, n+bits, 0, "mode %d", mode)
+			// The output so far decodes to all the input.
+			gz, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+			assert.NoError(t, err)
+			got := make([]byte, len(data))
+			_, err = io.ReadFull(gz, got)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(got, data))
+		}
+		assert.NoError(t, zout.Close())
+	}
+}
+
+func TestDeflateAutoFlush(t *testing.T) {
+	r := rand.New(rand.NewSource(87))
+	for _, bufSize := range []int{0, 1, 100} {
+		var out, flushed bytes.Buffer
+		zout, err := zlib.NewWriterOpts(&out, zlib.WriterOptions{AutoFlush: true, BufferSize: bufSize})
+		assert.NoError(t, err)
+		zflushed, err := zlib.NewWriterLevel(&flushed, -1, bufSize)
+		assert.NoError(t, err)
+		var data []byte
+		for i := 0; i < 50; i++ {
+			event := randomText(r, r.Intn(3000))
+			switch i % 3 {
+			case 0:
+				_, err = zout.Write(event)
+			case 1:
+				_, err = zout.WriteString(string(event))
+			case 2:
+				_, err = zout.ReadFrom(bytes.NewReader(event))
+			}
+			assert.NoError(t, err)
+			_, err = zflushed.Write(event)
+			assert.NoError(t, err)
+			assert.NoError(t, zflushed.Flush())
+			data = append(data, event...)
+
+			// Each write can be decoded as soon as it is written, and is
+			// flushed like with Flush.
+			assert.True(t, bytes.Equal(out.Bytes(), flushed.Bytes()), "write %d", i)
+			gz, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+			assert.NoError(t, err)
+			got := make([]byte, len(data))
+			_, err = io.ReadFull(gz, got)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(got, data))
+		}
+		assert.NoError(t, zout.Close())
+		gz, err := gzip.NewReader(&out)
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(gz)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(got, data))
+	}
+}
+
+func TestDeflateTune(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(88)), 300000)
+	compress := func(zout zlib.Writer) []byte {
+		var out bytes.Buffer
+		assert.NoError(t, zout.Reset(&out))
+		_, err := zout.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+		gz, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+		assert.NoError(t, err)
+		got, err := ioutil.ReadAll(gz)
+		assert.NoError(t, err)
+		assert.True(t, bytes.Equal(got, data))
+		return out.Bytes()
+	}
+	level6, err := zlib.NewWriterLevel(ioutil.Discard, 6, 0)
+	assert.NoError(t, err)
+	level9, err := zlib.NewWriterLevel(ioutil.Discard, 9, 0)
+	assert.NoError(t, err)
+	want6, want9 := compress(level6), compress(level9)
+
+	// The parameters of level 9, from deflate.c, make level 6 compress like
+	// it. Only the XFL byte of the header tells them apart.
+	zout, err := zlib.NewWriterLevel(ioutil.Discard, 6, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Tune(32, 258, 258, 4096))
+	got := compress(zout)
+	assert.True(t, bytes.Equal(got[10:], want9[10:]))
+	// The tuning survives Reset.
+	assert.True(t, bytes.Equal(compress(zout), got))
+
+	// A shorter search compresses less.
+	assert.NoError(t, zout.Reset(ioutil.Discard))
+	assert.NoError(t, zout.Tune(4, 4, 8, 4))
+	fast := compress(zout)
+	assert.True(t, len(fast) > len(want6), len(fast), len(want6))
+
+	// SetParams with a new level installs its parameters.
+	assert.NoError(t, zout.Reset(ioutil.Discard))
+	assert.NoError(t, zout.SetParams(9, zlib.StrategyDefault))
+	assert.True(t, bytes.Equal(compress(zout), want9))
+
+	assert.NoError(t, zout.Reset(ioutil.Discard))
+	assert.EQ(t, zout.Tune(-1, 4, 8, 4).Error(), "zlib: invalid tuning length -1")
+	assert.EQ(t, zout.Tune(4, 4, 259, 4).Error(), "zlib: invalid tuning length 259")
+	assert.EQ(t, zout.Tune(4, 4, 8, 0).Error(), "zlib: invalid tuning chain 0")
+	assert.NoError(t, zout.Close())
+	assert.EQ(t, zout.Tune(4, 4, 8, 4), zlib.ErrWriterClosed)
+}
+
+func TestDeflateCheckpoint(t *testing.T) {
+	r := rand.New(rand.NewSource(89))
+	var parts [][]byte
+	for i := 0; i < 5; i++ {
+		part := randomText(r, 100000+r.Intn(100000))
+		random := make([]byte, 20000)
+		r.Read(random)
+		parts = append(parts, append(part, random...))
+	}
+	header := zlib.Header{Name: "upload.log", Comment: "resumable", Extra: []byte("xx")}
+	for _, bufSize := range []int{0, 7} {
+		var want bytes.Buffer
+		zout, err := zlib.NewWriterLevel(&want, 6, bufSize)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.SetHeader(header))
+		for _, part := range parts {
+			_, err = zout.Write(part)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, zout.Close())
+
+		var out bytes.Buffer
+		zout, err = zlib.NewWriterLevel(&out, 6, bufSize)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.SetHeader(header))
+		var cps []*zlib.WriterCheckpoint
+		for i, part := range parts {
+			cp, err := zout.Checkpoint()
+			assert.NoError(t, err)
+			cps = append(cps, cp)
+			assert.EQ(t, cp.OutputOffset(), int64(out.Len()))
+			assert.EQ(t, cp.InputOffset(), zout.InputBytes())
+			if i == 0 || i == 2 {
+				// The first attempt at the part fails half way.
+				assert.NoError(t, zout.Restore(cp, &failingWriter{n: 1000}))
+				_, err = zout.Write(part)
+				assert.EQ(t, err, errFailingWriter)
+				assert.NoError(t, zout.Restore(cp, &out))
+			}
+			_, err = zout.Write(part)
+			assert.NoError(t, err)
+		}
+		// Going back once more rewrites the same end of the stream.
+		assert.NoError(t, zout.Close())
+		assert.True(t, bytes.Equal(out.Bytes(), want.Bytes()), bufSize)
+		assert.EQ(t, zout.Restore(cps[3], &out), zlib.ErrWriterClosed)
+		assert.NoError(t, zout.Reset(ioutil.Discard))
+		out.Truncate(int(cps[3].OutputOffset()))
+		assert.NoError(t, zout.Restore(cps[3], &out))
+		for _, part := range parts[3:] {
+			_, err = zout.Write(part)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, zout.Close())
+		assert.True(t, bytes.Equal(out.Bytes(), want.Bytes()), bufSize)
+
+		for _, cp := range cps {
+			assert.NoError(t, cp.Close())
+			assert.NoError(t, cp.Close())
+		}
+		assert.NoError(t, zout.Reset(ioutil.Discard))
+		assert.HasSubstr(t, zout.Restore(cps[0], ioutil.Discard), "checkpoint is closed")
+		other, err := zlib.NewWriter(ioutil.Discard)
+		assert.NoError(t, err)
+		cp, err := other.Checkpoint()
+		assert.NoError(t, err)
+		assert.HasSubstr(t, zout.Restore(cp, ioutil.Discard), "taken by another writer")
+		assert.NoError(t, cp.Close())
+		assert.NoError(t, other.Close())
+		_, err = other.Checkpoint()
+		assert.EQ(t, err, zlib.ErrWriterClosed)
+		assert.NoError(t, zout.Close())
+	}
+}
+
+func TestDeflateAbort(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(90)), 100000)
+	var out bytes.Buffer
+	zout, err := zlib.NewWriter(&out)
+	assert.NoError(t, err)
+	_, err = zout.Write(data)
+	assert.NoError(t, err)
+	n := out.Len()
+	assert.NoError(t, zout.Abort())
+	assert.NoError(t, zout.Abort())
+	// Nothing more reaches the underlying writer.
+	_, err = zout.Write(data)
+	assert.EQ(t, err, zlib.ErrWriterClosed)
+	assert.EQ(t, zout.Flush(), zlib.ErrWriterClosed)
+	assert.NoError(t, zout.Close())
+	assert.EQ(t, out.Len(), n)
+	runtime.GC()
+
+	// Reset starts a new stream.
+	out.Reset()
+	assert.NoError(t, zout.Reset(&out))
+	_, err = zout.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+	gz, err := gzip.NewReader(&out)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(got, data))
+
+	// A failed writer is aborted all the same, and Close reports the failure.
+	sink := &writeCloseRecorder{Writer: &failingWriter{n: 5}, err: errors.New("close failed")}
+	zout, err = zlib.NewWriterOpts(sink, zlib.WriterOptions{CloseUnderlying: true})
+	assert.NoError(t, err)
+	assert.EQ(t, zout.Flush(), errFailingWriter)
+	assert.EQ(t, zout.Abort(), sink.err)
+	assert.EQ(t, sink.closed, 1)
+	assert.NoError(t, zout.Abort())
+	assert.EQ(t, zout.Close(), errFailingWriter)
+	assert.EQ(t, sink.closed, 1)
+}
+
+func TestDeflateNoFinalizer(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(92)), 100000)
+	collected := make(chan bool, 1)
+	func() {
+		var out bytes.Buffer
+		zout, err := zlib.NewWriterOpts(&out, zlib.WriterOptions{NoFinalizer: true, PoolBuffer: true})
+		assert.NoError(t, err)
+		// SetFinalizer would crash if the writer had one already.
+		runtime.SetFinalizer(zout, func(interface{}) { collected <- true })
+		for i := 0; i < 3; i++ {
+			out.Reset()
+			assert.NoError(t, zout.Reset(&out))
+			_, err = zout.Write(data)
+			assert.NoError(t, err)
+			assert.NoError(t, zout.Close())
+			gz, err := gzip.NewReader(&out)
+			assert.NoError(t, err)
+			got, err := ioutil.ReadAll(gz)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(got, data))
 		}
-		n2, err := zout.Write(src[:n])
+	}()
+	// Close and Reset didn't install or clear a finalizer either.
+	for i := 0; i < 10 && len(collected) == 0; i++ {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	assert.EQ(t, len(collected), 1)
+}
+
+// splitObjects returns the objects of a writer with SplitSize, and the
+// NextWriter that appends them.
+func splitObjects() (*[]*writeCloseRecorder, func() (io.Writer, error)) {
+	objects := &[]*writeCloseRecorder{{Writer: &bytes.Buffer{}}}
+	return objects, func() (io.Writer, error) {
+		o := &writeCloseRecorder{Writer: &bytes.Buffer{}}
+		*objects = append(*objects, o)
+		return o, nil
+	}
+}
+
+func TestDeflateSplit(t *testing.T) {
+	r := rand.New(rand.NewSource(93))
+	text := randomText(r, 2000000)
+	random := make([]byte, 500000)
+	r.Read(random)
+	const splitSize = 30000
+	for _, data := range [][]byte{text, random} {
+		for _, writeSize := range []int{len(data), 1000} {
+			objects, next := splitObjects()
+			zout, err := zlib.NewWriterOpts((*objects)[0], zlib.WriterOptions{SplitSize: splitSize, NextWriter: next, CloseUnderlying: true})
+			assert.NoError(t, err)
+			for i := 0; i < len(data); i += writeSize {
+				end := i + writeSize
+				if end > len(data) {
+					end = len(data)
+				}
+				_, err = zout.Write(data[i:end])
+				assert.NoError(t, err)
+				// Flush never moves to the next object.
+				if i%(100*writeSize) == 0 {
+					n := len(*objects)
+					assert.NoError(t, zout.Flush())
+					assert.EQ(t, len(*objects), n)
+				}
+			}
+			assert.NoError(t, zout.Close())
+			assert.GT(t, len(*objects), 2)
+			var got []byte
+			var total int64
+			for i, o := range *objects {
+				out := o.Writer.(*bytes.Buffer).Bytes()
+				total += int64(len(out))
+				assert.EQ(t, o.closed, 1, "object %d", i)
+				// Every object is a gzip file with a single member.
+				rd := bytes.NewReader(out)
+				zin, err := gzip.NewReader(rd)
+				assert.NoError(t, err)
+				zin.Multistream(false)
+				part, err := ioutil.ReadAll(zin)
+				assert.NoError(t, err)
+				assert.EQ(t, rd.Len(), 0, "object %d", i)
+				assert.GT(t, len(part), 0, "object %d", i)
+				got = append(got, part...)
+				if i < len(*objects)-1 {
+					assert.GE(t, len(out), splitSize, "object %d", i)
+				}
+				assert.LT(t, len(out), splitSize+150000, "object %d", i)
+			}
+			assert.EQ(t, got, data)
+			assert.EQ(t, zout.OutputBytes(), total)
+			assert.EQ(t, zout.Checksum(), crc32.ChecksumIEEE(data))
+		}
+	}
+}
+
+func TestDeflateSplitBoundary(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(93)), 1000000)
+	// Close right after the object reaches SplitSize ends the stream in it,
+	// without an empty object.
+	objects, next := splitObjects()
+	zout, err := zlib.NewWriterOpts((*objects)[0], zlib.WriterOptions{SplitSize: 1000, NextWriter: next})
+	assert.NoError(t, err)
+	_, err = zout.Write(data[:65536])
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Flush())
+	assert.NoError(t, zout.Close())
+	assert.EQ(t, len(*objects), 1)
+	assert.EQ(t, (*objects)[0].closed, 0)
+	zin, err := gzip.NewReader((*objects)[0].Writer.(*bytes.Buffer))
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, got, data[:65536])
+
+	// The next Write moves to the next object.
+	objects, next = splitObjects()
+	zout, err = zlib.NewWriterOpts((*objects)[0], zlib.WriterOptions{SplitSize: 1000, NextWriter: next})
+	assert.NoError(t, err)
+	_, err = zout.Write(data[:65536])
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Flush())
+	_, err = zout.Write([]byte("x"))
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+	assert.EQ(t, len(*objects), 2)
+	zin, err = gzip.NewReader((*objects)[1].Writer.(*bytes.Buffer))
+	assert.NoError(t, err)
+	got, err = ioutil.ReadAll(zin)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), "x")
+
+	// Reset starts a new sequence of objects.
+	assert.NoError(t, zout.Reset(ioutil.Discard))
+	_, err = zout.Write(data)
+	assert.NoError(t, err)
+	before := len(*objects)
+	assert.NoError(t, zout.Reset(ioutil.Discard))
+	_, err = zout.Write(data[:65536])
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Flush())
+	assert.EQ(t, len(*objects), before)
+	_, err = zout.Write(data[:100])
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+	assert.EQ(t, len(*objects), before+1)
+
+	// Errors of NextWriter fail the writer.
+	errNext := errors.New("no more objects")
+	var out writeCloseRecorder
+	out.Writer = ioutil.Discard
+	calls := 0
+	zout, err = zlib.NewWriterOpts(&out, zlib.WriterOptions{SplitSize: 1000, CloseUnderlying: true, NextWriter: func() (io.Writer, error) {
+		calls++
+		return nil, errNext
+	}})
+	assert.NoError(t, err)
+	n, err := zout.Write(data)
+	assert.EQ(t, err, errNext)
+	assert.LT(t, n, len(data))
+	assert.EQ(t, zout.Flush(), errNext)
+	assert.EQ(t, zout.Close(), errNext)
+	assert.EQ(t, calls, 1)
+	assert.EQ(t, out.closed, 1)
+
+	for _, test := range []struct {
+		opts zlib.WriterOptions
+		err  string
+	}{
+		{zlib.WriterOptions{SplitSize: -1}, "zlib: invalid split size -1"},
+		{zlib.WriterOptions{SplitSize: 1}, "zlib: SplitSize without NextWriter"},
+		{zlib.WriterOptions{NextWriter: next}, "zlib: NextWriter without SplitSize"},
+	} {
+		_, err := zlib.NewWriterOpts(ioutil.Discard, test.opts)
+		assert.EQ(t, err.Error(), test.err)
+	}
+	_, err = zlib.NewAsyncWriter(ioutil.Discard, zlib.AsyncWriterOptions{Writer: zlib.WriterOptions{SplitSize: 1, NextWriter: next}})
+	assert.EQ(t, err.Error(), "zlib: SplitSize with AsyncWriter")
+}
+
+func TestDeflateProgress(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(94)), 300000)
+	var out bytes.Buffer
+	var calls []zlib.Progress
+	zout, err := zlib.NewWriterOpts(&out, zlib.WriterOptions{Progress: func(p zlib.Progress) error {
+		calls = append(calls, p)
+		return nil
+	}})
+	assert.NoError(t, err)
+	for i := 0; i < len(data); i += 10000 {
+		_, err = zout.Write(data[i : i+10000])
 		assert.NoError(t, err)
-		assert.EQ(t, n, n2)
-		src = src[n:]
+		assert.EQ(t, calls[len(calls)-1], zlib.Progress{InputBytes: zout.InputBytes(), OutputBytes: zout.OutputBytes()})
 	}
+	assert.EQ(t, len(calls), 30)
+	assert.NoError(t, zout.Flush())
+	_, err = zout.WriteString("end")
+	assert.NoError(t, err)
 	assert.NoError(t, zout.Close())
+	assert.EQ(t, len(calls), 33)
+	for i := 1; i < len(calls); i++ {
+		assert.GE(t, calls[i].InputBytes, calls[i-1].InputBytes)
+		assert.GE(t, calls[i].OutputBytes, calls[i-1].OutputBytes)
+	}
+	last := calls[len(calls)-1]
+	assert.EQ(t, last, zlib.Progress{InputBytes: int64(len(data) + 3), OutputBytes: int64(out.Len())})
+	assert.EQ(t, last.Ratio(), zout.Ratio())
+	assert.EQ(t, zlib.Progress{}.Ratio(), 0.0)
 
-	got := bytes.Buffer{}
-	zin, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+	// ReadFrom reports every chunk.
+	calls = nil
+	out.Reset()
+	assert.NoError(t, zout.Reset(&out))
+	_, err = zout.ReadFrom(iotest.HalfReader(bytes.NewReader(data)))
 	assert.NoError(t, err)
-	n, err := io.Copy(&got, zin)
+	assert.GT(t, len(calls), 1)
+	assert.EQ(t, calls[len(calls)-1].InputBytes, int64(len(data)))
+	assert.NoError(t, zout.Close())
+
+	// An error of the callback fails the writer, which doesn't end the stream.
+	errStop := errors.New("stop")
+	n := 0
+	out.Reset()
+	zout, err = zlib.NewWriterOpts(&out, zlib.WriterOptions{Progress: func(p zlib.Progress) error {
+		if n++; n == 3 {
+			return errStop
+		}
+		return nil
+	}})
 	assert.NoError(t, err)
-	assert.EQ(t, int(n), len(orgSrc))
-	if !bytes.Equal(got.Bytes(), orgSrc) {
-		t.Fatal("fail")
-	}
+	_, err = zout.Write(data[:1000])
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Flush())
+	k, err := zout.Write(data[:1000])
+	assert.EQ(t, err, errStop)
+	assert.EQ(t, k, 1000)
+	assert.EQ(t, zout.Flush(), errStop)
+	_, err = zout.Write(data)
+	assert.EQ(t, err, errStop)
+	assert.EQ(t, zout.Close(), errStop)
+	assert.EQ(t, n, 3)
+	zin, err := gzip.NewReader(&out)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(zin)
+	assert.EQ(t, err, io.ErrUnexpectedEOF)
+
+	// An error at Close is returned by Close.
+	zout, err = zlib.NewWriterOpts(ioutil.Discard, zlib.WriterOptions{Progress: func(p zlib.Progress) error {
+		return errStop
+	}})
+	assert.NoError(t, err)
+	assert.EQ(t, zout.Close(), errStop)
+	assert.EQ(t, zout.Close(), errStop)
 }
 
-func TestDeflateRandom(t *testing.T) {
-	r := rand.New(rand.NewSource(0))
-	for i := 0; i < 20; i++ {
-		n := r.Intn(16 << 20)
-		log.Printf("%d: n=%d", i, n)
-		data := make([]byte, n)
-		_, err := r.Read(data)
-		assert.NoError(t, err)
-		testDeflate(t, r, data)
+// TestFinalizerRace runs writers and readers that are only reachable through
+// method values, with the garbage collector running all the time, so that a
+// finalizer running during a cgo call would free the zlib state under it.
+func TestFinalizerRace(t *testing.T) {
+	defer debug.SetGCPercent(debug.SetGCPercent(1))
+	data := randomText(rand.New(rand.NewSource(95)), 100000)
+	iterations := 50
+	if testing.Short() {
+		iterations = 10
 	}
+	stop := make(chan bool)
+	gcDone := make(chan bool)
+	go func() {
+		defer close(gcDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				runtime.GC()
+			}
+		}
+	}()
+	for i := 0; i < iterations; i++ {
+		var out bytes.Buffer
+		write, flush, closeWriter := newWriterFuncs(t, &out)
+		for j := 0; j < len(data); j += 10000 {
+			_, err := write(data[j : j+10000])
+			assert.NoError(t, err)
+			assert.NoError(t, flush())
+		}
+		assert.NoError(t, closeWriter())
+
+		read, closeReader := newReaderFuncs(t, &out)
+		got := make([]byte, 0, len(data))
+		buf := make([]byte, 10000)
+		for {
+			n, err := read(buf)
+			got = append(got, buf[:n]...)
+			if err == io.EOF {
+				break
+			}
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, closeReader())
+		assert.EQ(t, got, data)
+	}
+	close(stop)
+	<-gcDone
 }
 
-func TestDeflateFlush(t *testing.T) {
-	r := rand.New(rand.NewSource(0))
-	data := make([]byte, 16<<20)
-	_, err := r.Read(data)
+// newWriterFuncs returns method values of a writer to out, which is
+// unreachable otherwise.
+func newWriterFuncs(t *testing.T, out io.Writer) (func([]byte) (int, error), func() error, func() error) {
+	zout, err := zlib.NewWriterLevel(out, -1, 4096)
 	assert.NoError(t, err)
+	return zout.Write, zout.Flush, zout.Close
+}
 
-	writtenData := data
-	out := bytes.Buffer{}
-	zout, err := zlib.NewWriter(&out)
+// newReaderFuncs is newWriterFuncs for a reader of in.
+func newReaderFuncs(t *testing.T, in io.Reader) (func([]byte) (int, error), func() error) {
+	zin, err := zlib.NewReader(in)
 	assert.NoError(t, err)
+	return zin.Read, zin.Close
+}
 
-	for len(writtenData) > 0 {
-		n := r.Intn(8192)
-		if n > len(writtenData) {
-			n = len(writtenData)
-		}
-		n2, err := zout.Write(writtenData[:n])
+func TestDeflateTinyBuffer(t *testing.T) {
+	r := rand.New(rand.NewSource(85))
+	text := randomText(r, 200000)
+	random := make([]byte, 50000)
+	r.Read(random)
+	// Zero selects the default size, and negative sizes are rejected.
+	zout, err := zlib.NewWriterLevel(ioutil.Discard, -1, 0)
+	assert.NoError(t, err)
+	_, err = zout.Write(text)
+	assert.NoError(t, err)
+	assert.NoError(t, zout.Close())
+	_, err = zlib.NewWriterLevel(ioutil.Discard, -1, -1)
+	assert.EQ(t, err.Error(), "zlib: invalid buffer size -1")
+
+	// Buffers of a few bytes go around every loop that drains zlib many
+	// times.
+	for _, size := range []int{1, 2, 7} {
+		var out bytes.Buffer
+		zout, err := zlib.NewWriterLevel(&out, 6, size)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.SetHeader(zlib.Header{Name: "tiny.txt", Comment: "a header longer than the buffer"}))
+		_, err = zout.Write(text)
 		assert.NoError(t, err)
-		assert.EQ(t, n, n2)
-		writtenData = writtenData[n:]
 		assert.NoError(t, zout.Flush())
+		_, err = zout.Write(random)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.SetParams(1, zlib.StrategyDefault))
+		_, err = zout.WriteString(string(text))
+		assert.NoError(t, err)
+		assert.NoError(t, zout.FullFlush())
+		for _, mode := range []zlib.FlushMode{zlib.FlushPartial, zlib.FlushBlock} {
+			_, err = zout.Write(text[:1000])
+			assert.NoError(t, err)
+			assert.NoError(t, zout.FlushMode(mode))
+		}
+		assert.NoError(t, zout.NewMember())
+		_, err = zout.ReadFrom(bytes.NewReader(random))
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+
+		gz, err := gzip.NewReader(&out)
+		assert.NoError(t, err)
+		assert.EQ(t, gz.Name, "tiny.txt")
+		got, err := ioutil.ReadAll(gz)
+		assert.NoError(t, err)
+		want := append(append(append([]byte(nil), text...), random...), text...)
+		want = append(append(append(want, text[:1000]...), text[:1000]...), random...)
+		assert.True(t, bytes.Equal(got, want), size)
 	}
-	assert.NoError(t, zout.Close())
+}
 
-	got := bytes.Buffer{}
-	zin, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
-	assert.NoError(t, err)
-	n, err := io.Copy(&got, zin)
+func TestDeflateLevelConstants(t *testing.T) {
+	assert.EQ(t, zlib.NoCompression, gzip.NoCompression)
+	assert.EQ(t, zlib.BestSpeed, gzip.BestSpeed)
+	assert.EQ(t, zlib.BestCompression, gzip.BestCompression)
+	assert.EQ(t, zlib.DefaultCompression, gzip.DefaultCompression)
+	assert.EQ(t, zlib.HuffmanOnly, gzip.HuffmanOnly)
+
+	data := randomText(rand.New(rand.NewSource(18)), 100000)
+	compress := func(zout zlib.Writer, err error) []byte {
+		assert.NoError(t, err)
+		var out bytes.Buffer
+		assert.NoError(t, zout.Reset(&out))
+		_, err = zout.Write(data)
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+		return out.Bytes()
+	}
+	huffman := compress(zlib.NewWriterStrategy(ioutil.Discard, zlib.DefaultCompression, zlib.StrategyHuffmanOnly, 0))
+	assert.True(t, bytes.Equal(compress(zlib.NewWriterLevel(ioutil.Discard, zlib.HuffmanOnly, 0)), huffman))
+	assert.True(t, bytes.Equal(compress(zlib.NewWriterOpts(ioutil.Discard, zlib.WriterOptions{Level: zlib.HuffmanOnly})), huffman))
+	_, err := zlib.NewWriterStrategy(ioutil.Discard, zlib.HuffmanOnly, zlib.StrategyRLE, 0)
+	assert.EQ(t, err.Error(), "zlib: level -2 with strategy 3")
+
+	zout, err := zlib.NewWriterLevel(ioutil.Discard, zlib.BestSpeed, 0)
 	assert.NoError(t, err)
-	assert.EQ(t, int(n), len(data))
-	if !bytes.Equal(got.Bytes(), data) {
-		t.Fatal("fail")
+	assert.NoError(t, zout.SetParams(zlib.HuffmanOnly, zlib.StrategyDefault))
+	assert.EQ(t, zout.SetParams(zlib.HuffmanOnly, zlib.StrategyFixed).Error(), "zlib: level -2 with strategy 4")
+	assert.NoError(t, zout.Close())
+
+	for _, f := range []zlib.Format{zlib.FormatGzip, zlib.FormatZlib, zlib.FormatRaw} {
+		for level := zlib.HuffmanOnly; level <= zlib.BestCompression; level++ {
+			assert.NoError(t, zlib.ValidateLevel(f, level))
+		}
+		assert.EQ(t, zlib.ValidateLevel(f, 10).Error(), "zlib: invalid level 10")
+		assert.EQ(t, zlib.ValidateLevel(f, -3).Error(), "zlib: invalid level -3")
 	}
+	assert.EQ(t, zlib.ValidateLevel(zlib.FormatAuto, zlib.BestSpeed).Error(), "zlib: invalid format 3")
 }
 
-func TestDeflateReset(t *testing.T) {
-	r := rand.New(rand.NewSource(0))
-	data := make([]byte, 16<<20)
-	_, err := r.Read(data)
-	assert.NoError(t, err)
+// shortWriter writes at most max bytes per call, without an error.
+type shortWriter struct {
+	w   io.Writer
+	max int
+}
 
-	out := bytes.Buffer{}
-	zout, err := zlib.NewWriter(&out)
+func (w shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.max {
+		p = p[:w.max]
+	}
+	return w.w.Write(p)
+}
+
+func TestDeflateShortWrites(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(19)), 100000)
+	var out bytes.Buffer
+	zout, err := zlib.NewWriterLevel(shortWriter{&out, 7}, 6, 4096)
+	assert.NoError(t, err)
+	_, err = zout.Write(data)
 	assert.NoError(t, err)
+	assert.NoError(t, zout.Flush())
 	_, err = zout.Write(data)
 	assert.NoError(t, err)
 	assert.NoError(t, zout.Close())
+	assert.EQ(t, zout.OutputBytes(), int64(out.Len()))
+	gz, err := gzip.NewReader(&out)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(got, append(data, data...)))
 
-	// Reset for second run
-	_, err = r.Read(data)
+	// A writer that makes no progress fails.
+	zout, err = zlib.NewWriterLevel(shortWriter{&out, 0}, 6, 4096)
 	assert.NoError(t, err)
-	out = bytes.Buffer{}
-	assert.NoError(t, zout.Reset(&out))
 	_, err = zout.Write(data)
-	assert.NoError(t, err)
-	assert.NoError(t, zout.Close())
+	assert.EQ(t, err, io.ErrShortWrite)
+}
 
-	got := bytes.Buffer{}
-	zin, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+// limitedWriter writes the first n bytes to w, then fails.
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+var errLimitedWriter = errors.New("limitedWriter")
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n, _ := w.w.Write(p[:w.n])
+		w.n = 0
+		return n, errLimitedWriter
+	}
+	w.n -= len(p)
+	return w.w.Write(p)
+}
+
+func TestDeflateWriteCount(t *testing.T) {
+	r := rand.New(rand.NewSource(20))
+	data := make([]byte, 1<<20)
+	r.Read(data)
+	for _, limit := range []int{5, 1000, 100000} {
+		var out bytes.Buffer
+		zout, err := zlib.NewWriterOpts(&limitedWriter{&out, limit}, zlib.WriterOptions{Store: true, BufferSize: 4096})
+		assert.NoError(t, err)
+		n, err := zout.Write(data)
+		assert.EQ(t, err, errLimitedWriter)
+		assert.True(t, n < len(data), n)
+		assert.EQ(t, zout.InputBytes(), int64(n))
+		// The output that was written covers at most the n bytes reported.
+		gz, err := gzip.NewReader(&out)
+		if limit < 10 {
+			// Not even the header is complete.
+			assert.NotNil(t, err)
+			continue
+		}
+		assert.NoError(t, err)
+		got, _ := ioutil.ReadAll(gz)
+		assert.True(t, len(got) > 0 && len(got) <= n, len(got), n)
+		assert.True(t, bytes.Equal(got, data[:len(got)]))
+		// zlib holds at most two windows of input.
+		assert.True(t, n-len(got) <= 64<<10, n-len(got))
+	}
+}
+
+func TestDeflateNewMember(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(21)), 100000)
+	headers := []zlib.Header{{}, {Name: "second.txt", Comment: "second"}, {}}
+	for _, deterministic := range []bool{false, true} {
+		newWriter := func(w io.Writer) zlib.Writer {
+			zout, err := zlib.NewWriterOpts(w, zlib.WriterOptions{Level: 9, BufferSize: 4096, Deterministic: deterministic})
+			assert.NoError(t, err)
+			return zout
+		}
+		var want bytes.Buffer
+		for _, h := range headers {
+			zout := newWriter(&want)
+			if h.Name != "" && !deterministic {
+				assert.NoError(t, zout.SetHeader(h))
+			}
+			_, err := zout.Write(data)
+			assert.NoError(t, err)
+			assert.NoError(t, zout.Close())
+		}
+
+		var out bytes.Buffer
+		zout := newWriter(&out)
+		for i, h := range headers {
+			if i > 0 {
+				assert.NoError(t, zout.NewMember())
+			}
+			if h.Name != "" && !deterministic {
+				assert.NoError(t, zout.SetHeader(h))
+			}
+			_, err := zout.Write(data)
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, zout.Close())
+		assert.True(t, bytes.Equal(out.Bytes(), want.Bytes()), deterministic)
+		assert.EQ(t, zout.OutputBytes(), int64(out.Len()))
+		assert.EQ(t, zout.InputBytes(), int64(3*len(data)))
+
+		zin, err := zlib.NewReader(&out)
+		assert.NoError(t, err)
+		zin.Multistream(false)
+		for i := range headers {
+			got, err := ioutil.ReadAll(zin)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(got, data))
+			if !deterministic {
+				assert.EQ(t, zin.Header().Name, headers[i].Name)
+			}
+			more, err := zin.NextMember()
+			assert.NoError(t, err)
+			assert.EQ(t, more, i < len(headers)-1)
+		}
+		assert.NoError(t, zin.Close())
+		assert.EQ(t, zout.NewMember(), zlib.ErrWriterClosed)
+	}
+}
+
+func TestDeflateAppend(t *testing.T) {
+	data := randomText(rand.New(rand.NewSource(22)), 100000)
+	tmp, err := ioutil.TempDir("", "")
 	assert.NoError(t, err)
-	n, err := io.Copy(&got, zin)
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, "append.gz")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
 	assert.NoError(t, err)
-	assert.EQ(t, int(n), len(data))
-	if !bytes.Equal(got.Bytes(), data) {
-		t.Fatal("fail")
+	for i := 0; i < 3; i++ {
+		zout, err := zlib.NewWriterAppend(f, 6, 0)
+		assert.NoError(t, err)
+		_, err = zout.Write(data[i*1000:])
+		assert.NoError(t, err)
+		assert.NoError(t, zout.Close())
+	}
+	assert.NoError(t, f.Close())
+
+	if gunzip, err := exec.LookPath("gunzip"); err == nil {
+		out, err := exec.Command(gunzip, "-t", path).CombinedOutput()
+		assert.NoError(t, err, string(out))
 	}
+	src, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	n, err := zlib.CheckMembers(bytes.NewReader(src))
+	assert.NoError(t, err)
+	assert.EQ(t, n, 3)
+	gz, err := gzip.NewReader(bytes.NewReader(src))
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(got, append(append(data, data[1000:]...), data[2000:]...)))
+
+	n, err = zlib.CheckMembers(bytes.NewReader(nil))
+	assert.NoError(t, err)
+	assert.EQ(t, n, 0)
+
+	// Appending to a truncated file would leave a broken member in the
+	// middle.
+	assert.NoError(t, ioutil.WriteFile(path, src[:len(src)-3], 0600))
+	f, err = os.OpenFile(path, os.O_RDWR, 0600)
+	assert.NoError(t, err)
+	_, err = zlib.NewWriterAppend(f, 6, 0)
+	assert.EQ(t, err, io.ErrUnexpectedEOF)
+	assert.NoError(t, f.Close())
+	n, err = zlib.CheckMembers(bytes.NewReader(append(src, "garbage"...)))
+	assert.EQ(t, err, zlib.ErrHeader)
+	assert.EQ(t, n, 3)
 }
 
 var (
@@ -342,6 +4900,33 @@ func BenchmarkInflateZlib(b *testing.B) {
 		})
 }
 
+// BenchmarkInflateBufioSource compares a source read in exact mode, such as a
+// bufio.Reader, with a plain one.
+func BenchmarkInflateBufioSource(b *testing.B) {
+	data := randomText(rand.New(rand.NewSource(0)), 4<<20)
+	src := compressGzip(b, data)
+	for _, bc := range []struct {
+		name string
+		in   func() io.Reader
+	}{
+		{"plain", func() io.Reader { return struct{ io.Reader }{bytes.NewReader(src)} }},
+		{"bufio", func() io.Reader { return bufio.NewReader(bytes.NewReader(src)) }},
+		{"buffer", func() io.Reader { return bytes.NewBuffer(src) }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				zin, err := zlib.NewReader(bc.in())
+				assert.NoError(b, err)
+				n, err := io.Copy(ioutil.Discard, zin)
+				assert.NoError(b, err)
+				assert.EQ(b, n, int64(len(data)))
+				assert.NoError(b, zin.Close())
+			}
+		})
+	}
+}
+
 type discardingWriter struct {
 	n int64
 }
@@ -385,3 +4970,210 @@ func BenchmarkDeflateZlib(b *testing.B) {
 			return w
 		})
 }
+
+func benchmarkDeflateString(b *testing.B, write func(zout zlib.Writer, s string)) {
+	s := string(randomText(rand.New(rand.NewSource(0)), 4096))
+	zout, err := zlib.NewWriterLevel(ioutil.Discard, 1, 0)
+	assert.NoError(b, err)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(s)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		write(zout, s)
+	}
+	b.StopTimer()
+	assert.NoError(b, zout.Close())
+}
+
+func BenchmarkDeflateWriteString(b *testing.B) {
+	benchmarkDeflateString(b, func(zout zlib.Writer, s string) {
+		if _, err := zout.WriteString(s); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
+
+func BenchmarkDeflateWriteStringBytes(b *testing.B) {
+	benchmarkDeflateString(b, func(zout zlib.Writer, s string) {
+		if _, err := zout.Write([]byte(s)); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
+
+func BenchmarkDeflateParallel(b *testing.B) {
+	benchmarkDeflate(b, *testPathFlag,
+		func(out io.Writer) io.WriteCloser {
+			w, err := zlib.NewParallelWriter(out, zlib.ParallelWriterOptions{Level: 5})
+			assert.NoError(b, err)
+			return w
+		})
+}
+
+func BenchmarkDeflateAsync(b *testing.B) {
+	benchmarkDeflate(b, *testPathFlag,
+		func(out io.Writer) io.WriteCloser {
+			w, err := zlib.NewAsyncWriter(out, zlib.AsyncWriterOptions{Writer: zlib.WriterOptions{Level: 5}})
+			assert.NoError(b, err)
+			return w
+		})
+}
+
+// BenchmarkDeflateTune compares the default parameters of level 6 with a
+// shorter match search, and reports the ratio of each.
+func BenchmarkDeflateTune(b *testing.B) {
+	for _, test := range []struct {
+		name                                      string
+		goodLength, maxLazy, niceLength, maxChain int
+	}{
+		{"Level6", 8, 16, 128, 128},
+		{"Chain32", 8, 16, 128, 32},
+		{"Nice32Chain16", 8, 16, 32, 16},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			fi, err := os.Stat(*testPathFlag)
+			assert.NoError(b, err)
+			var out *discardingWriter
+			benchmarkDeflate(b, *testPathFlag,
+				func(w io.Writer) io.WriteCloser {
+					out = w.(*discardingWriter)
+					zout, err := zlib.NewWriterLevel(w, 6, 512<<10)
+					assert.NoError(b, err)
+					assert.NoError(b, zout.Tune(test.goodLength, test.maxLazy, test.niceLength, test.maxChain))
+					return zout
+				})
+			b.ReportMetric(float64(fi.Size())/float64(out.n), "ratio")
+		})
+	}
+}
+
+// benchmarkDeflateSmall creates, fills and closes writers of small messages,
+// as a pool of writers does.
+func benchmarkDeflateSmall(b *testing.B, opts zlib.WriterOptions) {
+	msg := randomText(rand.New(rand.NewSource(0)), 200)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		zout, err := zlib.NewWriterOpts(ioutil.Discard, opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := zout.Write(msg); err != nil {
+			b.Fatal(err)
+		}
+		if err := zout.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDeflateSmall(b *testing.B) {
+	benchmarkDeflateSmall(b, zlib.WriterOptions{PoolBuffer: true})
+}
+
+func BenchmarkDeflateSmallNoFinalizer(b *testing.B) {
+	benchmarkDeflateSmall(b, zlib.WriterOptions{PoolBuffer: true, NoFinalizer: true})
+}
+
+func BenchmarkCompressSmall(b *testing.B) {
+	msg := randomText(rand.New(rand.NewSource(0)), 200)
+	dst := make([]byte, 0, 1000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := zlib.Compress(dst, msg, zlib.DefaultCompression); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkDecompress decodes a gzip file of text of size bytes with
+// decompress.
+func benchmarkDecompress(b *testing.B, size int, decompress func(dst, src []byte) ([]byte, error)) {
+	text := randomText(rand.New(rand.NewSource(0)), size)
+	stream, err := zlib.Compress(nil, text, zlib.DefaultCompression)
+	if err != nil {
+		b.Fatal(err)
+	}
+	dst := make([]byte, 0, size)
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decompress(dst, stream); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// decompressReader decodes with a reader that it reuses, as a pool of readers
+// does.
+func decompressReader(size int) func(dst, src []byte) ([]byte, error) {
+	var zin zlib.Reader
+	var in bytes.Reader
+	return func(dst, src []byte) ([]byte, error) {
+		in.Reset(src)
+		if zin == nil {
+			var err error
+			if zin, err = zlib.NewReader(&in); err != nil {
+				return nil, err
+			}
+		} else if err := zin.Reset(&in); err != nil {
+			return nil, err
+		}
+		n, err := io.ReadFull(zin, dst[len(dst):len(dst)+size])
+		return dst[:len(dst)+n], err
+	}
+}
+
+func BenchmarkDecompress(b *testing.B) {
+	for _, size := range []int{1000, 100000} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			b.Run("reader", func(b *testing.B) {
+				benchmarkDecompress(b, size, decompressReader(size))
+			})
+			b.Run("Decompress", func(b *testing.B) {
+				benchmarkDecompress(b, size, zlib.Decompress)
+			})
+			b.Run("DecompressWithSize", func(b *testing.B) {
+				benchmarkDecompress(b, size, func(dst, src []byte) ([]byte, error) {
+					return zlib.DecompressWithSize(dst, src, size)
+				})
+			})
+		})
+	}
+}
+
+// benchmarkDeflateCopy compresses the file at path with io.Copy straight from
+// the file, so that the writer's ReadFrom, if any, reads it.
+func benchmarkDeflateCopy(
+	b *testing.B,
+	path string,
+	deflateFactory func(out io.Writer) io.WriteCloser) {
+	for i := 0; i < b.N; i++ {
+		deflator := deflateFactory(&discardingWriter{})
+		in, err := os.Open(path)
+		assert.NoError(b, err)
+		_, err = io.Copy(deflator, in)
+		assert.NoError(b, err)
+		assert.NoError(b, deflator.Close())
+		assert.NoError(b, in.Close())
+	}
+}
+
+func BenchmarkDeflateZlibReadFrom(b *testing.B) {
+	benchmarkDeflateCopy(b, *testPathFlag,
+		func(out io.Writer) io.WriteCloser {
+			w, err := zlib.NewWriterLevel(out, 5, 512<<10)
+			assert.NoError(b, err)
+			return w
+		})
+}
+
+func BenchmarkDeflateZlibCopyBuffer(b *testing.B) {
+	benchmarkDeflateCopy(b, *testPathFlag,
+		func(out io.Writer) io.WriteCloser {
+			w, err := zlib.NewWriterLevel(out, 5, 512<<10)
+			assert.NoError(b, err)
+			// Hide ReadFrom, so that io.Copy uses a 32KB buffer.
+			return struct{ io.WriteCloser }{w}
+		})
+}
@@ -5,11 +5,10 @@
 #include <string.h>
 #include <zlib.h>
 
-int zs_inflate_init(char* stream) {
+int zs_inflate_init(char* stream, int window_bits) {
   z_stream* zs = (z_stream*)stream;
   memset(zs, 0, sizeof(*zs));
-  // 16 makes it understand only gzip files
-  return inflateInit2_(zs, 16 + 15, ZLIB_VERSION, sizeof(*zs));
+  return inflateInit2_(zs, window_bits, ZLIB_VERSION, sizeof(*zs));
 }
 
 void zs_inflate_end(char* stream) { inflateEnd((z_stream*)stream); }
@@ -21,60 +20,192 @@ int zs_inflate_reset(char* stream) {
 
 int zs_get_errno() { return errno; }
 
-int zs_inflate(char* stream, void* in, int in_bytes, void* out, int* out_bytes,
-               int* consumed_input) {
+const char* zs_get_msg(char* stream) { return ((z_stream*)stream)->msg; }
+
+unsigned long zs_get_adler(char* stream) { return ((z_stream*)stream)->adler; }
+
+unsigned long zs_crc32_combine(unsigned long crc1, unsigned long crc2,
+                               long long len2) {
+  return crc32_combine(crc1, crc2, (z_off_t)len2);
+}
+
+unsigned long zs_adler32_combine(unsigned long adler1, unsigned long adler2,
+                                 long long len2) {
+  return adler32_combine(adler1, adler2, (z_off_t)len2);
+}
+
+int zs_get_data_type(char* stream) { return ((z_stream*)stream)->data_type; }
+
+zs_header* zs_header_new(int extra_max) {
+  zs_header* h = calloc(1, sizeof(zs_header));
+  if (h == NULL || extra_max == 0) {
+    return h;
+  }
+  h->extra = malloc(extra_max);
+  if (h->extra == NULL) {
+    free(h);
+    return NULL;
+  }
+  h->extra_max = extra_max;
+  return h;
+}
+
+void zs_header_free(zs_header* h) {
+  free(h->extra);
+  free(h);
+}
+
+int zs_inflate_get_header(char* stream, zs_header* h) {
+  memset(&h->head, 0, sizeof(h->head));
+  h->head.name = h->name;
+  h->head.name_max = ZS_NAME_MAX;
+  h->head.comment = h->comment;
+  h->head.comm_max = ZS_COMMENT_MAX;
+  h->head.extra = h->extra;
+  h->head.extra_max = h->extra_max;
+  return inflateGetHeader((z_stream*)stream, &h->head);
+}
+
+void zs_header_copy(zs_header* dst, const zs_header* src) {
+  // head keeps pointing to the buffers of the header it was installed in.
+  dst->head = src->head;
+  memcpy(dst->name, src->name, ZS_NAME_MAX);
+  memcpy(dst->comment, src->comment, ZS_COMMENT_MAX);
+  if (src->extra != NULL) {
+    memcpy(dst->extra, src->extra, src->extra_max);
+  }
+}
+
+int zs_inflate_copy(char* dst, char* src) {
+  return inflateCopy((z_stream*)dst, (z_stream*)src);
+}
+
+int zs_inflate_validate(char* stream, int check) {
+  return inflateValidate((z_stream*)stream, check);
+}
+
+int zs_inflate_set_dictionary(char* stream, void* dict, int dict_bytes) {
+  return inflateSetDictionary((z_stream*)stream, dict, dict_bytes);
+}
+
+int zs_inflate(char* stream, void* in, int* in_bytes, void* out,
+               int* out_bytes) {
   z_stream* zs = (z_stream*)stream;
-  if (in_bytes > 0) {
-    if (zs->avail_in != 0) {
-      abort();
+  zs->next_in = in;
+  zs->avail_in = *in_bytes;
+  zs->next_out = out;
+  zs->avail_out = *out_bytes;
+  int ret = inflate(zs, Z_NO_FLUSH);
+  *in_bytes = zs->avail_in;
+  *out_bytes = zs->avail_out;
+  return ret;
+}
+
+int zs_inflate_block(char* stream, void* in, int* in_bytes, void* out,
+                     int* out_bytes) {
+  z_stream* zs = (z_stream*)stream;
+  zs->next_in = in;
+  zs->avail_in = *in_bytes;
+  zs->next_out = out;
+  zs->avail_out = *out_bytes;
+  int ret = inflate(zs, Z_BLOCK);
+  *in_bytes = zs->avail_in;
+  *out_bytes = zs->avail_out;
+  return ret;
+}
+
+int zs_inflate_all(char* stream, int reset, int multistream, void* in,
+                   size_t* in_bytes, void* out, size_t* out_bytes) {
+  z_stream* zs = (z_stream*)stream;
+  int ret;
+  if (reset && (ret = inflateReset(zs)) != Z_OK) {
+    return ret;
+  }
+  // avail_in and avail_out are 32 bits, so large buffers take several calls.
+  const uInt max = (uInt)-1;
+  size_t in_left = *in_bytes, out_left = *out_bytes;
+  zs->next_in = in;
+  zs->avail_in = 0;
+  zs->next_out = out;
+  zs->avail_out = 0;
+  for (;;) {
+    if (zs->avail_out == 0) {
+      zs->avail_out = out_left > max ? max : (uInt)out_left;
+      out_left -= zs->avail_out;
     }
-    zs->avail_in = in_bytes;
-    zs->next_in = in;
-  } else {
     if (zs->avail_in == 0) {
-      abort();
+      zs->avail_in = in_left > max ? max : (uInt)in_left;
+      in_left -= zs->avail_in;
+    }
+    ret = inflate(zs, Z_NO_FLUSH);
+    if (ret == Z_STREAM_END && multistream &&
+        (zs->avail_in > 0 || in_left > 0)) {
+      // Another gzip member follows.
+      if ((ret = inflateReset(zs)) != Z_OK) {
+        break;
+      }
+      continue;
+    }
+    if (ret != Z_OK || (zs->avail_in == 0 && in_left == 0) ||
+        (zs->avail_out == 0 && out_left == 0)) {
+      break;
     }
   }
-  zs->next_out = out;
-  zs->avail_out = *out_bytes;
-  int ret = inflate((z_stream*)stream, Z_NO_FLUSH);
-  if (ret == Z_OK || ret == Z_STREAM_END) {
-    *out_bytes = zs->avail_out;
-  }
-  *consumed_input = (zs->avail_in == 0);
+  *in_bytes = in_left + zs->avail_in;
+  *out_bytes -= out_left + zs->avail_out;
+  // Keep no pointers to the Go buffers.
+  zs->next_in = NULL;
+  zs->avail_in = 0;
+  zs->next_out = NULL;
+  zs->avail_out = 0;
   return ret;
 }
 
-int zs_deflate_init(char* stream, int level) {
+int zs_inflate_prime(char* stream, int bits, int value) {
+  return inflatePrime((z_stream*)stream, bits, value);
+}
+
+int zs_inflate_sync(char* stream, void* in, int* in_bytes) {
+  z_stream* zs = (z_stream*)stream;
+  zs->next_in = in;
+  zs->avail_in = *in_bytes;
+  int ret = inflateSync(zs);
+  *in_bytes = zs->avail_in;
+  return ret;
+}
+
+int zs_deflate_init(char* stream, int level, int window_bits, int mem_level,
+                    int strategy) {
   z_stream* zs = (z_stream*)stream;
   memset(zs, 0, sizeof(*zs));
-  return deflateInit2(zs, level, Z_DEFLATED, 16 + 15, 8, Z_DEFAULT_STRATEGY);
+  return deflateInit2(zs, level, Z_DEFLATED, window_bits, mem_level, strategy);
 }
 
-int zs_deflate(char* stream, void* in, int in_bytes, void* out,
-               int* out_bytes) {
+int zs_deflate(char* stream, void* in, int* in_bytes, void* out,
+               int* out_bytes, int flush) {
   z_stream* zs = (z_stream*)stream;
-  if (in_bytes > 0) {
+  if (*in_bytes > 0) {
     if (zs->avail_in != 0) {  // has buffered input
       abort();
     }
-    zs->avail_in = in_bytes;
+    zs->avail_in = *in_bytes;
     zs->next_in = in;
-  } else if (zs->avail_in == 0) {
-    abort();
   }
+  // Without input, deflate still writes output it has pending, or returns
+  // Z_BUF_ERROR if it has none.
   zs->next_out = out;
   zs->avail_out = *out_bytes;
-  int ret = deflate(zs, Z_NO_FLUSH);
+  int ret = deflate(zs, flush);
+  *in_bytes = zs->avail_in;
   *out_bytes = zs->avail_out;
   return ret;
 }
 
-int zs_deflate_flush(char* stream, void* out, int* out_bytes) {
+int zs_deflate_flush(char* stream, int flush, void* out, int* out_bytes) {
   z_stream* zs = (z_stream*)stream;
   zs->next_out = out;
   zs->avail_out = *out_bytes;
-  int ret = deflate(zs, Z_SYNC_FLUSH);
+  int ret = deflate(zs, flush);
   *out_bytes = zs->avail_out;
   return ret;
 }
@@ -91,11 +222,128 @@ int zs_deflate_finish(char* stream, void* out, int* out_bytes) {
   return ret;
 }
 
+int zs_deflate_params(char* stream, int level, int strategy, void* out,
+                      int* out_bytes) {
+  z_stream* zs = (z_stream*)stream;
+  zs->next_out = out;
+  zs->avail_out = *out_bytes;
+  int ret = deflateParams(zs, level, strategy);
+  *out_bytes = zs->avail_out;
+  return ret;
+}
+
+int zs_deflate_pending(char* stream, unsigned* pending, int* bits) {
+  return deflatePending((z_stream*)stream, pending, bits);
+}
+
+unsigned long zs_deflate_bound(char* stream, unsigned long source_len) {
+  return deflateBound((z_stream*)stream, source_len);
+}
+
+int zs_deflate_tune(char* stream, int good_length, int max_lazy,
+                    int nice_length, int max_chain) {
+  return deflateTune((z_stream*)stream, good_length, max_lazy, nice_length,
+                     max_chain);
+}
+
+int zs_deflate_all(char* stream, void* in, size_t in_bytes, void* out,
+                   size_t* out_bytes) {
+  z_stream* zs = (z_stream*)stream;
+  int ret = deflateReset(zs);
+  if (ret != Z_OK) {
+    return ret;
+  }
+  // avail_in and avail_out are 32 bits, so large buffers take several calls.
+  const uInt max = (uInt)-1;
+  size_t out_left = *out_bytes;
+  zs->next_in = in;
+  zs->avail_in = 0;
+  zs->next_out = out;
+  zs->avail_out = 0;
+  do {
+    if (zs->avail_out == 0) {
+      zs->avail_out = out_left > max ? max : (uInt)out_left;
+      out_left -= zs->avail_out;
+    }
+    if (zs->avail_in == 0) {
+      zs->avail_in = in_bytes > max ? max : (uInt)in_bytes;
+      in_bytes -= zs->avail_in;
+    }
+    ret = deflate(zs, in_bytes > 0 ? Z_NO_FLUSH : Z_FINISH);
+  } while (ret == Z_OK && (zs->avail_out > 0 || out_left > 0));
+  *out_bytes = zs->total_out;
+  // Keep no pointers to the Go buffers.
+  zs->next_in = NULL;
+  zs->avail_in = 0;
+  zs->next_out = NULL;
+  zs->avail_out = 0;
+  return ret;
+}
+
 int zs_deflate_reset(char* stream) {
   z_stream* zs = (z_stream*)stream;
+  // Drop the input of a deflate call that failed to write its output.
+  zs->avail_in = 0;
+  zs->next_in = NULL;
   return deflateReset(zs);
 }
 
+int zs_deflate_set_dictionary(char* stream, void* dict, int dict_bytes) {
+  return deflateSetDictionary((z_stream*)stream, dict, dict_bytes);
+}
+
+gz_header* zs_gz_header_new(void) { return calloc(1, sizeof(gz_header)); }
+
+void zs_gz_header_free(gz_header* h) {
+  free(h->extra);
+  free(h->name);
+  free(h->comment);
+  free(h);
+}
+
+gz_header* zs_gz_header_dup(const gz_header* h) {
+  gz_header* d = calloc(1, sizeof(gz_header));
+  if (d == NULL) {
+    return NULL;
+  }
+  *d = *h;
+  d->extra = NULL;
+  d->name = NULL;
+  d->comment = NULL;
+  if (h->extra != NULL) {
+    d->extra = malloc(h->extra_len + 1);
+    if (d->extra == NULL) {
+      goto fail;
+    }
+    memcpy(d->extra, h->extra, h->extra_len);
+    d->extra[h->extra_len] = 0;
+  }
+  if (h->name != NULL) {
+    d->name = (Bytef*)strdup((const char*)h->name);
+    if (d->name == NULL) {
+      goto fail;
+    }
+  }
+  if (h->comment != NULL) {
+    d->comment = (Bytef*)strdup((const char*)h->comment);
+    if (d->comment == NULL) {
+      goto fail;
+    }
+  }
+  return d;
+fail:
+  zs_gz_header_free(d);
+  return NULL;
+}
+
+int zs_deflate_set_header(char* stream, gz_header* h) {
+  return deflateSetHeader((z_stream*)stream, h);
+}
+
+int zs_deflate_copy(char* dst, char* src) {
+  return deflateCopy((z_stream*)dst, (z_stream*)src);
+}
+
 int zs_deflate_end(char* stream) {
   z_stream* zs = (z_stream*)stream;
   return deflateEnd(zs);
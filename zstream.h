@@ -1,20 +1,73 @@
 #ifndef ZSTREAM_H
 #define ZSTREAM_H
 
-extern int zs_inflate_init(char* stream);
+#include <zlib.h>
+
+// Maximum number of bytes of the gzip FNAME and FCOMMENT fields captured by
+// the reader, including the terminating NUL. Longer fields are truncated.
+#define ZS_NAME_MAX 1024
+#define ZS_COMMENT_MAX 1024
+
+// zs_header owns the buffers that a gz_header points to. inflate overwrites
+// head.name and head.comment with NULL when a field is absent, so the buffers
+// are kept separately and reinstalled by zs_inflate_get_header.
+typedef struct zs_header {
+  gz_header head;
+  Bytef name[ZS_NAME_MAX];
+  Bytef comment[ZS_COMMENT_MAX];
+  Bytef* extra;  // NULL if extra_max is 0.
+  uInt extra_max;
+} zs_header;
+
+extern int zs_inflate_init(char* stream, int window_bits);
 extern int zs_inflate_reset(char* stream);
 extern void zs_inflate_end(char* stream);
-extern int zs_inflate(char* stream, void* in, int in_bytes, void* out,
-                      int* out_bytes, int* consumed_input);
-
-extern int zs_deflate_init(char* stream, int level);
-extern int zs_deflate(char* stream, void* in, int in_bytes, void* out,
+extern zs_header* zs_header_new(int extra_max);
+extern void zs_header_free(zs_header* h);
+extern int zs_inflate_get_header(char* stream, zs_header* h);
+extern void zs_header_copy(zs_header* dst, const zs_header* src);
+extern int zs_inflate_copy(char* dst, char* src);
+extern int zs_inflate_validate(char* stream, int check);
+extern int zs_inflate_set_dictionary(char* stream, void* dict, int dict_bytes);
+extern int zs_inflate(char* stream, void* in, int* in_bytes, void* out,
                       int* out_bytes);
-extern int zs_deflate_flush(char* stream, void* out, int* out_bytes);
+extern int zs_inflate_block(char* stream, void* in, int* in_bytes, void* out,
+                            int* out_bytes);
+extern int zs_inflate_all(char* stream, int reset, int multistream, void* in,
+                          size_t* in_bytes, void* out, size_t* out_bytes);
+extern int zs_inflate_prime(char* stream, int bits, int value);
+extern int zs_inflate_sync(char* stream, void* in, int* in_bytes);
+
+extern int zs_deflate_init(char* stream, int level, int window_bits,
+                           int mem_level, int strategy);
+extern int zs_deflate(char* stream, void* in, int* in_bytes, void* out,
+                      int* out_bytes, int flush);
+extern int zs_deflate_flush(char* stream, int flush, void* out, int* out_bytes);
 extern int zs_deflate_finish(char* stream, void* out, int* out_bytes);
 extern int zs_deflate_reset(char* stream);
+extern int zs_deflate_all(char* stream, void* in, size_t in_bytes, void* out,
+                          size_t* out_bytes);
+extern unsigned long zs_deflate_bound(char* stream, unsigned long source_len);
+extern int zs_deflate_tune(char* stream, int good_length, int max_lazy,
+                           int nice_length, int max_chain);
+extern int zs_deflate_pending(char* stream, unsigned* pending, int* bits);
+extern int zs_deflate_params(char* stream, int level, int strategy, void* out,
+                             int* out_bytes);
+extern int zs_deflate_set_dictionary(char* stream, void* dict, int dict_bytes);
+extern gz_header* zs_gz_header_new(void);
+extern void zs_gz_header_free(gz_header* h);
+extern gz_header* zs_gz_header_dup(const gz_header* h);
+extern int zs_deflate_set_header(char* stream, gz_header* h);
+extern int zs_deflate_copy(char* dst, char* src);
 extern int zs_deflate_end(char* stream);
 
 extern int zs_get_errno();
+extern const char* zs_get_msg(char* stream);
+extern unsigned long zs_get_adler(char* stream);
+extern unsigned long zs_crc32_combine(unsigned long crc1, unsigned long crc2,
+                                      long long len2);
+extern unsigned long zs_adler32_combine(unsigned long adler1,
+                                        unsigned long adler2, long long len2);
+extern int zs_get_data_type(char* stream);
 
 #endif /* ZSTREAM_H */